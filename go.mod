@@ -3,13 +3,16 @@ module github.com/IMQS/router
 go 1.22.7
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/IMQS/go-apachelog v0.0.0-20250801094120-5180d6788d2b
 	github.com/IMQS/gowinsvc v1.2.0
 	github.com/IMQS/log v1.4.0
 	github.com/IMQS/serviceauth v1.4.0
 	github.com/IMQS/serviceconfigsgo v1.4.0
+	golang.org/x/crypto v0.27.0
 	golang.org/x/net v0.29.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -25,7 +25,7 @@ case ARGV[0]
 		# At present the tests behave no differently when run with -race and without,
 		# but it's a likely thing to do in future. ie.. make some stress tests run only with -race off,
 		# because -race uses 10x the memory and is 10x slower.
-		exec_or_die( "go test github.com/IMQS/router/server -test.cpu 2" )
+		exec_or_die( "go test github.com/IMQS/router/server github.com/IMQS/router/signing -test.cpu 2" )
 	when "test_integration" then
 		# TODO: try logging into our IMQS domain (or whatever's appropriate for a CI box)
 end
@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/IMQS/gowinsvc/service"
 	"github.com/IMQS/router/server"
@@ -27,11 +29,24 @@ func realMain() (result int) {
 	flags := flag.NewFlagSet("router", flag.ExitOnError)
 	configFile := flags.String("config", "", "Optional config file for testing")
 	showHttpPort := flags.Bool("show-http-port", false, "print the http port to stdout and exit")
+	showConfig := flags.Bool("show-config", false, "print the effective config, with all includes merged, and exit")
+	showSchema := flags.Bool("config-schema", false, "print the JSON Schema of the config file and exit")
+	standalone := flags.Bool("standalone", false, "run without the IMQS config service. Requires -config")
 
 	if len(os.Args) > 1 {
 		flags.Parse(os.Args[1:])
 	}
 
+	if *showSchema {
+		fmt.Print(string(server.ConfigJSONSchema()))
+		result = 0
+		return
+	}
+
+	if *standalone && *configFile == "" {
+		panic(fmt.Errorf("-standalone needs a config file, specified with -config"))
+	}
+
 	config := &server.Config{}
 
 	err := config.LoadFile(*configFile)
@@ -39,6 +54,10 @@ func realMain() (result int) {
 		panic(fmt.Errorf("Error loading '%s': %v", *configFile, err))
 	}
 
+	if *standalone {
+		config.ConfigService.Type = server.ConfigServiceNone
+	}
+
 	if os.Getenv("DISABLE_HTTPS_REDIRECT") == "1" {
 		config.HTTP.RedirectHTTP = false
 	}
@@ -68,6 +87,12 @@ func realMain() (result int) {
 		config.HTTP.EnableHTTPS = true
 	}
 
+	if *showConfig {
+		fmt.Println(config.EffectiveConfig())
+		result = 0
+		return
+	}
+
 	server, err := server.NewServer(config)
 	if err != nil {
 		panic(fmt.Errorf("Error starting server: %v", err))
@@ -82,10 +107,12 @@ func realMain() (result int) {
 	}
 	success := true
 	if !service.RunAsService(handlerNoRet) {
-		// Run in the foreground
+		// Run in the foreground, until a listener fails, or we are interrupted
 		success = false
-		fmt.Print(handler())
+		fmt.Print(runForeground(handler))
 	}
+	// The process is about to exit, whether the service was stopped, or the foreground run ended
+	server.Close()
 
 	if success {
 		result = 0
@@ -94,3 +121,18 @@ func realMain() (result int) {
 	}
 	return
 }
+
+func runForeground(handler func() error) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	errors := make(chan error, 1)
+	go func() {
+		errors <- handler()
+	}()
+	select {
+	case err := <-errors:
+		return err
+	case sig := <-interrupt:
+		return fmt.Errorf("Stopped by %v", sig)
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/serviceauth"
+)
+
+// What happens to a request that matches none of the audit rules
+const (
+	AuditUnmatchedAllow = "Allow" // The request continues, without being recorded. This is the default.
+	AuditUnmatchedDeny  = "Deny"  // The request is refused with 400
+)
+
+// The audit rules of ECS targets that don't have their own. These used to be hard-coded into the
+// ECS pass-through provider.
+var ecsAuditDefaults = ConfigAudit{
+	Rules: []ConfigAuditRule{
+		{
+			Path:    "/ecs/ACCESS/([^/]*)/([^/]*)",
+			DidWhat: "$1",
+			ToWhat:  "site gate: $2",
+			Context: `{"url": "${request.url}","origin": "ecs api passthrough router"}`,
+		},
+		{
+			Path:    "/ecs/sam/([^/]*)/([^/]*)",
+			DidWhat: "$1",
+			ToWhat:  "site: $2",
+			Context: `{"url": "${request.url}","origin": "ecs api passthrough router"}`,
+		},
+	},
+	Unmatched: AuditUnmatchedDeny,
+}
+
+// Variables that audit templates may use, besides the capture groups of the rule's Path
+var auditBuiltinVars = []string{"request.method", "request.path", "request.url", "user.id", "user.username", "user.email"}
+
+// Matches ${name}, $1 and $name
+var auditTemplateVar = regexp.MustCompile(`\$\{([A-Za-z0-9_.]+)\}|\$([A-Za-z0-9_]+)`)
+
+// Records requests in the imqsauth audit log. Replaced by tests.
+var addToAuditLog = serviceauth.AddToAuditLog
+
+// auditRules decide which requests to a route are recorded in the imqsauth audit log, and what is
+// recorded about them. The first rule that matches a request wins.
+type auditRules struct {
+	rules         []*auditRule
+	denyUnmatched bool
+}
+
+type auditRule struct {
+	methods map[string]bool // Empty matches all methods
+	path    *regexp.Regexp
+	didWhat string // Templates
+	toWhat  string
+	context string
+}
+
+// Returns nil if nothing is audited
+func newAuditRules(c *ConfigAudit) (*auditRules, error) {
+	a := &auditRules{}
+	switch c.Unmatched {
+	case "", AuditUnmatchedAllow:
+	case AuditUnmatchedDeny:
+		a.denyUnmatched = true
+	default:
+		return nil, fmt.Errorf("Audit Unmatched must be '%v' or '%v'", AuditUnmatchedAllow, AuditUnmatchedDeny)
+	}
+	for i := range c.Rules {
+		rule, err := newAuditRule(&c.Rules[i])
+		if err != nil {
+			return nil, fmt.Errorf("Audit rule %v: %v", i+1, err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	if len(a.rules) == 0 && !a.denyUnmatched {
+		return nil, nil
+	}
+	return a, nil
+}
+
+func newAuditRule(c *ConfigAuditRule) (*auditRule, error) {
+	if c.Path == "" {
+		return nil, fmt.Errorf("Path is required")
+	}
+	path, err := regexp.Compile("^(?:" + c.Path + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Path: %v", err)
+	}
+	r := &auditRule{
+		methods: map[string]bool{},
+		path:    path,
+		didWhat: c.DidWhat,
+		toWhat:  c.ToWhat,
+		context: c.Context,
+	}
+	for _, m := range c.Methods {
+		r.methods[strings.ToUpper(m)] = true
+	}
+	if r.didWhat == "" && (r.toWhat != "" || r.context != "") {
+		return nil, fmt.Errorf("ToWhat and Context need DidWhat")
+	}
+	if r.toWhat == "" {
+		r.toWhat = "${request.url}"
+	}
+	if r.context == "" {
+		r.context = "{}"
+	}
+
+	// Make sure that the templates only refer to things that exist, and that Context produces JSON
+	known := map[string]bool{}
+	for _, name := range auditBuiltinVars {
+		known[name] = true
+	}
+	for i, name := range path.SubexpNames() {
+		known[strconv.Itoa(i)] = true
+		if name != "" {
+			known[name] = true
+		}
+	}
+	for field, tmpl := range map[string]string{"DidWhat": r.didWhat, "ToWhat": r.toWhat, "Context": r.context} {
+		for _, m := range auditTemplateVar.FindAllStringSubmatch(tmpl, -1) {
+			if name := m[1] + m[2]; !known[name] {
+				return nil, fmt.Errorf("%v refers to unknown variable '%v'", field, name)
+			}
+		}
+	}
+	if !json.Valid([]byte(expandAuditTemplate(r.context, func(string) string { return "x" }, true))) {
+		return nil, fmt.Errorf("Context must be JSON, with variables inside strings")
+	}
+	return r, nil
+}
+
+// Replace the variables in tmpl. If forJSON is true, then values are escaped for use inside a JSON string.
+func expandAuditTemplate(tmpl string, lookup func(name string) string, forJSON bool) string {
+	return auditTemplateVar.ReplaceAllStringFunc(tmpl, func(v string) string {
+		m := auditTemplateVar.FindStringSubmatch(v)
+		value := lookup(m[1] + m[2])
+		if forJSON {
+			quoted, _ := json.Marshal(value)
+			value = string(quoted[1 : len(quoted)-1])
+		}
+		return value
+	})
+}
+
+// Returns the rule that matches req, and the values of its capture groups, or nil
+func (a *auditRules) match(req *http.Request) (*auditRule, []string) {
+	for _, r := range a.rules {
+		if len(r.methods) != 0 && !r.methods[req.Method] {
+			continue
+		}
+		if groups := r.path.FindStringSubmatch(req.URL.Path); groups != nil {
+			return r, groups
+		}
+	}
+	return nil, nil
+}
+
+// Record req in the audit log, if a rule asks for it. Returns false if the request may not continue,
+// in which case an error has already been sent.
+func (a *auditRules) record(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	rule, groups := a.match(req)
+	if rule == nil {
+		if a.denyUnmatched {
+			http.Error(w, "Unknown URL for this route", http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+	if rule.didWhat == "" {
+		// The rule allows the request, without recording it
+		return true
+	}
+	lookup := func(name string) string {
+		if n, err := strconv.Atoi(name); err == nil {
+			return groups[n]
+		}
+		if i := rule.path.SubexpIndex(name); i > 0 {
+			return groups[i]
+		}
+		switch name {
+		case "request.method":
+			return req.Method
+		case "request.path":
+			return req.URL.Path
+		case "request.url":
+			return req.URL.String()
+		}
+		if authData != nil {
+			switch name {
+			case "user.id":
+				return strconv.Itoa(authData.UserID)
+			case "user.username":
+				return authData.Username
+			case "user.email":
+				return authData.Email
+			}
+		}
+		return ""
+	}
+	didWhat := expandAuditTemplate(rule.didWhat, lookup, false)
+	toWhat := expandAuditTemplate(rule.toWhat, lookup, false)
+	context := expandAuditTemplate(rule.context, lookup, true)
+	statusCode, err := addToAuditLog(req, didWhat, toWhat, context)
+	if err != nil {
+		log.Errorf("Error logging user action: %v", err)
+		http.Error(w, err.Error(), statusCode)
+		return false
+	}
+	return true
+}
+
+// Returns the audit rules of this route, or nil if it has none
+func (r *route) auditRules() *auditRules {
+	if r.audit != nil {
+		return r.audit
+	}
+	return r.target.audit
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	backend := newOKBackend(t)
+
+	type entry struct{ didWhat, toWhat, context string }
+	entries := []entry{}
+	auditFails := false
+	defer func(original func(*http.Request, string, string, string) (int, error)) { addToAuditLog = original }(addToAuditLog)
+	addToAuditLog = func(req *http.Request, didWhat, toWhat, context string) (int, error) {
+		if auditFails {
+			return http.StatusServiceUnavailable, errors.New("imqsauth is down")
+		}
+		entries = append(entries, entry{didWhat, toWhat, context})
+		return http.StatusOK, nil
+	}
+
+	s, _ := newTestServer(t, `{
+		"Targets": {
+			"ECS": {"URL": "`+backend.URL+`", "PassThroughAuth": {"Type": "ECS", "Username": "u", "Password": "p"}},
+			"ASSETS": {"URL": "`+backend.URL+`"}
+		},
+		"Routes": {
+			"/ecs/(.*)": "{ECS}/$1",
+			"/assets/(.*)": {"Target": "{ASSETS}/$1", "Audit": {
+				"Unmatched": "Deny",
+				"Rules": [
+					{"Methods": ["delete"], "Path": "/assets/(?P<kind>\\w+)/(\\d+)", "DidWhat": "delete ${kind}", "ToWhat": "$2",
+						"Context": "{\"by\": \"${user.username}\", \"path\": \"${request.path}\"}"},
+					{"Methods": ["GET"], "Path": "/assets/.*"}
+				]}}
+		}}`)
+
+	expect := func(method, path string, code int, expected *entry) {
+		t.Helper()
+		entries = entries[:0]
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, httptest.NewRequest(method, path, nil))
+		if w.Code != code {
+			t.Errorf("%v %v: expected %v, but got %v %v", method, path, code, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+		if expected == nil && len(entries) != 0 {
+			t.Errorf("%v %v: expected nothing to be audited, but got %v", method, path, entries)
+		} else if expected != nil && (len(entries) != 1 || entries[0] != *expected) {
+			t.Errorf("%v %v: expected %v to be audited, but got %v", method, path, *expected, entries)
+		}
+	}
+
+	// The ECS defaults, which used to be hard-coded
+	expect("GET", "/ecs/ACCESS/open/gate7", 200, &entry{"open", "site gate: gate7", `{"url": "/ecs/ACCESS/open/gate7","origin": "ecs api passthrough router"}`})
+	expect("POST", "/ecs/sam/ForceSim1/site3", 200, &entry{"ForceSim1", "site: site3", `{"url": "/ecs/sam/ForceSim1/site3","origin": "ecs api passthrough router"}`})
+	expect("GET", "/ecs/other/thing/1", 400, nil)
+
+	expect("DELETE", `/assets/pipe/42`, 200, &entry{"delete pipe", "42", `{"by": "", "path": "/assets/pipe/42"}`})
+	// A rule without DidWhat lets requests through without recording them
+	expect("GET", "/assets/pipe/42", 200, nil)
+	expect("PUT", "/assets/pipe/42", 400, nil)
+
+	// Values are escaped inside the JSON context
+	quote := func(string) string { return `say "hi"` }
+	if got := expandAuditTemplate(`{"a": "$1"}`, quote, true); got != `{"a": "say \"hi\""}` {
+		t.Errorf("Context value was not escaped: %v", got)
+	}
+
+	auditFails = true
+	expect("DELETE", "/assets/pipe/42", http.StatusServiceUnavailable, nil)
+
+	expectTargetErrors(t, "Audit",
+		`{"Rules": [{"Path": "/x/(.*)", "DidWhat": "$2"}]}`,
+		`{"Rules": [{"Path": "/x/(.*)", "DidWhat": "$nothing"}]}`,
+		`{"Rules": [{"Path": "/x/(.*)", "DidWhat": "x", "Context": "{\"a\": ${request.path}}"}]}`,
+		`{"Rules": [{"Path": "/x/(.*)", "ToWhat": "x"}]}`,
+		`{"Unmatched": "Maybe"}`,
+	)
+}
@@ -3,10 +3,9 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +13,16 @@ import (
 	"github.com/IMQS/serviceauth"
 )
 
+// The pass-through auth providers that the router has always had.
+// None of them take any Options.
+
+func init() {
+	registerPassThrough(AuthPassThroughPureHub, newPureHubProvider)
+	registerPassThrough(AuthPassThroughSitePro, newSiteProProvider)
+	registerPassThrough(AuthPassThroughECS, newECSProvider)
+	registerPassThrough(AuthPassThroughCouchDB, newCouchDBProvider)
+}
+
 /*
 Sample PureHub response:
 {
@@ -30,141 +39,142 @@ type pureHubAuthResponse struct {
 	Expires     string `json:".expires"`
 }
 
-// Returns true if the request should continue to be passed through the router
-// If you return false, then you must already have sent an appropriate error response to 'w'.
-func authPassThrough(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token, target *targetPassThroughAuth) bool {
-	switch target.config.Type {
-	case AuthPassThroughNone:
-		return true
-	case AuthPassThroughPureHub:
-		return authInjectPureHub(log, w, req, target)
-	case AuthPassThroughSitePro:
-		return authInjectSitePro(log, w, req, target)
-	case AuthPassThroughECS:
-		return authInjectECS(log, w, req, target)
-	case AuthPassThroughCouchDB:
-		return authInjectCouchDB(log, w, req, authData, target)
-	default:
-		return true
-	}
+// PureHub logs in with a username and password, and shares the resulting token between all users of the
+// target, because PureHub authentication is "machine to machine", without any user-specific session.
+type pureHubProvider struct {
+	config ConfigPassThroughAuth
+	client *http.Client
+	token  *sharedToken
 }
 
-func authInjectECS(log *log.Logger, w http.ResponseWriter, req *http.Request, target *targetPassThroughAuth) bool {
-	req.SetBasicAuth(target.config.Username, target.config.Password)
-
-	actionUrl := strings.Split(req.URL.String(), "/") // Example: "ecs/ACCESS/FWVERSION/" or "ecs/sam/ForceSim1/"
-	context := "{}"
-	didWhat := req.URL.String()
-	toWhat := req.URL.String()
-	if len(actionUrl) == 5 && actionUrl[1] == "ecs" {
-		context = `{"url": "` + req.URL.String() + `","origin": "ecs api passthrough router"}`
-		didWhat = actionUrl[3]
-		switch actionUrl[2] {
-		case "ACCESS":
-			toWhat = "site gate: " + actionUrl[4]
-		case "sam":
-			toWhat = "site: " + actionUrl[4]
-		default:
-			http.Error(w, "Unkown url to ECS API", http.StatusBadRequest) // Don't allow unkown url's to ECS API
-			return false
-		}
-	} else {
-		http.Error(w, "Unkown url to ECS API", http.StatusBadRequest) // Don't allow unkown url's to ECS API
-		return false
+func newPureHubProvider(config *ConfigPassThroughAuth) (passThroughProvider, error) {
+	if err := config.decodeOptions(&struct{}{}); err != nil {
+		return nil, err
 	}
+	if config.LoginURL == "" {
+		return nil, fmt.Errorf("PureHub needs a LoginURL")
+	}
+	p := &pureHubProvider{
+		config: *config,
+		client: http.DefaultClient,
+	}
+	p.token = newSharedToken("PureHub authentication token", time.Now, p.getToken)
+	return p, nil
+}
 
-	statusCode, err := serviceauth.AddToAuditLog(req, didWhat, toWhat, context)
+func (p *pureHubProvider) inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	header, err := p.token.get(log)
 	if err != nil {
-		log.Errorf("Error logging user action")
-		http.Error(w, err.Error(), statusCode)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return false
 	}
+	req.Header.Set("Authorization", header)
 	return true
 }
 
-func authInjectSitePro(log *log.Logger, w http.ResponseWriter, req *http.Request, target *targetPassThroughAuth) bool {
-	req.SetBasicAuth(target.config.Username, target.config.Password)
-	return true
+func (p *pureHubProvider) invalidate(rejected *http.Request) {
+	p.token.invalidate(rejected.Header.Get("Authorization"))
 }
 
-func authInjectCouchDB(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token, target *targetPassThroughAuth) bool {
-	// Allow pings to the CouchDB service
-	if req.URL.Path == "/userstorage/" {
-		return true
-	}
-
-	req.SetBasicAuth(target.config.Username, target.config.Password)
+func (p *pureHubProvider) passThroughToken() *sharedToken {
+	return p.token
+}
 
-	splitPath := strings.SplitAfter(req.URL.Path, "userdb-")
-	userIDSplitPath := strings.Split(splitPath[1], "/")
-	userIDPath, _ := strconv.Atoi(userIDSplitPath[0])
+func (p *pureHubProvider) exportTokens() interface{} {
+	if saved := p.token.save(); saved != nil {
+		return saved
+	}
+	return nil
+}
 
-	// Ensure logged-in user can only access his own data
-	if authData.UserID == userIDPath {
-		return true
+func (p *pureHubProvider) importTokens(raw json.RawMessage) error {
+	saved := &savedSharedToken{}
+	if err := json.Unmarshal(raw, saved); err != nil {
+		return err
 	}
-	return false
+	p.token.restore(saved)
+	return nil
 }
 
-func authInjectPureHub(log *log.Logger, w http.ResponseWriter, req *http.Request, target *targetPassThroughAuth) bool {
-	// The 'inject' function assumes you have obtained a lock (read or write) on "target.lock"
-	inject := func() {
-		req.Header.Set("Authorization", "Bearer "+target.token)
+func (p *pureHubProvider) getToken() (string, time.Time, error) {
+	requestBody := "grant_type=password&username=" + url.QueryEscape(p.config.Username) + "&password=" + url.QueryEscape(p.config.Password)
+	resp, err := p.client.Post(p.config.LoginURL, "application/x-www-form-urlencoded", strings.NewReader(requestBody))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("http.Post: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%v: %v", resp.Status, err)
+	}
+	var token pureHubAuthResponse
+	if err = json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("Error decoding JSON: %v", err)
 	}
+	expires, err := time.Parse(time.RFC1123, token.Expires)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// Lower the possibility of using an expired token. We happen to know that they last one hour,
+	// so chopping one minute off it should be fine.
+	return "Bearer " + token.AccessToken, expires.Add(-60 * time.Second), nil
+}
 
-	// Run with two attempts.
-	// First attempt is optimistic. We take the read lock, and inject the auth header if it is valid.
-	// On the second attempt we take the write lock, and generate a new token.
+// SitePro accepts a fixed username and password
+type siteProProvider struct {
+	config ConfigPassThroughAuth
+}
 
-	done := false
-	target.lock.RLock()
-	if target.token != "" && target.tokenExpires.After(time.Now()) {
-		done = true
-		inject()
-	}
-	target.lock.RUnlock()
-	if done {
-		return true
+func newSiteProProvider(config *ConfigPassThroughAuth) (passThroughProvider, error) {
+	if err := config.decodeOptions(&struct{}{}); err != nil {
+		return nil, err
 	}
+	return &siteProProvider{config: *config}, nil
+}
 
-	// Acquire a new token
-	target.lock.Lock()
-	err := pureHubGetToken(log, target)
-	if err == nil {
-		log.Infof("Success acquiring PureHub authentication token")
-		inject()
-	} else {
-		log.Infof("Error acquiring PureHub authentication token: %v", err)
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+func (p *siteProProvider) inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	req.SetBasicAuth(p.config.Username, p.config.Password)
+	return true
+}
+
+// ECS accepts a fixed username and password. Only a small set of URLs may be used, and every
+// request is recorded in the imqsauth audit log. That is done by the target's Audit rules, which
+// default to ecsAuditDefaults.
+type ecsProvider struct {
+	config ConfigPassThroughAuth
+}
+
+func newECSProvider(config *ConfigPassThroughAuth) (passThroughProvider, error) {
+	if err := config.decodeOptions(&struct{}{}); err != nil {
+		return nil, err
 	}
-	target.lock.Unlock()
+	return &ecsProvider{config: *config}, nil
+}
 
-	return err != nil
+func (p *ecsProvider) inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	req.SetBasicAuth(p.config.Username, p.config.Password)
+	return true
 }
 
-func pureHubGetToken(log *log.Logger, target *targetPassThroughAuth) error {
-	requestBody := "grant_type=password&username=" + url.QueryEscape(target.config.Username) + "&password=" + url.QueryEscape(target.config.Password)
-	resp, err := http.Post(target.config.LoginURL, "application/x-www-form-urlencoded", strings.NewReader(requestBody))
-	if err != nil {
-		return fmt.Errorf("http.Post: %v", err)
+// CouchDB accepts a fixed username and password. A user may only access his own database.
+type couchDBProvider struct {
+	config ConfigPassThroughAuth
+}
+
+func newCouchDBProvider(config *ConfigPassThroughAuth) (passThroughProvider, error) {
+	if err := config.decodeOptions(&struct{}{}); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err == nil {
-		var token pureHubAuthResponse
-		if err = json.Unmarshal(body, &token); err == nil {
-			target.token = token.AccessToken
-			target.tokenExpires, err = time.Parse(time.RFC1123, token.Expires)
-			if err == nil {
-				// Lower the possibility of using an expired token. We happen to know that they last one hour,
-				// so chopping one minute off it should be fine.
-				target.tokenExpires = target.tokenExpires.Add(-60 * time.Second)
-			}
-		} else {
-			return fmt.Errorf("Error decoding JSON: %v", err)
-		}
-	} else {
-		return fmt.Errorf("%v: %v", resp.Status, err)
+	return &couchDBProvider{config: *config}, nil
+}
+
+func (p *couchDBProvider) inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	// Allow pings to the CouchDB service
+	if req.URL.Path == "/userstorage/" {
+		return true
 	}
-	return err
+
+	// The target's Owner rule makes sure that users only reach their own database
+	req.SetBasicAuth(p.config.Username, p.config.Password)
+	return true
 }
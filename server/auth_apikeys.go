@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+const (
+	defaultAPIKeyHeader        = "X-API-Key"
+	defaultAPIKeyForwardHeader = "X-API-Key-Name"
+)
+
+/*
+apiKeys lets machine clients call routes without an IMQS session. The keys live in a JSON file,
+which holds only the SHA-256 hash of each key, so that the file itself is not a secret:
+
+	{
+		"Keys": [
+			{
+				"Name": "partner-x",						Sent to the backend in the ForwardHeader
+				"SHA256": "9f86d081884c7d65...",			Hex SHA-256 of the key. eg: echo -n "the key" | sha256sum
+				"Routes": ["/partner/(.*)"],				The routes that this key may call, exactly as they appear in Routes. "*" means all.
+				"Expires": "2027-01-01T00:00:00Z",			Optional
+				"AllowedIPs": ["196.1.2.0/24", "10.1.1.5"]	Optional. Addresses or CIDR ranges that the key may be used from.
+			}
+		]
+	}
+
+The file is reloaded when it changes.
+*/
+type apiKeys struct {
+	config ConfigAPIKeys
+	file   *reloadingFile // Contents are *apiKeyFile
+	now    func() time.Time
+}
+
+type apiKeyFile struct {
+	Keys []*apiKey
+
+	byHash map[string]*apiKey
+}
+
+type apiKey struct {
+	Name       string
+	SHA256     string
+	Routes     []string
+	Expires    time.Time
+	AllowedIPs []string
+
+	routes  map[string]bool
+	allowed ipList
+}
+
+// Returns nil if API keys are not configured
+func newAPIKeys(c *ConfigAPIKeys) (*apiKeys, error) {
+	if c.File == "" {
+		return nil, nil
+	}
+	k := &apiKeys{
+		config: *c,
+		now:    time.Now,
+	}
+	if k.config.Header == "" {
+		k.config.Header = defaultAPIKeyHeader
+	}
+	if k.config.ForwardHeader == "" {
+		k.config.ForwardHeader = defaultAPIKeyForwardHeader
+	}
+	var err error
+	if k.file, err = newReloadingFile(c.File, c.Reload, parseAPIKeyFile); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func parseAPIKeyFile(data []byte) (interface{}, error) {
+	f := &apiKeyFile{byHash: map[string]*apiKey{}}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(f); err != nil {
+		return nil, err
+	}
+	for _, key := range f.Keys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("Every API key needs a Name")
+		}
+		hash, err := hex.DecodeString(key.SHA256)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("API key %v: SHA256 must be 64 hex digits", key.Name)
+		}
+		normalized := hex.EncodeToString(hash)
+		if f.byHash[normalized] != nil {
+			return nil, fmt.Errorf("API key %v has the same hash as %v", key.Name, f.byHash[normalized].Name)
+		}
+		f.byHash[normalized] = key
+		key.routes = map[string]bool{}
+		for _, r := range key.Routes {
+			key.routes[r] = true
+		}
+		if key.allowed, err = parseIPList(key.AllowedIPs); err != nil {
+			return nil, fmt.Errorf("API key %v: AllowedIPs: %v", key.Name, err)
+		}
+	}
+	return f, nil
+}
+
+// Remove the key, and any identity that the client tried to forward, from the request. Returns the
+// key, or an empty string if the request doesn't have one.
+// This applies to every request, so that keys never reach a backend, even on routes that don't accept them.
+func (k *apiKeys) extract(req *http.Request) string {
+	req.Header.Del(k.config.ForwardHeader)
+	key := req.Header.Get(k.config.Header)
+	req.Header.Del(k.config.Header)
+	if k.config.QueryParam != "" && req.URL.RawQuery != "" {
+		// Only the key is removed. The rest of the query goes to the backend exactly as the client sent it,
+		// because re-encoding it would reorder the parameters, and change their escaping.
+		kept := []string{}
+		found := false
+		for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+			name, value, _ := strings.Cut(pair, "=")
+			if queryUnescape(name) != k.config.QueryParam {
+				kept = append(kept, pair)
+				continue
+			}
+			if !found && key == "" {
+				key = queryUnescape(value)
+			}
+			found = true
+		}
+		if found {
+			req.URL.RawQuery = strings.Join(kept, "&")
+			req.RequestURI = req.URL.RequestURI()
+		}
+	}
+	return key
+}
+
+// Returns s with query escaping removed, or s itself if the escaping is invalid
+func queryUnescape(s string) string {
+	if u, err := url.QueryUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// Check a key against the file. routeMatch is the route's pattern, as it appears in the Routes section of the config.
+// On success, returns the key's name. On failure, returns the HTTP status code and the reason.
+func (k *apiKeys) check(log *log.Logger, key string, routeMatch string, remoteIP string) (name string, httpCode int, err error) {
+	file := k.file.get(log).(*apiKeyFile)
+	hash := sha256.Sum256([]byte(key))
+	entry := file.byHash[hex.EncodeToString(hash[:])]
+	if entry == nil {
+		return "", http.StatusUnauthorized, fmt.Errorf("Invalid API key")
+	}
+	if !entry.Expires.IsZero() && !k.now().Before(entry.Expires) {
+		return "", http.StatusUnauthorized, fmt.Errorf("API key %v has expired", entry.Name)
+	}
+	if !entry.routes["*"] && !entry.routes[routeMatch] {
+		return "", http.StatusForbidden, fmt.Errorf("API key %v may not access %v", entry.Name, routeMatch)
+	}
+	if len(entry.allowed) != 0 && !entry.allowed.contains(net.ParseIP(remoteIP)) {
+		return "", http.StatusForbidden, fmt.Errorf("API key %v may not be used from %v", entry.Name, remoteIP)
+	}
+	return entry.Name, http.StatusOK, nil
+}
+
+// Authorize a request with an API key, instead of an IMQS session. On success, the name of the key
+// is forwarded to the backend, and returned.
+func (s *Server) authorizeAPIKey(w http.ResponseWriter, req *http.Request, key string, route *route) (name string, ok bool) {
+	if key == "" {
+		http.Error(w, "API key required", http.StatusUnauthorized)
+		return "", false
+	}
+	name, httpCode, err := s.apiKeys.check(s.errorLog, key, route.match, remoteIP(req))
+	if err != nil {
+		s.errorLog.Infof("%v", err)
+		http.Error(w, err.Error(), httpCode)
+		return "", false
+	}
+	req.Header.Set(s.apiKeys.config.ForwardHeader, name)
+	return name, true
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sha256Hex(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestAPIKeys(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v|%v|%v", r.Header.Get("X-API-Key-Name"), r.Header.Get("X-API-Key"), r.URL.RawQuery)
+	}))
+	defer backend.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "apikeys.json")
+	writeKeys := func(keys string) {
+		if err := os.WriteFile(keyFile, []byte(`{"Keys": [`+keys+`]}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys(fmt.Sprintf(`
+		{"Name": "partner", "SHA256": "%v", "Routes": ["/partner/(.*)", "/open/(.*)"], "AllowedIPs": ["10.1.0.0/16"]},
+		{"Name": "old", "SHA256": "%v", "Routes": ["*"], "Expires": "2020-01-01T00:00:00Z"}`,
+		sha256Hex("secret-1"), sha256Hex("secret-2")))
+
+	s, c := newTestServer(t, `{
+		"Auth": {"APIKeys": {"File": "`+filepath.ToSlash(keyFile)+`", "QueryParam": "api_key"}},
+		"Targets": {"PARTNER": {"URL": "`+backend.URL+`", "AllowAPIKeys": true}},
+		"Routes": {
+			"/partner/(.*)": "{PARTNER}/$1",
+			"/open/(.*)": {"Target": "`+backend.URL+`/$1", "AllowAPIKeys": true},
+			"/public/(.*)": "`+backend.URL+`/$1"
+		}}`)
+	var err error
+	if s.apiKeys, err = newAPIKeys(&c.Auth.APIKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(path, key, from string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = from + ":5000"
+		req.Header.Set("X-API-Key-Name", "spoofed")
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+	expect := func(path, key, from string, code int, body string) {
+		t.Helper()
+		gotCode, gotBody := send(path, key, from)
+		if gotCode != code || (body != "" && gotBody != body) {
+			t.Errorf("%v with key %q from %v: expected %v %q, but got %v %q", path, key, from, code, body, gotCode, gotBody)
+		}
+	}
+
+	expect("/partner/a", "secret-1", "10.1.2.3", 200, "partner||")
+	expect("/open/a?x=1&api_key=secret-1", "", "10.1.2.3", 200, "partner||x=1")
+	expect("/open/a", "", "10.1.2.3", 401, "API key required")
+	expect("/partner/a", "wrong", "10.1.2.3", 401, "Invalid API key")
+	expect("/partner/a", "secret-1", "10.2.0.1", 403, "API key partner may not be used from 10.2.0.1")
+	expect("/partner/a", "secret-2", "10.1.2.3", 401, "API key old has expired")
+	// Routes that don't accept keys still lose them, along with any identity that the client made up
+	expect("/public/a?api_key=secret-1", "secret-1", "10.1.2.3", 200, "||")
+	// The rest of the query is left exactly as the client sent it
+	expect("/open/a?b=1%20x&api%5Fkey=secret-1&a=2;c&api_key=other", "", "10.1.2.3", 200, "partner||b=1%20x&a=2;c")
+
+	// Keys are reloaded when the file changes
+	s.apiKeys.file.now = func() time.Time { return time.Now().Add(time.Hour) }
+	writeKeys(fmt.Sprintf(`{"Name": "renamed", "SHA256": "%v", "Routes": ["/partner/(.*)"]}`, sha256Hex("secret-1")))
+	expect("/partner/a", "secret-1", "10.2.0.1", 200, "renamed||")
+	expect("/open/a", "secret-1", "10.2.0.1", 403, "API key renamed may not access /open/(.*)")
+
+	// A broken file is ignored, and the previous keys remain in use
+	os.WriteFile(keyFile, []byte(`{"Keys": [{"Name": "x", "SHA256": "nothex"}]}`), 0600)
+	s.apiKeys.file.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	expect("/partner/a", "secret-1", "10.2.0.1", 200, "renamed||")
+
+	if _, err := parseAPIKeyFile([]byte(`{"Keys": [{"Name": "x", "SHA256": "` + sha256Hex("a") + `", "AllowedIPs": ["nope"]}]}`)); err == nil {
+		t.Errorf("Expected invalid AllowedIPs to fail")
+	}
+}
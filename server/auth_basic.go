@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultBasicAuthRealm  = "IMQS"
+	basicAuthMaxFailures   = 5           // Failed attempts from one IP address, within basicAuthFailureWindow, before it is locked out
+	basicAuthFailureWindow = time.Minute // Also the duration of the lockout
+	basicAuthMaxTrackedIPs = 10000
+)
+
+// basicAuth protects a target or route with HTTP Basic authentication, using an htpasswd file.
+// The file is reloaded when it changes. Passwords may be hashed with bcrypt ($2y$), SHA-1 ({SHA}),
+// or Apache's MD5 ($apr1$), which are the formats that the htpasswd tool produces.
+type basicAuth struct {
+	config  ConfigBasicAuth
+	file    *reloadingFile // Contents are htpasswd
+	limiter *failureLimiter
+}
+
+// Username to password hash
+type htpasswd map[string]string
+
+// Returns nil if the config doesn't ask for Basic auth. files and limiter are shared by all targets
+// and routes, so that a file that is used in many places is only loaded once, and so that failures
+// are counted across all of them.
+func newBasicAuth(c *ConfigBasicAuth, files map[string]*reloadingFile, limiter *failureLimiter) (*basicAuth, error) {
+	if c.File == "" {
+		if c.Realm != "" || c.ForwardAuthorization {
+			return nil, fmt.Errorf("BasicAuth needs a File")
+		}
+		return nil, nil
+	}
+	b := &basicAuth{
+		config:  *c,
+		limiter: limiter,
+	}
+	if b.config.Realm == "" {
+		b.config.Realm = defaultBasicAuthRealm
+	}
+	b.file = files[c.File]
+	if b.file == nil {
+		var err error
+		if b.file, err = newReloadingFile(c.File, c.Reload, parseHtpasswd); err != nil {
+			return nil, fmt.Errorf("BasicAuth: %v", err)
+		}
+		files[c.File] = b.file
+	}
+	return b, nil
+}
+
+func parseHtpasswd(data []byte) (interface{}, error) {
+	users := htpasswd{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 1 {
+			return nil, fmt.Errorf("Line %v is not 'user:hash'", lineNo)
+		}
+		user, hash := line[:colon], line[colon+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") && !strings.HasPrefix(hash, "$apr1$") {
+			return nil, fmt.Errorf("Line %v: the password of %v must be hashed with bcrypt, SHA or apr1", lineNo, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// Returns true if password matches an htpasswd hash
+func htpasswdMatch(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash[6:], "$", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, parts[0]))) == 1
+	}
+	return false
+}
+
+// Apache's variant of the MD5 crypt algorithm, which is the default of the htpasswd tool on many systems
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	// This loop is there to make brute force attacks slower
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return string(out)
+}
+
+// Returns true if the request may continue. Otherwise, a 401 or 429 has already been sent.
+func (b *basicAuth) authorize(log *log.Logger, w http.ResponseWriter, req *http.Request) bool {
+	ip := remoteIP(req)
+	if wait, locked := b.limiter.locked(ip); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		http.Error(w, "Too many failed login attempts", http.StatusTooManyRequests)
+		return false
+	}
+	user, password, ok := req.BasicAuth()
+	if ok {
+		users := b.file.get(log).(htpasswd)
+		if hash, exists := users[user]; exists && htpasswdMatch(hash, password) {
+			b.limiter.succeed(ip)
+			if !b.config.ForwardAuthorization {
+				req.Header.Del("Authorization")
+			}
+			return true
+		}
+		log.Infof("BasicAuth failed for user '%v' from %v", user, ip)
+		b.limiter.fail(ip)
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, b.config.Realm))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// failureLimiter locks out IP addresses that fail to log in too often
+type failureLimiter struct {
+	now      func() time.Time
+	lock     sync.Mutex
+	failures map[string]*ipFailures
+}
+
+type ipFailures struct {
+	count int
+	since time.Time // Start of the window, or of the lockout once count reaches basicAuthMaxFailures
+}
+
+func newFailureLimiter() *failureLimiter {
+	return &failureLimiter{
+		now:      time.Now,
+		failures: map[string]*ipFailures{},
+	}
+}
+
+// Returns the time remaining, if ip is locked out
+func (l *failureLimiter) locked(ip string) (time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f := l.failures[ip]
+	if f == nil || f.count < basicAuthMaxFailures {
+		return 0, false
+	}
+	remaining := basicAuthFailureWindow - l.now().Sub(f.since)
+	if remaining <= 0 {
+		delete(l.failures, ip)
+		return 0, false
+	}
+	return remaining, true
+}
+
+func (l *failureLimiter) fail(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	f := l.failures[ip]
+	if f == nil || now.Sub(f.since) >= basicAuthFailureWindow {
+		if f == nil && len(l.failures) >= basicAuthMaxTrackedIPs {
+			l.prune(now)
+		}
+		f = &ipFailures{since: now}
+		l.failures[ip] = f
+	}
+	f.count++
+	if f.count == basicAuthMaxFailures {
+		// The lockout starts now
+		f.since = now
+	}
+}
+
+func (l *failureLimiter) succeed(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.failures, ip)
+}
+
+// Drop expired entries, or everything if none have expired, so that a flood of addresses can't
+// exhaust our memory. Must be called with the lock held.
+func (l *failureLimiter) prune(now time.Time) {
+	for ip, f := range l.failures {
+		if now.Sub(f.since) >= basicAuthFailureWindow {
+			delete(l.failures, ip)
+		}
+	}
+	if len(l.failures) >= basicAuthMaxTrackedIPs {
+		l.failures = map[string]*ipFailures{}
+	}
+}
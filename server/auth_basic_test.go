@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdFormats(t *testing.T) {
+	// Example from the Apache htpasswd documentation
+	if !htpasswdMatch("$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "myPassword") {
+		t.Errorf("apr1 hash did not match")
+	}
+	if htpasswdMatch("$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "myPassworD") {
+		t.Errorf("apr1 hash matched the wrong password")
+	}
+	if !htpasswdMatch("{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=", "myPassword") {
+		t.Errorf("SHA hash did not match")
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("myPassword"), bcrypt.MinCost)
+	// The htpasswd tool writes $2y$, which is the same algorithm as Go's $2a$
+	if !htpasswdMatch("$2y$"+string(hash[4:]), "myPassword") || htpasswdMatch(string(hash), "other") {
+		t.Errorf("bcrypt hash did not work")
+	}
+	if _, err := parseHtpasswd([]byte("joe:plaintext\n")); err == nil || !strings.Contains(err.Error(), "Line 1") {
+		t.Errorf("Expected a plain text password to be rejected, but got %v", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "auth=%v", r.Header.Get("Authorization"))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	htfile := filepath.Join(dir, "tools.htpasswd")
+	sum := sha1.Sum([]byte("pw"))
+	os.WriteFile(htfile, []byte("# Tools\nann:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\njoe:{SHA}"+base64.StdEncoding.EncodeToString(sum[:])+"\n"), 0600)
+
+	s, c := newTestServer(t, `{
+		"Targets": {"TOOLS": {"URL": "`+backend.URL+`", "BasicAuth": {"File": "`+filepath.ToSlash(htfile)+`", "Realm": "Tools"}}},
+		"Routes": {
+			"/tools/(.*)": "{TOOLS}/$1",
+			"/raw/(.*)": {"Target": "`+backend.URL+`/$1", "BasicAuth": {"File": "`+filepath.ToSlash(htfile)+`", "ForwardAuthorization": true}}
+		}}`)
+
+	send := func(path, user, password, from string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = from + ":4000"
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		return w
+	}
+
+	if w := send("/tools/x", "", "", "10.0.0.1"); w.Code != 401 || w.Header().Get("WWW-Authenticate") != `Basic realm="Tools", charset="UTF-8"` {
+		t.Errorf("Expected a challenge, but got %v %v", w.Code, w.Header())
+	}
+	if w := send("/tools/x", "joe", "pw", "10.0.0.1"); w.Code != 200 || w.Body.String() != "auth=" {
+		t.Errorf("Expected joe to get in, without his credentials reaching the backend: %v %v", w.Code, w.Body.String())
+	}
+	if w := send("/raw/x", "ann", "myPassword", "10.0.0.1"); w.Code != 200 || !strings.HasPrefix(w.Body.String(), "auth=Basic ") {
+		t.Errorf("Expected Authorization to be forwarded: %v %v", w.Code, w.Body.String())
+	}
+
+	// Too many failures from one address lock it out, but not other addresses
+	for i := 0; i < basicAuthMaxFailures; i++ {
+		if w := send("/tools/x", "joe", "guess", "10.0.0.2"); w.Code != 401 {
+			t.Fatalf("Expected a wrong password to fail with 401, but got %v", w.Code)
+		}
+	}
+	if w := send("/tools/x", "joe", "pw", "10.0.0.2"); w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a locked out address to get 429, but got %v", w.Code)
+	}
+	if w := send("/tools/x", "joe", "pw", "10.0.0.3"); w.Code != 200 {
+		t.Errorf("Another address was locked out: %v", w.Code)
+	}
+
+	// The lockout expires. All routes share one limiter.
+	s.translator.allRoutes()[0].basicAuthRules().limiter.now = func() time.Time { return time.Now().Add(basicAuthFailureWindow) }
+	if w := send("/tools/x", "joe", "pw", "10.0.0.2"); w.Code != 200 {
+		t.Errorf("Lockout did not expire: %v", w.Code)
+	}
+
+	c = &Config{}
+	c.LoadString(`{"Targets": {"X": {"URL": "http://a", "BasicAuth": {"Realm": "x"}}}}`)
+	if _, err := newUrlTranslator(c); err == nil || !strings.Contains(err.Error(), "BasicAuth needs a File") {
+		t.Errorf("Expected BasicAuth without a File to fail, but got %v", err)
+	}
+}
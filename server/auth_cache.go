@@ -0,0 +1,180 @@
+package server
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+const (
+	defaultDecisionCacheSize = 10000
+	defaultLogoutPath        = "/auth2/logout"
+)
+
+// decisionCache remembers the answers that imqsauth gives us, so that a burst of requests from
+// the same session doesn't cost a round trip each. Entries are keyed on session token plus
+// the permission that was asked for, and live for a short TTL. When the cache is full, the least
+// recently used entry is dropped.
+type decisionCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration // Zero if denials are not cached
+	maxEntries  int
+	logoutPath  string
+	cookie      string
+	now         func() time.Time
+
+	lock     sync.Mutex
+	lru      *list.List                          // Most recently used at the front. Values are *decision.
+	sessions map[string]map[string]*list.Element // token -> permission -> element
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type decision struct {
+	token      string
+	permission string
+	expires    time.Time
+	httpCode   int
+	errorMsg   string
+	authData   *serviceauth.Token
+}
+
+type decisionCacheStatus struct {
+	Entries   int
+	Hits      int64
+	Misses    int64
+	Evictions int64 // Entries dropped because the cache was full, or the session logged out
+}
+
+// Returns nil if the cache is not enabled
+func newDecisionCache(c *ConfigAuth) *decisionCache {
+	if c.DecisionCache.TTL <= 0 {
+		return nil
+	}
+	dc := &decisionCache{
+		ttl:         time.Duration(c.DecisionCache.TTL) * time.Second,
+		negativeTTL: time.Duration(c.DecisionCache.NegativeTTL) * time.Second,
+		maxEntries:  c.DecisionCache.MaxEntries,
+		logoutPath:  c.DecisionCache.LogoutPath,
+		cookie:      c.SessionJWT.Cookie,
+		now:         time.Now,
+		lru:         list.New(),
+		sessions:    map[string]map[string]*list.Element{},
+	}
+	if dc.maxEntries <= 0 {
+		dc.maxEntries = defaultDecisionCacheSize
+	}
+	if dc.logoutPath == "" {
+		dc.logoutPath = defaultLogoutPath
+	}
+	if dc.cookie == "" {
+		dc.cookie = defaultSessionCookie
+	}
+	return dc
+}
+
+// Returns the credentials that identify the caller, or an empty string if there are none.
+// imqsauth may have authenticated either the Authorization header or the session cookie, and we can't
+// tell which, so the key holds both. Otherwise, clients that send the same header, such as "Bearer null"
+// or a shared Basic credential, would share the decisions that were made about one of their sessions.
+func (dc *decisionCache) tokenOf(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	session := ""
+	if cookie, err := req.Cookie(dc.cookie); err == nil {
+		session = cookie.Value
+	}
+	if auth == "" && session == "" {
+		return ""
+	}
+	return auth + "\x00" + session
+}
+
+func (dc *decisionCache) get(token, permission string) *decision {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if el := dc.sessions[token][permission]; el != nil {
+		d := el.Value.(*decision)
+		if dc.now().Before(d.expires) {
+			dc.lru.MoveToFront(el)
+			dc.hits.Add(1)
+			return d
+		}
+		dc.remove(el)
+	}
+	dc.misses.Add(1)
+	return nil
+}
+
+// Cache the result of a call to imqsauth. Errors other than 401 and 403 are never cached,
+// because they say nothing about the session.
+func (dc *decisionCache) put(token, permission string, httpCode int, errorMsg string, authData *serviceauth.Token) {
+	ttl := dc.ttl
+	if httpCode != http.StatusOK {
+		if dc.negativeTTL <= 0 || (httpCode != http.StatusUnauthorized && httpCode != http.StatusForbidden) {
+			return
+		}
+		ttl = dc.negativeTTL
+	}
+	d := &decision{
+		token:      token,
+		permission: permission,
+		expires:    dc.now().Add(ttl),
+		httpCode:   httpCode,
+		errorMsg:   errorMsg,
+		authData:   authData,
+	}
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if el := dc.sessions[token][permission]; el != nil {
+		dc.remove(el)
+	}
+	for dc.lru.Len() >= dc.maxEntries {
+		dc.remove(dc.lru.Back())
+		dc.evictions.Add(1)
+	}
+	perms := dc.sessions[token]
+	if perms == nil {
+		perms = map[string]*list.Element{}
+		dc.sessions[token] = perms
+	}
+	perms[permission] = dc.lru.PushFront(d)
+}
+
+// Drop every decision that was made for this session
+func (dc *decisionCache) evictSession(token string) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	for _, el := range dc.sessions[token] {
+		dc.remove(el)
+		dc.evictions.Add(1)
+	}
+}
+
+// Must be called with the lock held
+func (dc *decisionCache) remove(el *list.Element) {
+	d := dc.lru.Remove(el).(*decision)
+	perms := dc.sessions[d.token]
+	delete(perms, d.permission)
+	if len(perms) == 0 {
+		delete(dc.sessions, d.token)
+	}
+}
+
+func (dc *decisionCache) status() *decisionCacheStatus {
+	dc.lock.Lock()
+	entries := dc.lru.Len()
+	dc.lock.Unlock()
+	return &decisionCacheStatus{
+		Entries:   entries,
+		Hits:      dc.hits.Load(),
+		Misses:    dc.misses.Load(),
+		Evictions: dc.evictions.Load(),
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+func TestDecisionCache(t *testing.T) {
+	dc := newDecisionCache(&ConfigAuth{DecisionCache: ConfigDecisionCache{TTL: 10, NegativeTTL: 2, MaxEntries: 3}})
+	now := time.Now()
+	dc.now = func() time.Time { return now }
+
+	user := &serviceauth.Token{UserID: 5}
+	dc.put("s1", "enabled", http.StatusOK, "", user)
+	dc.put("s1", "admin", http.StatusForbidden, "Permission denied", nil)
+	dc.put("s1", "report", http.StatusInternalServerError, "imqsauth is down", nil)
+	if d := dc.get("s1", "enabled"); d == nil || d.authData != user {
+		t.Fatalf("Positive decision was not cached")
+	}
+	if d := dc.get("s1", "admin"); d == nil || d.httpCode != http.StatusForbidden {
+		t.Fatalf("Negative decision was not cached")
+	}
+	if dc.get("s1", "report") != nil {
+		t.Errorf("Server errors must not be cached")
+	}
+
+	// Denials expire sooner than grants
+	now = now.Add(5 * time.Second)
+	if dc.get("s1", "admin") != nil {
+		t.Errorf("Negative decision outlived NegativeTTL")
+	}
+	if dc.get("s1", "enabled") == nil {
+		t.Errorf("Positive decision expired too soon")
+	}
+	now = now.Add(5 * time.Second)
+	if dc.get("s1", "enabled") != nil {
+		t.Errorf("Positive decision outlived TTL")
+	}
+
+	// Least recently used entries are dropped when full
+	dc.put("s1", "a", http.StatusOK, "", nil)
+	dc.put("s2", "a", http.StatusOK, "", nil)
+	dc.put("s3", "a", http.StatusOK, "", nil)
+	dc.get("s1", "a")
+	dc.put("s4", "a", http.StatusOK, "", nil)
+	if dc.get("s2", "a") != nil || dc.get("s1", "a") == nil {
+		t.Errorf("Expected s2 to be evicted, because it was least recently used")
+	}
+
+	// Logout drops all of a session's entries
+	dc.put("s1", "b", http.StatusOK, "", nil)
+	dc.evictSession("s1")
+	if dc.get("s1", "a") != nil || dc.get("s1", "b") != nil {
+		t.Errorf("Session entries survived logout")
+	}
+	if len(dc.sessions["s1"]) != 0 {
+		t.Errorf("Session index was not cleaned up")
+	}
+
+	st := dc.status()
+	if st.Entries != 1 || st.Hits != 5 || st.Misses != 6 || st.Evictions != 4 {
+		t.Errorf("Unexpected counters %+v", st)
+	}
+}
+
+// The cache key of a request that only carries a session cookie
+func sessionCacheKey(dc *decisionCache, session string) string {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: dc.cookie, Value: session})
+	return dc.tokenOf(req)
+}
+
+func TestDecisionCacheKey(t *testing.T) {
+	dc := newDecisionCache(&ConfigAuth{DecisionCache: ConfigDecisionCache{TTL: 10}})
+	request := func(auth, session string) *http.Request {
+		req := httptest.NewRequest("GET", "/x", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		return req
+	}
+
+	// Clients that send the same header, but have different sessions, must not share decisions
+	alice := request("Bearer null", "alice")
+	bob := request("Bearer null", "bob")
+	dc.put(dc.tokenOf(alice), "enabled", http.StatusOK, "", &serviceauth.Token{UserID: 1})
+	if dc.get(dc.tokenOf(bob), "enabled") != nil {
+		t.Errorf("Bob was granted Alice's permission, because they send the same Authorization header")
+	}
+	if d := dc.get(dc.tokenOf(alice), "enabled"); d == nil || d.authData.UserID != 1 {
+		t.Errorf("Alice's decision was not cached")
+	}
+	if dc.tokenOf(request("Basic c2hhcmVk", "")) == dc.tokenOf(request("", "Basic c2hhcmVk")) {
+		t.Errorf("A header and a cookie with the same value must have different keys")
+	}
+	if dc.tokenOf(request("", "")) != "" {
+		t.Errorf("A request without credentials must have no key")
+	}
+}
+
+func TestDecisionCacheDisabled(t *testing.T) {
+	if newDecisionCache(&ConfigAuth{}) != nil {
+		t.Errorf("Decision cache should be disabled by default")
+	}
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	s := &Server{decisions: newDecisionCache(&ConfigAuth{DecisionCache: ConfigDecisionCache{TTL: 10}})}
+	s.decisions.get("x", "enabled")
+
+	// The local machine is not trusted by default, because a local reverse proxy makes every request local
+	req := httptest.NewRequest("GET", "/router/status", nil)
+	req.RemoteAddr = "127.0.0.1:5555"
+	w := httptest.NewRecorder()
+	s.serveStatus(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected local status request to be forbidden by default, but got %v", w.Code)
+	}
+
+	s.status.allowLoopback = true
+	w = httptest.NewRecorder()
+	s.serveStatus(w, req)
+	status := routerStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.DecisionCache == nil || status.DecisionCache.Misses != 1 {
+		t.Errorf("Unexpected status %v", w.Body.String())
+	}
+
+	req.RemoteAddr = "10.1.2.3:5555"
+	w = httptest.NewRecorder()
+	s.serveStatus(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected remote status request to be forbidden, but got %v", w.Code)
+	}
+
+	// Users with the permission may read it from anywhere
+	var err error
+	if s.status, err = newStatusAccess(&ConfigStatus{RequirePermission: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "session", Value: "admin-session"})
+	s.decisions.put(s.decisions.tokenOf(req), "admin", http.StatusOK, "", &serviceauth.Token{UserID: 1})
+	w = httptest.NewRecorder()
+	s.serveStatus(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected an admin to read the status, but got %v", w.Code)
+	}
+	if _, err := newStatusAccess(&ConfigStatus{RequirePermission: "admin AND"}); err == nil {
+		t.Errorf("Expected an invalid permission expression to fail")
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ClientCertMode controls whether the HTTPS listener asks for client certificates
+type ClientCertMode string
+
+const (
+	ClientCertNone     ClientCertMode = ""         // Client certificates are not requested. This is the default.
+	ClientCertOptional ClientCertMode = "Optional" // A certificate is verified if the client sends one
+	ClientCertRequire  ClientCertMode = "Require"  // Every HTTPS connection must present a valid certificate
+)
+
+// Headers that carry the details of a verified client certificate to the backend.
+// Clients may not send these themselves.
+const (
+	clientCertHeaderName        = "X-Client-Cert-Name" // Name of the rule in Auth.ClientCertRules that the certificate matched
+	clientCertHeaderSubject     = "X-Client-Cert-Subject"
+	clientCertHeaderIssuer      = "X-Client-Cert-Issuer"
+	clientCertHeaderSerial      = "X-Client-Cert-Serial"
+	clientCertHeaderSAN         = "X-Client-Cert-SAN"
+	clientCertHeaderFingerprint = "X-Client-Cert-Fingerprint"
+	clientCertHeaderNotAfter    = "X-Client-Cert-Not-After"
+)
+
+var clientCertHeaders = []string{
+	clientCertHeaderName,
+	clientCertHeaderSubject,
+	clientCertHeaderIssuer,
+	clientCertHeaderSerial,
+	clientCertHeaderSAN,
+	clientCertHeaderFingerprint,
+	clientCertHeaderNotAfter,
+}
+
+// clientCertAuth verifies client certificates on the HTTPS listener, and maps them to the routes
+// and permissions that they are allowed, via Auth.ClientCertRules.
+type clientCertAuth struct {
+	config ConfigClientCerts
+	cas    *x509.CertPool
+	rules  []*clientCertRule
+}
+
+type clientCertRule struct {
+	name        string
+	subject     *regexp.Regexp
+	san         *regexp.Regexp
+	fingerprint string // Lower case hex SHA-256, without colons
+	routes      map[string]bool
+	permissions map[string]bool
+}
+
+// Returns nil if client certificates are not used
+func newClientCertAuth(c *ConfigClientCerts, rules []ConfigClientCertRule) (*clientCertAuth, error) {
+	switch c.Mode {
+	case ClientCertNone, ClientCertOptional, ClientCertRequire:
+	default:
+		return nil, fmt.Errorf("HTTP.ClientCerts.Mode must be '%v' or '%v'", ClientCertOptional, ClientCertRequire)
+	}
+	if c.Mode == ClientCertNone {
+		if len(rules) != 0 {
+			return nil, fmt.Errorf("Auth.ClientCertRules needs HTTP.ClientCerts.Mode to be '%v' or '%v'", ClientCertOptional, ClientCertRequire)
+		}
+		return nil, nil
+	}
+	if c.CAFile == "" {
+		return nil, fmt.Errorf("HTTP.ClientCerts needs a CAFile")
+	}
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client certificate CAFile: %v", err)
+	}
+	a := &clientCertAuth{
+		config: *c,
+		cas:    x509.NewCertPool(),
+	}
+	if !a.cas.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Client certificate CAFile %v has no certificates", c.CAFile)
+	}
+	for i := range rules {
+		rule, err := newClientCertRule(&rules[i])
+		if err != nil {
+			return nil, fmt.Errorf("Auth.ClientCertRules %v: %v", rules[i].Name, err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+func newClientCertRule(c *ConfigClientCertRule) (*clientCertRule, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("Every rule needs a Name")
+	}
+	if c.Subject == "" && c.SAN == "" && c.Fingerprint == "" {
+		return nil, fmt.Errorf("A rule needs at least one of Subject, SAN or Fingerprint")
+	}
+	r := &clientCertRule{
+		name:        c.Name,
+		routes:      map[string]bool{},
+		permissions: map[string]bool{},
+	}
+	var err error
+	if c.Subject != "" {
+		if r.subject, err = regexp.Compile("^(?:" + c.Subject + ")$"); err != nil {
+			return nil, fmt.Errorf("Invalid Subject: %v", err)
+		}
+	}
+	if c.SAN != "" {
+		if r.san, err = regexp.Compile("^(?:" + c.SAN + ")$"); err != nil {
+			return nil, fmt.Errorf("Invalid SAN: %v", err)
+		}
+	}
+	if c.Fingerprint != "" {
+		r.fingerprint = strings.ToLower(strings.ReplaceAll(c.Fingerprint, ":", ""))
+		if raw, err := hex.DecodeString(r.fingerprint); err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("Fingerprint must be a hex SHA-256")
+		}
+	}
+	for _, route := range c.Routes {
+		r.routes[route] = true
+	}
+	for _, perm := range c.Permissions {
+		r.permissions[perm] = true
+	}
+	return r, nil
+}
+
+// Settings for the HTTPS listener
+func (a *clientCertAuth) apply(tc *tls.Config) {
+	tc.ClientCAs = a.cas
+	if a.config.Mode == ClientCertRequire {
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+}
+
+func clientCertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// All of the certificate's subject alternative names, as strings
+func clientCertSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+func (r *clientCertRule) matches(cert *x509.Certificate) bool {
+	if r.subject != nil && !r.subject.MatchString(cert.Subject.String()) {
+		return false
+	}
+	if r.san != nil {
+		found := false
+		for _, san := range clientCertSANs(cert) {
+			if r.san.MatchString(san) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.fingerprint == "" || r.fingerprint == clientCertFingerprint(cert)
+}
+
+// Returns true if a certificate that matches this rule may make req to route, without an IMQS session
+func (r *clientCertRule) allows(route *route, req *http.Request) bool {
+	if r.routes["*"] || r.routes[route.match] {
+		return true
+	}
+	required := route.requiredPermission(req)
+	return required != nil && required.evalSet(r.permissions)
+}
+
+// Returns the first rule that matches cert, or nil
+func (a *clientCertAuth) match(cert *x509.Certificate) *clientCertRule {
+	for _, r := range a.rules {
+		if r.matches(cert) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Remove any certificate details that the client sent, so that a backend can trust these headers,
+// whether or not this router verifies client certificates
+func stripClientCertHeaders(req *http.Request) {
+	for _, h := range clientCertHeaders {
+		req.Header.Del(h)
+	}
+}
+
+// Returns the leaf certificate that the TLS handshake verified, or nil
+func verifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// Forward the details of the client's certificate, and decide whether the certificate grants access to the route.
+// Returns granted=true if the certificate takes the place of an IMQS session. Returns ok=false if the request
+// must stop, in which case an error has already been sent.
+func (s *Server) authorizeClientCert(w http.ResponseWriter, req *http.Request, route *route) (granted bool, ok bool) {
+	cert := verifiedClientCert(req)
+	var rule *clientCertRule
+	if cert != nil {
+		req.Header.Set(clientCertHeaderSubject, cert.Subject.String())
+		req.Header.Set(clientCertHeaderIssuer, cert.Issuer.String())
+		req.Header.Set(clientCertHeaderSerial, cert.SerialNumber.Text(16))
+		req.Header.Set(clientCertHeaderFingerprint, clientCertFingerprint(cert))
+		req.Header.Set(clientCertHeaderNotAfter, cert.NotAfter.UTC().Format(time.RFC3339))
+		if sans := clientCertSANs(cert); len(sans) != 0 {
+			req.Header.Set(clientCertHeaderSAN, strings.Join(sans, ","))
+		}
+		if rule = s.clientCerts.match(cert); rule != nil {
+			req.Header.Set(clientCertHeaderName, rule.name)
+			if rule.allows(route, req) {
+				return true, true
+			}
+		}
+	}
+	if route.requiresClientCert() {
+		switch {
+		case cert == nil:
+			http.Error(w, "A client certificate is required", http.StatusUnauthorized)
+		case rule == nil:
+			http.Error(w, "Client certificate is not recognized", http.StatusForbidden)
+		default:
+			http.Error(w, fmt.Sprintf("Client certificate %v may not access this route", rule.name), http.StatusForbidden)
+		}
+		return false, false
+	}
+	return false, true
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Issue a certificate. If parent is nil, then the certificate is a self-signed CA.
+func testCert(t *testing.T, subject pkix.Name, dnsNames []string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+	return cert, key
+}
+
+func TestClientCerts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v|%v|%v", r.Header.Get("X-Client-Cert-Name"), r.Header.Get("X-Client-Cert-Subject"), r.Header.Get("X-Client-Cert-SAN"))
+	}))
+	defer backend.Close()
+
+	ca, caKey := testCert(t, pkix.Name{CommonName: "Devices CA"}, nil, nil, nil)
+	meter, _ := testCert(t, pkix.Name{CommonName: "meter-7", Organization: []string{"IMQS"}}, []string{"meter-7.devices.local"}, ca, caKey)
+	partner, _ := testCert(t, pkix.Name{CommonName: "partner"}, nil, ca, caKey)
+	stranger, _ := testCert(t, pkix.Name{CommonName: "stranger"}, nil, ca, caKey)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+
+	s, c := newTestServer(t, `{
+		"HTTP": {"ClientCerts": {"Mode": "Optional", "CAFile": "`+filepath.ToSlash(caFile)+`"}},
+		"Auth": {"ClientCertRules": [
+			{"Name": "meters", "Subject": "CN=meter-.*,O=IMQS", "SAN": ".*\\.devices\\.local", "Routes": ["/telemetry/(.*)"]},
+			{"Name": "partner", "Fingerprint": "`+clientCertFingerprint(partner)+`", "Permissions": ["reports"]}
+		]},
+		"Targets": {
+			"TELEMETRY": {"URL": "`+backend.URL+`", "RequireClientCert": true},
+			"REPORTS": {"URL": "`+backend.URL+`", "RequirePermission": "reports"}
+		},
+		"Routes": {"/telemetry/(.*)": "{TELEMETRY}/$1", "/reports/(.*)": "{REPORTS}/$1", "/public/(.*)": "`+backend.URL+`/$1"}}`)
+	var err error
+	if s.clientCerts, err = newClientCertAuth(&c.HTTP.ClientCerts, c.Auth.ClientCertRules); err != nil {
+		t.Fatal(err)
+	}
+	tc := &tls.Config{}
+	s.clientCerts.apply(tc)
+	if tc.ClientAuth != tls.VerifyClientCertIfGiven || tc.ClientCAs == nil {
+		t.Errorf("TLS listener was not configured for client certificates")
+	}
+
+	send := func(path string, cert *x509.Certificate) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Client-Cert-Name", "spoofed")
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca}}}
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(true, w, req)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+	expect := func(path string, cert *x509.Certificate, code int, body string) {
+		t.Helper()
+		if gotCode, gotBody := send(path, cert); gotCode != code || gotBody != body {
+			t.Errorf("%v: expected %v %q, but got %v %q", path, code, body, gotCode, gotBody)
+		}
+	}
+
+	expect("/telemetry/a", meter, 200, "meters|CN=meter-7,O=IMQS|meter-7.devices.local")
+	expect("/telemetry/a", nil, 401, "A client certificate is required")
+	expect("/telemetry/a", stranger, 403, "Client certificate is not recognized")
+	expect("/telemetry/a", partner, 403, "Client certificate partner may not access this route")
+	// A synthetic permission takes the place of an IMQS session
+	expect("/reports/a", partner, 200, "partner|CN=partner|")
+	// Certificate details are forwarded on routes that don't need them, and spoofed headers are always removed
+	expect("/public/a", stranger, 200, "|CN=stranger|")
+	expect("/public/a", nil, 200, "||")
+
+	// A router that doesn't verify certificates still removes spoofed headers
+	s.clientCerts = nil
+	expect("/public/a", nil, 200, "||")
+
+	c = &Config{}
+	c.LoadString(`{"Targets": {"X": {"URL": "http://a", "RequireClientCert": true}}}`)
+	if _, err := newUrlTranslator(c); err == nil || !strings.Contains(err.Error(), "RequireClientCert needs HTTP.ClientCerts") {
+		t.Errorf("Expected RequireClientCert without ClientCerts to fail, but got %v", err)
+	}
+	if _, err := newClientCertAuth(&ConfigClientCerts{}, []ConfigClientCertRule{{Name: "x", SAN: "y"}}); err == nil {
+		t.Errorf("Expected rules without a Mode to fail")
+	}
+}
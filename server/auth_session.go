@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+const (
+	defaultSessionCookie      = "session"
+	defaultSessionKeyRefresh  = 5 * 60  // seconds
+	sessionKeyMinReload       = 30      // seconds. Don't reload keys more often than this, when we see an unknown key ID.
+	sessionTokenLeeway        = 60      // seconds of clock skew that we tolerate on exp and nbf
+	maxSessionKeyDocumentSize = 1 << 20 // bytes
+)
+
+// sessionValidator validates signed session tokens locally, so that a request to a protected
+// target doesn't need a round trip to imqsauth.
+// The key set is reloaded periodically, and whenever we see a token signed by a key that we don't know,
+// which is what happens when the identity provider rotates its keys.
+type sessionValidator struct {
+	config ConfigSessionJWT
+	client *http.Client
+	now    func() time.Time
+
+	loadLock   sync.Mutex // Held while loading keys, so that only one thread does so at a time
+	keysLock   sync.RWMutex
+	keys       jwtKeys
+	keysLoaded time.Time
+}
+
+// The result of a successful local validation
+type localSession struct {
+	token       *serviceauth.Token
+	permissions map[string]bool
+	tenant      string
+}
+
+// Returns nil if local session validation is not configured
+func newSessionValidator(c *ConfigSessionJWT) (*sessionValidator, error) {
+	if c.KeyFile == "" && c.KeyURL == "" {
+		return nil, nil
+	}
+	if c.KeyFile != "" && c.KeyURL != "" {
+		return nil, fmt.Errorf("SessionJWT may have a KeyFile or a KeyURL, but not both")
+	}
+	v := &sessionValidator{
+		config: *c,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+	if v.config.Cookie == "" {
+		v.config.Cookie = defaultSessionCookie
+	}
+	if v.config.KeyRefresh == 0 {
+		v.config.KeyRefresh = defaultSessionKeyRefresh
+	}
+	if v.config.UserIDClaim == "" {
+		v.config.UserIDClaim = "uid"
+	}
+	if v.config.UsernameClaim == "" {
+		v.config.UsernameClaim = "username"
+	}
+	if v.config.EmailClaim == "" {
+		v.config.EmailClaim = "email"
+	}
+	if v.config.PermissionsClaim == "" {
+		v.config.PermissionsClaim = "permissions"
+	}
+	if v.config.TenantClaim == "" {
+		v.config.TenantClaim = "tenant"
+	}
+	// A key file must be valid at startup. A key URL may be temporarily unreachable, in which case
+	// we fall back to imqsauth until it comes up.
+	if err := v.loadKeys(); err != nil && v.config.KeyFile != "" {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *sessionValidator) loadKeys() error {
+	var data []byte
+	var err error
+	if v.config.KeyFile != "" {
+		data, err = os.ReadFile(v.config.KeyFile)
+	} else {
+		data, err = v.fetchKeys()
+	}
+	if err == nil {
+		var keys jwtKeys
+		if keys, err = parseJWTKeys(data); err == nil {
+			v.keysLock.Lock()
+			v.keys = keys
+			v.keysLock.Unlock()
+		}
+	}
+	// Record the attempt even if it failed, so that we don't hammer a broken key source
+	v.keysLock.Lock()
+	v.keysLoaded = v.now()
+	v.keysLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("Error loading session keys: %v", err)
+	}
+	return nil
+}
+
+func (v *sessionValidator) fetchKeys() ([]byte, error) {
+	resp, err := v.client.Get(v.config.KeyURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %v", v.config.KeyURL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSessionKeyDocumentSize))
+}
+
+// Reload the keys if they are older than maxAge. If another thread is busy loading, then we
+// don't wait for it, but carry on with the keys that we have.
+func (v *sessionValidator) refreshKeys(maxAge time.Duration) error {
+	v.keysLock.RLock()
+	stale := v.now().Sub(v.keysLoaded) >= maxAge
+	v.keysLock.RUnlock()
+	if !stale || !v.loadLock.TryLock() {
+		return nil
+	}
+	defer v.loadLock.Unlock()
+	return v.loadKeys()
+}
+
+func (v *sessionValidator) currentKeys() jwtKeys {
+	v.keysLock.RLock()
+	defer v.keysLock.RUnlock()
+	return v.keys
+}
+
+// Validate a session token. Returns errJWTUnknownKey if the token was not signed by any key that we know of,
+// in which case the caller should fall back to asking imqsauth.
+func (v *sessionValidator) validate(token string) (*localSession, error) {
+	v.refreshKeys(time.Duration(v.config.KeyRefresh) * time.Second)
+	claims, err := verifyJWT(token, v.currentKeys(), v.now(), sessionTokenLeeway*time.Second)
+	if err == errJWTUnknownKey {
+		// The keys may have been rotated
+		v.refreshKeys(sessionKeyMinReload * time.Second)
+		claims, err = verifyJWT(token, v.currentKeys(), v.now(), sessionTokenLeeway*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A session that never expires can't be revoked, short of rotating the signing key
+	if _, ok := claims.number("exp"); !ok {
+		return nil, fmt.Errorf("Session token has no expiry")
+	}
+	if v.config.Issuer != "" && claims.str("iss") != v.config.Issuer {
+		return nil, fmt.Errorf("Token issuer '%v' is not trusted", claims.str("iss"))
+	}
+	if v.config.Audience != "" {
+		found := false
+		for _, aud := range claims.strings("aud") {
+			found = found || aud == v.config.Audience
+		}
+		if !found {
+			return nil, fmt.Errorf("Token is not intended for this audience")
+		}
+	}
+
+	session := &localSession{
+		token:       &serviceauth.Token{},
+		permissions: map[string]bool{},
+	}
+	session.token.UserID, _ = strconv.Atoi(claims.str(v.config.UserIDClaim))
+	session.token.Username = claims.str(v.config.UsernameClaim)
+	session.token.Email = claims.str(v.config.EmailClaim)
+	session.tenant = claims.str(v.config.TenantClaim)
+	for _, p := range claims.strings(v.config.PermissionsClaim) {
+		session.permissions[p] = true
+	}
+	return session, nil
+}
+
+// Returns the session token of a request, from either the Authorization header, or the session cookie
+func sessionTokenFromRequest(req *http.Request, cookieName string) string {
+	if auth := req.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if cookie, err := req.Cookie(cookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+const (
+	defaultBlockStatusCode = http.StatusTeapot // What the router answered to yahoo.mail.com, before the Blocklist existed
+	blockLogInterval       = 10 * time.Second  // At most one log message per interval, so that a flood doesn't fill the log
+)
+
+// Blocklist.Hosts, unless the config sets it. We were getting a whole lot of requests to the 'telco'
+// server where the hostname was "yahoo.mail.com", and the router used to refuse them in code.
+var defaultBlockHosts = []string{`^yahoo\.mail\.com$`}
+
+// Reasons for blocking a request, which are also the keys of the counters on /router/status
+const (
+	blockReasonIP        = "IP"
+	blockReasonHost      = "Host"
+	blockReasonUserAgent = "UserAgent"
+	blockReasonPath      = "Path"
+)
+
+// ipList is a list of addresses and CIDR ranges, either IPv4 or IPv6
+type ipList []*net.IPNet
+
+// Parse addresses such as "10.1.1.5", "10.1.0.0/16", or "2001:db8::/32"
+func parseIPList(entries []string) (ipList, error) {
+	list := ipList{}
+	for _, entry := range entries {
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid IP address or CIDR range '%v'", entry)
+		}
+		list = append(list, ipNet)
+	}
+	return list, nil
+}
+
+func (l ipList) contains(ip net.IP) bool {
+	for _, ipNet := range l {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockRules decides which requests are refused. An empty rule set refuses nothing.
+type blockRules struct {
+	allowIPs   ipList // If not empty, only these addresses are allowed
+	denyIPs    ipList // Takes precedence over allowIPs
+	hosts      []*regexp.Regexp
+	userAgents []*regexp.Regexp
+	paths      []*regexp.Regexp
+}
+
+func newBlockRules(c *ConfigBlockRules) (*blockRules, error) {
+	r := &blockRules{}
+	var err error
+	if r.allowIPs, err = parseIPList(c.AllowIPs); err != nil {
+		return nil, fmt.Errorf("AllowIPs: %v", err)
+	}
+	if r.denyIPs, err = parseIPList(c.DenyIPs); err != nil {
+		return nil, fmt.Errorf("DenyIPs: %v", err)
+	}
+	compile := func(field string, patterns []string) ([]*regexp.Regexp, error) {
+		res := []*regexp.Regexp{}
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("%v: Failed to compile regex '%v': %v", field, p, err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	if r.hosts, err = compile("Hosts", c.Hosts); err != nil {
+		return nil, err
+	}
+	if r.userAgents, err = compile("UserAgents", c.UserAgents); err != nil {
+		return nil, err
+	}
+	if r.paths, err = compile("Paths", c.Paths); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *blockRules) isEmpty() bool {
+	return len(r.allowIPs) == 0 && len(r.denyIPs) == 0 && len(r.hosts) == 0 && len(r.userAgents) == 0 && len(r.paths) == 0
+}
+
+// Returns the reason for refusing the request, or an empty string if it may continue
+func (r *blockRules) check(req *http.Request, ip net.IP) string {
+	if r.denyIPs.contains(ip) || (len(r.allowIPs) != 0 && !r.allowIPs.contains(ip)) {
+		return blockReasonIP
+	}
+	for _, re := range r.hosts {
+		// A request whose URI is absolute, as if we were a proxy, has a host in the URL too
+		if re.MatchString(req.Host) || (req.URL.Host != "" && re.MatchString(req.URL.Host)) {
+			return blockReasonHost
+		}
+	}
+	for _, re := range r.userAgents {
+		if re.MatchString(req.UserAgent()) {
+			return blockReasonUserAgent
+		}
+	}
+	for _, re := range r.paths {
+		if re.MatchString(req.URL.Path) {
+			return blockReasonPath
+		}
+	}
+	return ""
+}
+
+/*
+blocklist refuses requests by IP address, Host, User-Agent or path, before they are routed.
+The rules in the config are fixed, and the rules in File are reloaded when it changes.
+The file has the same fields as the rules in the config:
+
+	{
+		"DenyIPs": ["203.0.113.0/24", "2001:db8::/32"],
+		"Hosts": ["^yahoo\\.mail\\.com$"],
+		"UserAgents": ["(?i)masscan"],
+		"Paths": ["\\.php$", "^/wp-admin/"]
+	}
+
+Blocked requests are counted, and reported on /router/status.
+*/
+type blocklist struct {
+	statusCode int
+	static     *blockRules
+	file       *reloadingFile // Contents are *blockRules. nil if there is no File.
+
+	counts sync.Map // Reason to *atomic.Int64
+
+	logLock       sync.Mutex
+	lastLog       time.Time
+	logSuppressed int
+}
+
+// The blocklist is created even if it has no rules, because it also counts the requests that
+// routes refuse with their own IP lists.
+func newBlocklist(c *ConfigBlocklist) (*blocklist, error) {
+	b := &blocklist{statusCode: c.StatusCode}
+	if b.statusCode == 0 {
+		b.statusCode = defaultBlockStatusCode
+	}
+	if b.statusCode < 400 || b.statusCode > 599 {
+		return nil, fmt.Errorf("Blocklist StatusCode must be between 400 and 599")
+	}
+	hosts := c.Hosts
+	if hosts == nil {
+		hosts = defaultBlockHosts
+	}
+	var err error
+	if b.static, err = newBlockRules(&ConfigBlockRules{
+		AllowIPs:   c.AllowIPs,
+		DenyIPs:    c.DenyIPs,
+		Hosts:      hosts,
+		UserAgents: c.UserAgents,
+		Paths:      c.Paths,
+	}); err != nil {
+		return nil, fmt.Errorf("Blocklist %v", err)
+	}
+	if c.File != "" {
+		if b.file, err = newReloadingFile(c.File, c.Reload, parseBlocklistFile); err != nil {
+			return nil, fmt.Errorf("Blocklist: %v", err)
+		}
+	}
+	return b, nil
+}
+
+func parseBlocklistFile(data []byte) (interface{}, error) {
+	c := ConfigBlockRules{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return nil, err
+	}
+	return newBlockRules(&c)
+}
+
+// Returns the reason for refusing the request, or an empty string if it may continue
+func (b *blocklist) check(log *log.Logger, req *http.Request) string {
+	if b == nil {
+		return ""
+	}
+	ip := net.ParseIP(remoteIP(req))
+	if reason := b.static.check(req, ip); reason != "" {
+		return reason
+	}
+	if b.file != nil {
+		return b.file.get(log).(*blockRules).check(req, ip)
+	}
+	return ""
+}
+
+// Refuse a request, counting it, and logging it unless we've logged too much recently.
+// b may be nil, in which case the request is refused with the default status code, and not counted.
+func (b *blocklist) block(log *log.Logger, w http.ResponseWriter, req *http.Request, reason string) {
+	if b == nil {
+		http.Error(w, "", defaultBlockStatusCode)
+		return
+	}
+	counter, _ := b.counts.LoadOrStore(reason, &atomic.Int64{})
+	counter.(*atomic.Int64).Add(1)
+
+	b.logLock.Lock()
+	now := time.Now()
+	if now.Sub(b.lastLog) >= blockLogInterval {
+		if b.logSuppressed != 0 {
+			log.Warnf("Blocked request from %v to %v%v (%v). %v more were blocked since the last message.", remoteIP(req), req.Host, req.URL.Path, reason, b.logSuppressed)
+		} else {
+			log.Warnf("Blocked request from %v to %v%v (%v)", remoteIP(req), req.Host, req.URL.Path, reason)
+		}
+		b.lastLog = now
+		b.logSuppressed = 0
+	} else {
+		b.logSuppressed++
+	}
+	b.logLock.Unlock()
+
+	http.Error(w, "", b.statusCode)
+}
+
+// Number of blocked requests, by reason
+func (b *blocklist) status() map[string]int64 {
+	counts := map[string]int64{}
+	b.counts.Range(func(reason, counter interface{}) bool {
+		counts[reason.(string)] = counter.(*atomic.Int64).Load()
+		return true
+	})
+	return counts
+}
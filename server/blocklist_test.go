@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlocklist(t *testing.T) {
+	backend := newOKBackend(t)
+
+	file := filepath.Join(t.TempDir(), "blocklist.json")
+	os.WriteFile(file, []byte(`{"Paths": ["\\.php$"]}`), 0600)
+
+	s, c := newTestServer(t, `{
+		"Blocklist": {"File": "`+filepath.ToSlash(file)+`", "StatusCode": 410, "DenyIPs": ["203.0.113.0/24", "2001:db8::/32"],
+			"Hosts": ["^yahoo\\.mail\\.com$"], "UserAgents": ["(?i)masscan"]},
+		"Targets": {"ADMIN": {"URL": "`+backend.URL+`", "AllowIPs": ["10.0.0.0/8", "::1"]}},
+		"Routes": {
+			"/admin/(.*)": "{ADMIN}/$1",
+			"/admin/secret/(.*)": {"Target": "{ADMIN}/secret/$1", "DenyIPs": ["10.9.0.0/16"]},
+			"/(.*)": "`+backend.URL+`/$1"
+		}}`)
+	var err error
+	if s.blocklist, err = newBlocklist(&c.Blocklist); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(target, from, agent string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = from
+		req.Header.Set("User-Agent", agent)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		return w.Code
+	}
+	expect := func(target, from, agent string, code int) {
+		t.Helper()
+		if got := send(target, from, agent); got != code {
+			t.Errorf("%v from %v (%v): expected %v, but got %v", target, from, agent, code, got)
+		}
+	}
+
+	expect("/page", "10.0.0.1:1000", "Firefox", 200)
+	expect("/page", "203.0.113.9:1000", "Firefox", 410)
+	expect("/page", "[2001:db8::5]:1000", "Firefox", 410)
+	expect("/page", "10.0.0.1:1000", "masscan/1.0", 410)
+	expect("http://yahoo.mail.com/page", "10.0.0.1:1000", "Firefox", 410)
+	expect("/index.php", "10.0.0.1:1000", "Firefox", 410)
+
+	// Targets and routes have their own lists
+	expect("/admin/x", "10.1.2.3:1000", "Firefox", 200)
+	expect("/admin/x", "[::1]:1000", "Firefox", 200)
+	expect("/admin/x", "192.168.1.1:1000", "Firefox", 410)
+	expect("/admin/secret/x", "10.1.2.3:1000", "Firefox", 200)
+	expect("/admin/secret/x", "10.9.2.3:1000", "Firefox", 410)
+
+	// The file is reloaded when it changes
+	os.WriteFile(file, []byte(`{"Paths": ["^/wp-admin/"]}`), 0600)
+	s.blocklist.file.now = func() time.Time { return time.Now().Add(time.Hour) }
+	expect("/index.php", "10.0.0.1:1000", "Firefox", 200)
+	expect("/wp-admin/x", "10.0.0.1:1000", "Firefox", 410)
+
+	req := httptest.NewRequest("GET", "/router/status", nil)
+	req.RemoteAddr = "127.0.0.1:1000"
+	s.status.allowLoopback = true
+	w := httptest.NewRecorder()
+	s.serveStatus(w, req)
+	status := routerStatus{}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	expected := map[string]int64{"IP": 4, "Host": 1, "UserAgent": 1, "Path": 2}
+	for reason, n := range expected {
+		if status.Blocked[reason] != n {
+			t.Errorf("Expected %v requests blocked for %v, but got %v", n, reason, status.Blocked)
+			break
+		}
+	}
+
+	if _, err := newBlocklist(&ConfigBlocklist{DenyIPs: []string{"10.0.0.300"}}); err == nil {
+		t.Errorf("Expected an invalid address to fail")
+	}
+}
+
+func TestBlocklistDefaults(t *testing.T) {
+	blocked := func(config string) (string, int) {
+		t.Helper()
+		c := &Config{}
+		if err := c.LoadString(config); err != nil {
+			t.Fatal(err)
+		}
+		b, err := newBlocklist(&c.Blocklist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.check(testLog(), httptest.NewRequest("GET", "http://yahoo.mail.com/", nil)), b.statusCode
+	}
+	// The rule that used to be built in is still there, with its old status code
+	if reason, code := blocked(`{}`); reason != blockReasonHost || code != http.StatusTeapot {
+		t.Errorf("Expected yahoo.mail.com to be refused with 418 by default, but got %q %v", reason, code)
+	}
+	if reason, _ := blocked(`{"Blocklist": {"Hosts": []}}`); reason != "" {
+		t.Errorf("Expected an empty Hosts list to remove the default rule")
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies in front of the router (HTTP.TrustedProxies). Requests from
+// them carry the address of the real client in X-Forwarded-For. Without this, every client behind
+// a proxy would look like the proxy to the rate limits, the IP lists, and Basic auth lockouts.
+type trustedProxies ipList
+
+type clientIPKey struct{}
+
+func newTrustedProxies(entries []string) (trustedProxies, error) {
+	list, err := parseIPList(entries)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP TrustedProxies: %v", err)
+	}
+	return trustedProxies(list), nil
+}
+
+// Returns req, carrying the address of the client, if req came through trusted proxies.
+// Each proxy appends the address that it received the request from to X-Forwarded-For, so we
+// walk the list from the right, and the first address that isn't a trusted proxy is the client.
+// Addresses to the left of that could have been made up by the client, so they are ignored.
+func (p trustedProxies) resolve(req *http.Request) *http.Request {
+	if len(p) == 0 || !ipList(p).contains(net.ParseIP(remoteIP(req))) {
+		return req
+	}
+	hops := []string{}
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// A proxy would not have written this, so stop at the last address that a proxy vouched for
+			break
+		}
+		client = ip.String()
+		if !ipList(p).contains(ip) {
+			break
+		}
+	}
+	if client == "" {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), clientIPKey{}, client))
+}
+
+// Returns the address of the client, which is the address of the connection, unless the request
+// came through a trusted proxy
+func remoteIP(req *http.Request) string {
+	if client, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return client
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		from     string
+		forwards []string
+		client   string
+	}{
+		{"192.0.2.1:1000", nil, "192.0.2.1"},
+		{"192.0.2.1:1000", []string{"198.51.100.7"}, "192.0.2.1"}, // Not a proxy, so the header is made up
+		{"10.0.0.1:1000", nil, "10.0.0.1"},
+		{"10.0.0.1:1000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"[::1]:1000", []string{"198.51.100.7, 10.0.0.2"}, "198.51.100.7"},       // Two proxies
+		{"10.0.0.1:1000", []string{"203.0.113.1, 198.51.100.7"}, "198.51.100.7"}, // The client added its own header
+		{"10.0.0.1:1000", []string{"203.0.113.1", "198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.1:1000", []string{"junk, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:1000", []string{"2001:db8::1"}, "2001:db8::1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.from
+		for _, f := range c.forwards {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		if got := remoteIP(proxies.resolve(req)); got != c.client {
+			t.Errorf("%v %v: expected client %v, but got %v", c.from, c.forwards, c.client, got)
+		}
+	}
+
+	if _, err := newTrustedProxies([]string{"10.0.0"}); err == nil {
+		t.Errorf("Expected an invalid address to fail")
+	}
+
+	// The client's address is used by the IP lists, which would otherwise see only the proxy
+	s, _ := newTestServer(t, `{"Routes": {"/(.*)": {"Target": "http://a/$1", "DenyIPs": ["198.51.100.0/24"]}}}`)
+	s.proxies = proxies
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(false, w, req)
+	if w.Code != defaultBlockStatusCode {
+		t.Errorf("Expected the client behind the proxy to be blocked, but got %v", w.Code)
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultQueueTimeout = 30 * time.Second
+
+var (
+	errQueueFull    = errors.New("Target is busy, and its queue is full")
+	errQueueTimeout = errors.New("Timed out waiting for the target")
+)
+
+/*
+concurrencyLimiter caps the number of requests that are in flight to a target. Requests beyond the
+cap wait in a bounded FIFO queue, for up to the queue timeout. When a request finishes, its slot is
+handed directly to the request at the front of the queue, so that newcomers can't jump the queue.
+*/
+type concurrencyLimiter struct {
+	maxInFlight int
+	maxQueue    int
+	timeout     time.Duration
+
+	lock     sync.Mutex
+	inFlight int
+	queue    *list.List // Values are chan struct{}, which is closed when the waiter gets a slot
+
+	// Counters for /router/status, guarded by lock
+	rejected  int64
+	timedOut  int64
+	waited    int64
+	waitTotal time.Duration
+	waitMax   time.Duration
+}
+
+type concurrencyStatus struct {
+	InFlight      int
+	Queued        int
+	MaxInFlight   int
+	MaxQueue      int
+	Rejected      int64 // Queue was full
+	TimedOut      int64 // Waited longer than the queue timeout
+	Waited        int64 // Requests that had to queue before they got a slot
+	AverageWaitMS float64
+	MaxWaitMS     float64
+}
+
+// Returns nil if the target has no limit
+func newConcurrencyLimiter(c *ConfigConcurrency) (*concurrencyLimiter, error) {
+	if c.MaxInFlight < 0 || c.MaxQueue < 0 || c.QueueTimeout < 0 {
+		return nil, fmt.Errorf("Concurrency values may not be negative")
+	}
+	if c.MaxInFlight == 0 {
+		if c.MaxQueue != 0 || c.QueueTimeout != 0 {
+			return nil, fmt.Errorf("Concurrency needs MaxInFlight")
+		}
+		return nil, nil
+	}
+	l := &concurrencyLimiter{
+		maxInFlight: c.MaxInFlight,
+		maxQueue:    c.MaxQueue,
+		timeout:     time.Duration(c.QueueTimeout) * time.Second,
+		queue:       list.New(),
+	}
+	if l.timeout == 0 {
+		l.timeout = defaultQueueTimeout
+	}
+	return l, nil
+}
+
+// Wait for a slot. On success, the caller must call release when the request is finished.
+// Returns ctx.Err() if the client went away while waiting.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	l.lock.Lock()
+	if l.inFlight < l.maxInFlight && l.queue.Len() == 0 {
+		l.inFlight++
+		l.lock.Unlock()
+		return nil
+	}
+	if l.queue.Len() >= l.maxQueue {
+		l.rejected++
+		l.lock.Unlock()
+		return errQueueFull
+	}
+	ready := make(chan struct{})
+	el := l.queue.PushBack(ready)
+	l.lock.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err != nil {
+		select {
+		case <-ready:
+			// We were handed a slot at the same moment that we gave up, so give it to the next waiter
+			l.releaseLocked()
+		default:
+			l.queue.Remove(el)
+		}
+		if err == errQueueTimeout {
+			l.timedOut++
+		}
+		return err
+	}
+	wait := time.Since(start)
+	l.waited++
+	l.waitTotal += wait
+	if wait > l.waitMax {
+		l.waitMax = wait
+	}
+	return nil
+}
+
+func (l *concurrencyLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.releaseLocked()
+}
+
+func (l *concurrencyLimiter) releaseLocked() {
+	if front := l.queue.Front(); front != nil {
+		// The slot passes to the waiter, so inFlight stays the same
+		l.queue.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	l.inFlight--
+}
+
+func (l *concurrencyLimiter) status() *concurrencyStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	st := &concurrencyStatus{
+		InFlight:    l.inFlight,
+		Queued:      l.queue.Len(),
+		MaxInFlight: l.maxInFlight,
+		MaxQueue:    l.maxQueue,
+		Rejected:    l.rejected,
+		TimedOut:    l.timedOut,
+		Waited:      l.waited,
+		MaxWaitMS:   float64(l.waitMax) / float64(time.Millisecond),
+	}
+	if l.waited != 0 {
+		st.AverageWaitMS = float64(l.waitTotal) / float64(l.waited) / float64(time.Millisecond)
+	}
+	return st
+}
+
+// Wait for a slot on the target. Returns false if the request may not continue, in which case
+// the response has already been sent.
+func (s *Server) acquireTargetSlot(w http.ResponseWriter, req *http.Request, t *target) bool {
+	err := t.concurrency.acquire(req.Context())
+	switch {
+	case err == nil:
+		return true
+	case err == errQueueFull || err == errQueueTimeout:
+		// Not logged, because a flood would fill the log. The counters are on /router/status.
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+	// Otherwise the client has gone away, so there is nobody to respond to
+	return false
+}
+
+// Targets that have a concurrency limit, keyed on name
+func (s *Server) concurrencyTargets() map[string]*target {
+	targets := map[string]*target{}
+	for _, r := range s.translator.allRoutes() {
+		if r.target.name != "" && r.target.concurrency != nil {
+			targets[r.target.name] = r.target
+		}
+	}
+	return targets
+}
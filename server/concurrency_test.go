@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	arrived := make(chan bool, 10)
+	finish := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- true
+		<-finish
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	s, _ := newTestServer(t, `{
+		"Targets": {"REPORTS": {"URL": "`+backend.URL+`", "Concurrency": {"MaxInFlight": 1, "MaxQueue": 1}}},
+		"Routes": {"/reports/(.*)": "{REPORTS}/$1"}}`)
+	limiter := s.translator.allRoutes()[0].target.concurrency
+
+	send := func() int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, httptest.NewRequest("GET", "/reports/x", nil))
+		return w.Code
+	}
+	codes := make(chan int, 2)
+	go func() { codes <- send() }()
+	<-arrived
+	go func() { codes <- send() }()
+	for limiter.status().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// One in flight and one queued, so a third request is shed
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when the queue is full, but got %v", code)
+	}
+
+	// The queued request goes through once the first one finishes
+	finish <- true
+	<-arrived
+	finish <- true
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Expected 200, but got %v", code)
+		}
+	}
+
+	// A request that waits too long gives up, and so does one whose client goes away
+	limiter.timeout = 20 * time.Millisecond
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.acquire(context.Background()); err != errQueueTimeout {
+		t.Errorf("Expected a queue timeout, but got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.acquire(ctx); err != context.Canceled {
+		t.Errorf("Expected the wait to be cancelled, but got %v", err)
+	}
+	limiter.release()
+
+	req := httptest.NewRequest("GET", "/router/status", nil)
+	req.RemoteAddr = "127.0.0.1:1000"
+	s.status.allowLoopback = true
+	w := httptest.NewRecorder()
+	s.serveStatus(w, req)
+	status := routerStatus{}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	st := status.Concurrency["REPORTS"]
+	if st == nil || st.InFlight != 0 || st.Queued != 0 || st.Rejected != 1 || st.TimedOut != 1 || st.Waited != 1 {
+		t.Errorf("Unexpected status %+v", st)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 
 	serviceconfig "github.com/IMQS/serviceconfigsgo"
@@ -13,6 +16,7 @@ import (
 Example configuration file:
 
 {
+	"$schema": "router-config.schema.json",						Optional. Lets editors validate the file against docs/router-config.schema.json
 	"Proxy": "http://192.168.1.1:1234",							This is used to route any targets that specify UseProxy: true
 	"AccessLog": "c:/imqsvar/logs/router-access.log",			The access log file. If empty, defaults to 'stdout'.
 	"ErrorLog": "c:/imqsvar/logs/router-error.log",				The error log file. If empty, defaults to 'stderr'.
@@ -26,23 +30,94 @@ Example configuration file:
 		"HTTPSPort": 444,										Override default HTTPS port (443)
 		"CertKeyFile": "c:/imqsbin/conf/ssl.key"				SSL private key
 		"CertFile": "c:/imqsbin/conf/ssl.crt"					SSL certificate file. Concatenation of your certificate with the CA certificate chain.
+		"ClientCerts": {										Optional. Verify client certificates on the HTTPS listener, against the CAs in CAFile.
+			"Mode": "Optional",									"Optional" verifies a certificate if one is sent. "Require" rejects connections without one,
+			"CAFile": "c:/imqsbin/conf/devices-ca.crt"			which locks out browsers. See Auth.ClientCertRules for what a certificate may access.
+		},
+		"TrustedProxies": ["10.0.0.5"],							Optional. Reverse proxies whose X-Forwarded-For gives the client's address to rate limits,
+																IP lists and Basic auth lockouts. Without this, clients behind a proxy share its address.
 		"DisableKeepAlive": true,								Controls http.Transport.DisableKeepAlive (backend comms). Default = false
 		"MaxIdleConnections": 50,								Controls http.Transport.MaxIdleConnections (backend comms). Default = 0 (uses Go std library default)
 		"ResponseHeaderTimeout": 60								Controls http.Transport.ResponseHeaderTimeout (backend comms). Default = 0 (uses Go std library default)
 	},
+	"ConfigService": {											Optional. By default, the router publishes its address to the IMQS config service, and
+		"Type": "File",											fetches TLS certificates from it when running in a container. "None" runs stand-alone.
+		"Directory": "c:/imqsbin/conf"							"File" reads certificates from Directory instead. The -standalone flag selects "None".
+	},
+	"Auth": {
+		"SessionJWT": {											Optional. Validate signed session tokens (RS256, ES256, EdDSA) locally, instead of asking imqsauth.
+			"KeyURL": "http://auth/keys.json",					JWKS document. Alternatively "KeyFile", which may be JWKS or PEM. Reloaded every "KeyRefresh" seconds,
+			"Issuer": "imqsauth",								and whenever a token arrives with an unknown key ID. Tokens that are not JWTs, or that are
+			"PermissionsClaim": "permissions"					signed by an unknown key, are still checked by imqsauth.
+		},
+		"DecisionCache": {										Optional. Remember the answers from imqsauth, keyed on session and permission.
+			"TTL": 10,											Seconds to remember a granted permission. Zero (the default) disables the cache.
+			"NegativeTTL": 2,									Seconds to remember a 401 or 403. Zero means denials are always re-checked.
+			"MaxEntries": 10000,								Least recently used entries are dropped beyond this.
+			"LogoutPath": "/auth2/logout"						A request here drops the cached entries of its session. Counters are in /router/status.
+		},
+		"TokenStore": {											Optional. Save pass-through tokens to an encrypted file, so that a restart doesn't log in again.
+			"File": "c:/imqsvar/router/tokens.bin",				Tokens of a target are discarded if its config changes.
+			"Key": "${file:/run/secrets/router-token-key}"		At least 16 characters. If empty, the environment variable ROUTER_TOKEN_STORE_KEY is used.
+		},
+		"IdentityJWT": {										Optional. The key that signs the identity tokens of targets with "ForwardIdentity": {"Mode": "JWT"}.
+			"KeyFile": "c:/imqsbin/conf/router-identity.pem",	PEM private key (RSA, P-256 or Ed25519), or "Secret" for HS256. Tokens carry sub, username,
+			"KeyID": "router-1",								email and permissions, are valid for "Lifetime" seconds (default 60), and are sent in
+			"Lifetime": 60										"Header" (default X-IMQS-Identity).
+		},
+		"ClientCertRules": [									Map verified client certificates to the routes, or permissions, that they may use without an IMQS session.
+			{													All of Subject, SAN (regexes) and Fingerprint (hex SHA-256) that are given must match. The first matching
+				"Name": "meters",								rule wins, and its Name is forwarded in X-Client-Cert-Name, along with X-Client-Cert-Subject, -SAN,
+				"Subject": "CN=meter-.*,O=IMQS",				-Fingerprint, etc. Targets and routes with "RequireClientCert": true refuse requests without a certificate
+				"Routes": ["/telemetry/(.*)"],					that is allowed to use them.
+				"Permissions": ["enabled"]
+			}
+		],
+		"APIKeys": {											Optional. Machine clients may send an API key instead of an IMQS session, on targets and
+			"File": "c:/imqsbin/conf/apikeys.json",				routes that have AllowAPIKeys. The file holds hashed keys, and is reloaded when it changes.
+			"Header": "X-API-Key",								The header and query parameter are removed from every request.
+			"QueryParam": "api_key",							Optional. Headers are preferred, because query strings end up in logs.
+			"ForwardHeader": "X-API-Key-Name"					The backend receives the name of the key in this header.
+		}
+	},
+	"Blocklist": {												Optional. Refuse requests before they are routed, with StatusCode (default 418).
+		"File": "c:/imqsbin/conf/blocklist.json",				More rules, in the same form. Reloaded when it changes.
+		"DenyIPs": ["203.0.113.0/24", "2001:db8::/32"],			"AllowIPs" restricts the router to a list of addresses. Targets and routes may have
+		"Hosts": ["^yahoo\\.mail\\.com$"],						their own AllowIPs and DenyIPs. "Hosts" (default: this rule), "UserAgents" and "Paths" are regexes.
+		"UserAgents": ["(?i)masscan"]							Blocked requests are counted in /router/status, and logged at most every 10 seconds.
+	},
+	"Status": {"RequirePermission": "admin"},					Who may read /router/status, besides other services. "AllowLoopback": true allows the local
+																machine, which is only safe if a local reverse proxy is in HTTP.TrustedProxies.
+	"Include": ["conf.d"],										Fragments that add Targets and Routes. Files, globs, or directories. Relative to this file.
 	"Targets": {
 		"MAPS": {												Targets names must be CAPITAL. This rule exists solely to enforce a convention.
 			"URL": "http://127.0.0.1:2000",
-			"UseProxy": true									If true, and a proxy is specified, then route this traffic through the proxy
-		},
+			"UseProxy": true,									If true, and a proxy is specified, then route this traffic through the proxy
+			"Concurrency": {"MaxInFlight": 4, "MaxQueue": 50, "QueueTimeout": 30},	At most 4 requests at once. Others wait in a queue, and get 503 when
+																					it's full, or after QueueTimeout seconds. Queue stats are on /router/status.
+			"ForwardIdentity": {"Mode": "Headers"},				Tell the backend who the user is, with X-IMQS-User-ID, -Username, -Email and -Permissions,
+																or with "Mode": "JWT", a token signed with Auth.IdentityJWT. Clients can't send these themselves.
+			"Signing": {"Secret": "${file:/run/secrets/maps}", "Headers": ["Content-Type", "X-IMQS-User-ID"]}	HMAC-SHA256 over the method, original path, query,
+		},																										these headers, body hash and time. Verify with the Go
+																												package github.com/IMQS/router/signing.
 		"THIRDPARTY": {
 			"URL": "https://externalsite.com",
-			"RequirePermission": "enabled",						Do not allow traffic to this target unless imqsauth says we have this permission
-			"PassThroughAuth": {								Transparent authentication
-				"Type": "PureHub",
+			"RequirePermission": "enabled",						Do not allow traffic to this target unless imqsauth says we have this permission. This may be an
+																expression, such as "report OR admin", or "enabled AND NOT guest".
+			"MethodPermissions": {"POST,DELETE": "admin"},		Methods that need other permissions. Routes may have RequirePermission and MethodPermissions
+																too, which take precedence over the target's.
+			"AllowAPIKeys": true,								Or unless the request has a valid API key (see Auth.APIKeys). Routes may also say "AllowAPIKeys".
+			"RateLimit": {"Rate": 5, "Burst": 20, "Key": "User"},	Token bucket per client, keyed on "IP" (default), "User", "APIKey" or "Header:<name>". Routes may have
+																their own RateLimit, which applies as well. Excess requests get 429 and Retry-After.
+			"PassThroughAuth": {								Transparent authentication. Type is one of PureHub, SitePro, ECS, CouchDB, OAuth2, Delegated, SigV4, Header.
+				"Type": "PureHub",								Settings that only apply to one Type go into "Options": {...}
 				"LoginURL": "https://externalsite.com/Token",
 				"Username": "username@example.com",
-				"Password": "mypassword"
+				"Password": "${file:/run/secrets/purehub}",				Any string may refer to ${NAME}, ${NAME:-default}, or ${file:/path/to/secret}
+				"InvalidateOn": {								Optional. Discard our cached token when the backend rejects it, which happens when it restarts.
+					"StatusCodes": [401],						Any of these triggers invalidation. "Header" and "BodyPattern" (regex over the start of HTML bodies)
+					"RedirectPattern": "/Account/Login"			are also available. Idempotent requests are then retried once, with a fresh token.
+				}
 			}
 		}
 	},
@@ -58,10 +133,60 @@ Example configuration file:
 		"/extile/(.*)": {                                       This long form is required when the hostname is not specified in the replacement text
 			"Target": "http://$1",
 			"ValidHosts": ["tile.mapbox.com", "tile.thunderforest.com"]
+		},
+		"/fauxton/(.*)": {
+			"Target": "http://127.0.0.1:5984/_utils/$1",
+			"BasicAuth": {"File": "c:/imqsbin/conf/fauxton.htpasswd"}	Targets may have BasicAuth too. Hashes may be bcrypt, SHA or apr1. The file is
+																		reloaded when it changes, and an IP address with 5 failures in a minute is locked out.
+		},
+		"/assets/(.*)": {
+			"Target": "http://127.0.0.1:2010/$1",
+			"Audit": {											Record requests in the imqsauth audit log. The first rule whose Methods and Path (regex)
+				"Unmatched": "Deny",							match wins. DidWhat, ToWhat and Context (JSON) are templates, with $1 or $name for capture
+				"Rules": [										groups, and ${request.url}, ${user.username}, etc. A rule without DidWhat lets requests
+					{"Methods": ["DELETE"], "Path": "/assets/(\\w+)/(\\d+)", "DidWhat": "delete $1", "ToWhat": "$2"},
+					{"Methods": ["GET"], "Path": "/assets/.*"}	through without recording them. "Unmatched": "Deny" refuses everything else with 400.
+				]												Targets may have Audit rules too. ECS targets default to the ECS rules.
+			}
+		},
+		"/files/(.*)": {
+			"Target": "http://127.0.0.1:2011/$1",
+			"RequirePermission": "enabled",
+			"Owner": {"Path": "/files/{owner}/.*", "Field": "Username"}	Users may only reach their own files. {owner} (or a capture group) must equal the
+																		user's UserID (default), Username, Email or Tenant. Others get 403. Targets may
+																		have an Owner too. CouchDB targets default to userdb-<user id>.
 		}
 	},
 }
 
+The config file may also be written as YAML (.yaml or .yml) or TOML (.toml). The file extension decides the format,
+and the structure is identical to the JSON form. Those formats allow the annotations above to be real comments:
+
+	HTTP:
+	  Port: 80                      # Primary HTTP port. Env var HTTP_PORT overrides this.
+	Targets:
+	  MAPS:                         # Targets names must be CAPITAL.
+	    URL: http://127.0.0.1:2000
+	Routes:
+	  /tile/(.*): "{MAPS}/tile/$1"  # Values starting with '{' must be quoted in YAML
+	  /extile/(.*):
+	    Target: http://$1
+	    ValidHosts: [tile.mapbox.com, tile.thunderforest.com]
+
+A fragment pulled in by Include may only contain "Targets" and "Routes". A target or route that is defined
+in more than one file is an error. Run the router with -show-config to see the merged result.
+
+Unknown fields are an error, in all formats. Run the router with -config-schema to produce a JSON Schema
+of the config file. A copy of it lives in docs/router-config.schema.json.
+
+Environment variables and secret files:
+Any string value may contain ${NAME}, which is replaced by the environment variable NAME, or ${file:/run/secrets/x},
+which is replaced by the contents of that file. Either form can be given a default with ":-", as in ${NAME:-default}.
+In Routes and Audit rules, ${name} is a named capture group of the regex, so environment variables must be written
+as ${env:NAME} there. ${env:NAME} works everywhere else too. Anything else inside ${}, such as ${1}, is left alone.
+It is an error to refer to an environment variable that is not set, or a file that does not exist, unless a default is given.
+Write $${ to produce a literal ${. Values read from files, and all Password fields, are redacted from -show-config.
+
 Notes about configuration:
 In order to keep the system performant, routes must start with a static prefix. The first opening parenthesis
 signals the end of the prefix. Should we need more complicated rewriting rules, we'd need to add support for that.
@@ -73,25 +198,38 @@ in terms of the number of slashes in the prefix, is 10. In other words prefixes
 type AuthPassThroughType string
 
 const (
-	AuthPassThroughNone    AuthPassThroughType = ""
-	AuthPassThroughPureHub                     = "PureHub"
-	AuthPassThroughSitePro                     = "SitePro"
-	AuthPassThroughECS                         = "ECS"
-	AuthPassThroughCouchDB                     = "CouchDB"
-	serviceConfigFileName                      = "router-config.json"
-	serviceConfigVersion                       = 1
-	serviceName                                = "ImqsRouter"
+	AuthPassThroughNone      AuthPassThroughType = ""
+	AuthPassThroughPureHub                       = "PureHub"
+	AuthPassThroughSitePro                       = "SitePro"
+	AuthPassThroughECS                           = "ECS"
+	AuthPassThroughCouchDB                       = "CouchDB"
+	AuthPassThroughOAuth2                        = "OAuth2"
+	AuthPassThroughDelegated                     = "Delegated"
+	AuthPassThroughSigV4                         = "SigV4"
+	AuthPassThroughHeader                        = "Header"
+	serviceConfigFileName                        = "router-config.json"
+	serviceConfigVersion                         = 1
+	serviceName                                  = "ImqsRouter"
 )
 
 type Config struct {
-	Proxy       string
-	AccessLog   string
-	ErrorLog    string
-	LogLevel    string
-	DebugRoutes bool
-	HTTP        ConfigHTTP
-	Targets     map[string]ConfigTarget
-	Routes      map[string]interface{} // Value is either a string or ConfigRoute
+	Schema        string `json:"$schema,omitempty"` // Optional reference to router-config.schema.json, for editors
+	Proxy         string
+	AccessLog     string
+	ErrorLog      string
+	LogLevel      string
+	DebugRoutes   bool
+	HTTP          ConfigHTTP
+	ConfigService ConfigConfigService
+	Auth          ConfigAuth
+	Blocklist     ConfigBlocklist
+	Status        ConfigStatus // Who may read /router/status
+	Include       []string     // Config fragments (files, globs, or directories) that add Targets and Routes
+	Targets       map[string]ConfigTarget
+	Routes        map[string]interface{} // Value is either a string or ConfigRoute
+
+	sources map[string]string // Name of the file that defined each of the Targets and Routes
+	secrets []string          // Values that were read from ${file:...} references, which must not be shown in debug output
 }
 
 type ConfigHTTP struct {
@@ -106,11 +244,179 @@ type ConfigHTTP struct {
 	ResponseHeaderTimeout int
 	RedirectHTTP          bool
 	AutomaticGzip         automaticGzip
+	ClientCerts           ConfigClientCerts // Verify client certificates on the HTTPS listener
+	TrustedProxies        []string          // Reverse proxies (addresses or CIDR ranges) whose X-Forwarded-For gives the client's address
+}
+
+type ConfigClientCerts struct {
+	Mode   ClientCertMode // "" (client certificates are not requested), "Optional", or "Require"
+	CAFile string         // PEM file with the CAs that may issue client certificates
+}
+
+// A rule that maps a verified client certificate to the routes and permissions that it may use.
+// Every one of Subject, SAN and Fingerprint that is specified must match.
+type ConfigClientCertRule struct {
+	Name        string   // Forwarded to the backend in X-Client-Cert-Name
+	Subject     string   // Regex matched against the whole subject, eg "CN=meter-.*,O=IMQS"
+	SAN         string   // Regex matched against each DNS name, email address, IP address and URI in the certificate
+	Fingerprint string   // Hex SHA-256 of the certificate. Colons are allowed.
+	Routes      []string // Routes that the certificate may use, exactly as they appear in Routes. "*" means all.
+	Permissions []string // The certificate may use targets and routes whose RequirePermission these satisfy
+}
+
+type ConfigConfigService struct {
+	Type      ConfigServiceType // "" (the IMQS config service), "None", or "File"
+	Directory string            // For type "File", the directory that holds the files that the config service would otherwise provide
+}
+
+type ConfigAuth struct {
+	SessionJWT      ConfigSessionJWT       // Validate signed session tokens locally, instead of asking imqsauth
+	DecisionCache   ConfigDecisionCache    // Cache the answers from imqsauth
+	TokenStore      ConfigTokenStore       // Keep pass-through tokens across restarts
+	APIKeys         ConfigAPIKeys          // Let machine clients authenticate with an API key
+	ClientCertRules []ConfigClientCertRule // What client certificates may access. See HTTP.ClientCerts.
+	IdentityJWT     ConfigIdentityJWT      // How we sign the identity tokens of targets whose ForwardIdentity Mode is "JWT"
+}
+
+// Other services (inter-service requests) may always read /router/status. Nobody else may, unless allowed here.
+type ConfigStatus struct {
+	RequirePermission string // IMQS users whose permissions satisfy this expression, eg "admin"
+	AllowLoopback     bool   // Any request from the local machine. A local reverse proxy makes every request local, unless it is in HTTP.TrustedProxies.
+}
+
+// Requests that are refused before they are routed. The rules here are fixed, while the rules in
+// File are reloaded when it changes.
+type ConfigBlocklist struct {
+	File       string   // JSON file with more rules, in the form of ConfigBlockRules
+	Reload     int      // Seconds between checks for changes to File. Default 10
+	StatusCode int      // Response to a blocked request. Default 418
+	AllowIPs   []string // If not empty, only these addresses and CIDR ranges may use the router
+	DenyIPs    []string // Addresses and CIDR ranges that may not use the router. Takes precedence over AllowIPs.
+	Hosts      []string // Regexes matched against the Host. Default ["^yahoo\\.mail\\.com$"]. An empty list blocks no hosts.
+	UserAgents []string // Regexes matched against the User-Agent
+	Paths      []string // Regexes matched against the path
+}
+
+// The rules in Blocklist.File
+type ConfigBlockRules struct {
+	AllowIPs   []string
+	DenyIPs    []string
+	Hosts      []string
+	UserAgents []string
+	Paths      []string
+}
+
+type ConfigAPIKeys struct {
+	File          string // JSON file with the hashed keys. Empty disables API keys.
+	Header        string // Request header that carries the key. Default "X-API-Key"
+	QueryParam    string // If not empty, the key may also be given in this query parameter, eg "api_key"
+	ForwardHeader string // The name of the key is sent to the backend in this header. Default "X-API-Key-Name"
+	Reload        int    // Seconds between checks for changes to File. Default 10
+}
+
+type ConfigTokenStore struct {
+	File string // Encrypted file that holds the tokens. Empty disables the store.
+	Key  string // Secret from which the encryption key is derived. If empty, the environment variable ROUTER_TOKEN_STORE_KEY is used.
+}
+
+type ConfigDecisionCache struct {
+	TTL         int    // Seconds for which a permission granted by imqsauth is remembered. Zero disables the cache.
+	NegativeTTL int    // Seconds for which a denial (401 or 403) is remembered. Zero means denials are not cached.
+	MaxEntries  int    // Default 10000. The least recently used entry is dropped when the cache is full.
+	LogoutPath  string // Default "/auth2/logout". A request to this path drops all entries of its session.
+}
+
+// The key that signs identity tokens. Backends verify the tokens with the matching public key, or
+// with Secret. The algorithm follows from the key: RS256, ES256 (P-256) or EdDSA (Ed25519), or HS256 for a Secret.
+type ConfigIdentityJWT struct {
+	KeyFile  string // PEM private key
+	Secret   string // Shared secret for HS256, at least 32 characters. Only one of KeyFile or Secret may be specified.
+	KeyID    string // "kid" of the token header
+	Issuer   string // "iss" claim. Default "imqs-router"
+	Lifetime int    // Seconds until a token expires. Default 60
+	Header   string // Request header that carries the token. Default "X-IMQS-Identity"
+}
+
+// Tell a backend who the user is, so that it doesn't have to validate the session itself.
+// Only requests from an IMQS user carry an identity.
+type ConfigForwardIdentity struct {
+	Mode     ForwardIdentityMode // "" (nothing is forwarded), "Headers", or "JWT"
+	Audience string              // "aud" claim of the token. Default is the target's name.
+}
+
+// Session tokens must have an "exp" claim. Tokens without one are refused, because they could never be revoked.
+type ConfigSessionJWT struct {
+	KeyFile          string // JWKS document, or PEM file with public keys or certificates
+	KeyURL           string // URL of a JWKS document. Only one of KeyFile or KeyURL may be specified.
+	KeyRefresh       int    // Seconds between reloads of the key set. Default 300
+	Issuer           string // If not empty, the "iss" claim must equal this
+	Audience         string // If not empty, the "aud" claim must contain this
+	Cookie           string // Name of the cookie that holds the session token. Default "session". An "Authorization: Bearer" header is also accepted.
+	UserIDClaim      string // Default "uid"
+	UsernameClaim    string // Default "username"
+	EmailClaim       string // Default "email"
+	PermissionsClaim string // Default "permissions". Either a list of strings, or a space-separated string.
+	TenantClaim      string // Default "tenant"
 }
 
 type ConfigRoute struct {
-	Target     string   // The same "target" value that is usually on the right side of a simple string-to-string { "src": "target" } route.
-	ValidHosts []string // If Target has no explicit hostname (eg "http://$1"), then only hosts in ValidHosts are allowed
+	Target            string            // The same "target" value that is usually on the right side of a simple string-to-string { "src": "target" } route.
+	ValidHosts        []string          // If Target has no explicit hostname (eg "http://$1"), then only hosts in ValidHosts are allowed
+	RequirePermission string            // Overrides the target's permissions
+	MethodPermissions map[string]string // Overrides the target's permissions, for these methods
+	AllowAPIKeys      bool              // Accept API keys on this route, even if the target doesn't (see Auth.APIKeys)
+	BasicAuth         ConfigBasicAuth   // Protect this route with an htpasswd file. Overrides the target's BasicAuth.
+	RequireClientCert bool              // Only clients with a certificate that may use this route are allowed (see Auth.ClientCertRules)
+	AllowIPs          []string          // If not empty, only these addresses and CIDR ranges may use this route
+	DenyIPs           []string          // Addresses and CIDR ranges that may not use this route
+	RateLimit         ConfigRateLimit   // Applies in addition to the target's RateLimit
+	Audit             ConfigAudit       // Overrides the target's Audit
+	Owner             ConfigOwner       // Overrides the target's Owner
+}
+
+// Restricts a target or route to the user that its URL belongs to, such as a per-user database.
+// Requests without an IMQS user, and requests to paths that don't match Path and aren't exempt, get 403.
+type ConfigOwner struct {
+	Path   string   // Regex over the request path. The capture group named "owner" (or "{owner}", which matches one segment), or else the first group, holds the owner.
+	Field  string   // The field of the user that must equal the owner: "UserID" (default), "Username", "Email", or "Tenant" (see Auth.SessionJWT.TenantClaim)
+	Exempt []string // Paths (regex) that need no owner, such as a health check
+}
+
+// Which requests are recorded in the imqsauth audit log. The first rule that matches a request wins.
+type ConfigAudit struct {
+	Rules     []ConfigAuditRule
+	Unmatched string // "Allow" (default) or "Deny". What happens to requests that match no rule.
+}
+
+// Templates may use the capture groups of Path ($1, or $name or ${name} for a named group), and ${request.method},
+// ${request.path}, ${request.url}, ${user.id}, ${user.username} and ${user.email}.
+type ConfigAuditRule struct {
+	Methods []string // Empty matches every method
+	Path    string   // Regex over the whole path of the incoming request
+	DidWhat string   // Template, eg "$1". Empty allows the request without recording it.
+	ToWhat  string   // Template. Default "${request.url}"
+	Context string   // Template of a JSON object, eg {"site": "$2"}. Variables must be inside strings. Default "{}"
+}
+
+// Caps the number of HTTP requests that a target handles at once. Requests beyond the cap wait in a FIFO queue.
+type ConfigConcurrency struct {
+	MaxInFlight  int // Zero disables the limit
+	MaxQueue     int // Requests that may wait for a slot. When the queue is full, requests get 503. Default 0 (no queue).
+	QueueTimeout int // Seconds that a request may wait in the queue before it gets 503. Default 30
+}
+
+// A token bucket rate limit. Every client gets its own bucket.
+type ConfigRateLimit struct {
+	Rate  float64 // Requests per second. Zero disables the limit.
+	Burst int     // Number of requests that may be made at once. Default is Rate, rounded up.
+	Key   string  // What identifies a client: "IP" (default), "User", "APIKey", or "Header:<name>". Falls back to IP when missing.
+}
+
+type ConfigBasicAuth struct {
+	File                 string // htpasswd file, with bcrypt, SHA, or apr1 hashes. Empty disables Basic auth.
+	Realm                string // Default "IMQS"
+	ForwardAuthorization bool   // Send the Authorization header to the backend. By default it is removed.
+	Reload               int    // Seconds between checks for changes to File. Default 10
 }
 
 type automaticGzip struct {
@@ -120,19 +426,48 @@ type automaticGzip struct {
 }
 
 type ConfigPassThroughAuth struct {
-	Type     AuthPassThroughType
-	LoginURL string
-	Username string
-	Password string
+	Type         AuthPassThroughType
+	LoginURL     string
+	Username     string
+	Password     string
+	Options      map[string]interface{} // Settings that are specific to Type. Each provider documents its own.
+	InvalidateOn ConfigInvalidateOn     // Backend responses that mean our cached credentials are no longer accepted
+}
+
+type ConfigInvalidateOn struct {
+	StatusCodes      []int    // eg [401, 403]
+	Header           string   // A response header whose presence means rejection, eg "WWW-Authenticate"
+	BodyPattern      string   // Regex matched against the first 8KB of the response body, eg "<title>Login</title>"
+	BodyContentTypes []string // Responses whose bodies are matched against BodyPattern. Default ["text/html"]. Event streams never are.
+	RedirectPattern  string   // Regex matched against the Location of a 3xx response, eg "/logon\\.jsp"
 }
 
 type ConfigTarget struct {
 	URL               string
 	UseProxy          bool
-	RequirePermission string
+	RequirePermission string                // Permission expression, eg "enabled", or "report OR admin", or "enabled AND NOT guest"
+	MethodPermissions map[string]string     // Permission expressions for particular methods, eg {"GET": "read", "POST,DELETE": "admin"}
+	AllowAPIKeys      bool                  // Machine clients may use an API key instead of an IMQS session (see Auth.APIKeys)
+	BasicAuth         ConfigBasicAuth       // Protect this target with an htpasswd file
+	RequireClientCert bool                  // Only clients with a certificate that may use this target are allowed (see Auth.ClientCertRules)
+	AllowIPs          []string              // If not empty, only these addresses and CIDR ranges may use this target
+	DenyIPs           []string              // Addresses and CIDR ranges that may not use this target
+	RateLimit         ConfigRateLimit       // Limit the requests that each client may make to this target
+	Concurrency       ConfigConcurrency     // Limit the requests that this target handles at once
+	ForwardIdentity   ConfigForwardIdentity // Send the user's identity to this target
+	Audit             ConfigAudit           // Record requests in the imqsauth audit log. ECS targets have default rules.
+	Owner             ConfigOwner           // Only the user that the URL belongs to may use this target. CouchDB targets have a default rule.
+	Signing           ConfigSigning         // Sign the requests that we forward to this target, so that it knows they came through the router
 	PassThroughAuth   ConfigPassThroughAuth
 }
 
+// HMAC signing of forwarded requests. Backends written in Go verify them with github.com/IMQS/router/signing.
+type ConfigSigning struct {
+	Secret      string   // Shared with the backend. At least 32 characters. Usually "${file:/run/secrets/...}".
+	Headers     []string // Headers that are signed, besides the method, original path, query, body and timestamp. Default ["Content-Type"].
+	MaxBodySize int64    // Requests with a larger body are refused with 413, because the body must be hashed. Default 8 MB.
+}
+
 // {FOO}/bar -> ( FOO, /bar)
 func splitNamedTarget(targetURL string) (string, string) {
 	open := strings.Index(targetURL, "{")
@@ -170,6 +505,11 @@ func (c *Config) verify() error {
 			if !ok {
 				return fmt.Errorf("Match %v has invalid value type. Must be either a string, or an object with 'Target' and 'ValidHosts'", match)
 			}
+			for key := range ct {
+				if _, known := structFieldByName(reflect.ValueOf(ConfigRoute{}), key); !known {
+					return fmt.Errorf("Route %v has unknown field '%v'", match, key)
+				}
+			}
 			replace, ok = ct["Target"].(string)
 		}
 
@@ -211,10 +551,31 @@ func (c *Config) verify() error {
 	return nil
 }
 
+// LoadFile loads the config from filename, which may be JSON, YAML, or TOML, depending on its extension.
+// If filename is empty, then the JSON config is fetched from the config service.
 func (c *Config) LoadFile(filename string) error {
 	c.Reset()
-	err := serviceconfig.GetConfig(filename, serviceName, serviceConfigVersion, serviceConfigFileName, c)
-	if err != nil {
+	var data []byte
+	if filename == "" {
+		raw := json.RawMessage{}
+		if err := serviceconfig.GetConfig(filename, serviceName, serviceConfigVersion, serviceConfigFileName, &raw); err != nil {
+			return err
+		}
+		data = raw
+	} else {
+		var err error
+		if data, err = os.ReadFile(filename); err != nil {
+			return err
+		}
+	}
+	if err := decodeConfig(data, configFormatOf(filename), c); err != nil {
+		return err
+	}
+	if err := c.interpolate(c); err != nil {
+		return err
+	}
+	c.recordSources(filename)
+	if err := c.loadIncludes(filepath.Dir(filename)); err != nil {
 		return err
 	}
 	c.populateGzipWhitelist()
@@ -223,7 +584,14 @@ func (c *Config) LoadFile(filename string) error {
 
 func (c *Config) LoadString(jsonConfig string) error {
 	c.Reset()
-	if err := json.Unmarshal([]byte(jsonConfig), c); err != nil {
+	if err := decodeConfig([]byte(jsonConfig), configFormatJSON, c); err != nil {
+		return err
+	}
+	if err := c.interpolate(c); err != nil {
+		return err
+	}
+	c.recordSources("")
+	if err := c.loadIncludes(""); err != nil {
 		return err
 	}
 	c.populateGzipWhitelist()
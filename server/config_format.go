@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type configFormat int
+
+const (
+	configFormatJSON configFormat = iota
+	configFormatYAML
+	configFormatTOML
+)
+
+// Pick the config file format from the filename extension.
+// Anything we don't recognize is JSON, which was the only format we supported before YAML and TOML.
+func configFormatOf(filename string) configFormat {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return configFormatYAML
+	case ".toml":
+		return configFormatTOML
+	}
+	return configFormatJSON
+}
+
+// Decode a config document into v, which must be a pointer.
+// Decoding is strict: a key that does not correspond to a field is an error, because a silently
+// ignored typo such as "RequirePermision" could leave a target unprotected.
+// Errors include the line number in the document, wherever the underlying decoder can tell us what it is.
+func decodeConfig(data []byte, format configFormat, v interface{}) error {
+	switch format {
+	case configFormatYAML:
+		return decodeYAML(data, v)
+	case configFormatTOML:
+		md, err := toml.Decode(string(data), v)
+		if err != nil {
+			return err
+		}
+		for _, key := range md.Undecoded() {
+			if !insideInterface(reflect.TypeOf(v), key) {
+				return fmt.Errorf("unknown field %q", key.String())
+			}
+		}
+		return nil
+	}
+	return decodeJSON(data, v)
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("unexpected content after the end of the document")
+	}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("line %v: %v", lineOfOffset(data, e.Offset), err)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("line %v: %v", lineOfOffset(data, e.Offset), err)
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field ") {
+		// encoding/json doesn't tell us where the unknown field is, so we assume it is the first occurrence of that key
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		if offset := strings.Index(string(data), field); offset != -1 {
+			return fmt.Errorf("line %v: %v", lineOfOffset(data, int64(offset)), err)
+		}
+	}
+	if err == io.EOF {
+		return fmt.Errorf("config document is empty")
+	}
+	return err
+}
+
+// The TOML decoder reports everything below an interface{} (such as the long form of Routes) as undecoded.
+// Those values are checked later, when they are turned into their concrete types.
+func insideInterface(t reflect.Type, key toml.Key) bool {
+	for _, part := range key {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Interface:
+			return true
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			field, ok := structFieldByName(reflect.New(t).Elem(), part)
+			if !ok {
+				return false
+			}
+			t = field.Type()
+		default:
+			return false
+		}
+	}
+	return t.Kind() == reflect.Interface
+}
+
+// Returns the 1-based line number of the given byte offset
+func lineOfOffset(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return 1 + strings.Count(string(data[:offset]), "\n")
+}
+
+// We don't let yaml.v3 decode directly into our structs, because it matches keys against lower-cased field names,
+// so "HTTP" would have to be written as "http". Instead, we walk the parsed document ourselves, and match keys to
+// fields the same way encoding/json does, which keeps a YAML config identical in shape to its JSON equivalent.
+func decodeYAML(data []byte, v interface{}) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		// Empty document
+		return nil
+	}
+	return decodeYAMLNode(doc.Content[0], reflect.ValueOf(v).Elem())
+}
+
+func decodeYAMLNode(node *yaml.Node, v reflect.Value) error {
+	if node.Kind == yaml.AliasNode {
+		return decodeYAMLNode(node.Alias, v)
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeYAMLNode(node, v.Elem())
+	case reflect.Interface:
+		// Let yaml.v3 produce the generic representation (map[string]interface{}, []interface{}, etc)
+		var any interface{}
+		if err := node.Decode(&any); err != nil {
+			return fmt.Errorf("line %v: %v", node.Line, err)
+		}
+		if any != nil {
+			v.Set(reflect.ValueOf(any))
+		}
+		return nil
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return yamlTypeError(node, v)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := structFieldByName(v, key.Value)
+			if !ok {
+				return fmt.Errorf("line %v: unknown field %q in %v", key.Line, key.Value, v.Type())
+			}
+			if err := decodeYAMLNode(value, field); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode || v.Type().Key().Kind() != reflect.String {
+			return yamlTypeError(node, v)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeYAMLNode(value, elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key.Value).Convert(v.Type().Key()), elem)
+		}
+		return nil
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return yamlTypeError(node, v)
+		}
+		s := reflect.MakeSlice(v.Type(), len(node.Content), len(node.Content))
+		for i, item := range node.Content {
+			if err := decodeYAMLNode(item, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+
+	// Scalars
+	if node.Kind != yaml.ScalarNode {
+		return yamlTypeError(node, v)
+	}
+	if err := node.Decode(v.Addr().Interface()); err != nil {
+		return yamlTypeError(node, v)
+	}
+	return nil
+}
+
+func yamlTypeError(node *yaml.Node, v reflect.Value) error {
+	what := node.Value
+	switch node.Kind {
+	case yaml.MappingNode:
+		what = "object"
+	case yaml.SequenceNode:
+		what = "list"
+	default:
+		what = fmt.Sprintf("%q", what)
+	}
+	return fmt.Errorf("line %v: cannot use %v as %v", node.Line, what, v.Type())
+}
+
+// Find a struct field in the same way that encoding/json does. A json tag name takes precedence over the
+// Go field name, and if there is no exact match, then we fall back to a case-insensitive match.
+func structFieldByName(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	fold := -1
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		fieldName := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			fieldName = tag
+		}
+		if fieldName == name {
+			return v.Field(i), true
+		}
+		if fold == -1 && strings.EqualFold(fieldName, name) {
+			fold = i
+		}
+	}
+	if fold != -1 {
+		return v.Field(fold), true
+	}
+	return reflect.Value{}, false
+}
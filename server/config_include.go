@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A config fragment, which is pulled in by the Include list of the main config.
+// Every IMQS module that needs routes can drop one of these into a conf.d directory,
+// instead of having its routes merged by hand into the main config file.
+type configFragment struct {
+	Targets map[string]ConfigTarget
+	Routes  map[string]interface{}
+}
+
+// Extensions of the files that we pick up when an Include entry is a directory
+var configFragmentExtensions = map[string]bool{
+	".json": true,
+	".yaml": true,
+	".yml":  true,
+	".toml": true,
+}
+
+// Remember which file defined each of the Targets and Routes, so that we can report duplicates.
+// mainFile is the name of the file that the top-level config came from.
+func (c *Config) recordSources(mainFile string) {
+	if mainFile == "" {
+		mainFile = "main config"
+	}
+	c.sources = map[string]string{}
+	for name := range c.Targets {
+		c.sources["Target "+name] = mainFile
+	}
+	for match := range c.Routes {
+		c.sources["Route "+match] = mainFile
+	}
+}
+
+// Load all of the fragments listed in c.Include, and merge them into c.
+// Relative paths are relative to baseDir, which is the directory of the main config file.
+func (c *Config) loadIncludes(baseDir string) error {
+	for _, include := range c.Include {
+		files, err := expandInclude(baseDir, include)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := c.loadFragment(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// An Include entry may be a single file, a glob, or a directory. Directories are expanded to all of the
+// config files inside them, in alphabetical order. Globs and directories may legitimately match nothing.
+func expandInclude(baseDir, include string) ([]string, error) {
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(baseDir, include)
+	}
+	if info, err := os.Stat(include); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(include)
+		if err != nil {
+			return nil, err
+		}
+		files := []string{}
+		for _, e := range entries {
+			if !e.IsDir() && configFragmentExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+				files = append(files, filepath.Join(include, e.Name()))
+			}
+		}
+		return files, nil
+	}
+	files, err := filepath.Glob(include)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Include pattern '%v': %v", include, err)
+	}
+	if len(files) == 0 && !strings.ContainsAny(include, "*?[") {
+		return nil, fmt.Errorf("Include file '%v' not found", include)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (c *Config) loadFragment(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	frag := configFragment{}
+	if err := decodeConfig(data, configFormatOf(filename), &frag); err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+	if err := c.interpolate(&frag); err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+	for name, target := range frag.Targets {
+		if err := c.claim("Target "+name, filename); err != nil {
+			return err
+		}
+		c.Targets[name] = target
+	}
+	for match, replace := range frag.Routes {
+		if err := c.claim("Route "+match, filename); err != nil {
+			return err
+		}
+		c.Routes[match] = replace
+	}
+	return nil
+}
+
+func (c *Config) claim(key, filename string) error {
+	if existing, ok := c.sources[key]; ok {
+		return fmt.Errorf("%v in '%v' is already defined in '%v'", key, filename, existing)
+	}
+	c.sources[key] = filename
+	return nil
+}
+
+// EffectiveConfig returns the merged configuration, after all includes have been loaded, as indented JSON.
+// This is intended for debugging, so secrets are redacted.
+func (c *Config) EffectiveConfig() string {
+	merged := c.redactedCopy()
+	merged.Include = nil
+	b, err := json.MarshalIndent(merged, "", "\t")
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
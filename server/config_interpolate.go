@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Config fields whose values are always redacted from debug output, no matter where they came from.
+// A name with dots is the full path of one field. A name without dots matches every field of that name.
+var secretConfigFields = map[string]bool{
+	"Password":            true,
+	"ClientSecret":        true, // OAuth2 pass-through Options
+	"RefreshToken":        true, // OAuth2 pass-through Options
+	"AssertionKey":        true, // Delegated pass-through Options
+	"SecretAccessKey":     true, // SigV4 pass-through Options
+	"SessionToken":        true, // SigV4 pass-through Options
+	"Auth.TokenStore.Key": true,
+	"Secret":              true, // Auth.IdentityJWT, and the Signing of targets
+}
+
+const redacted = "******"
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Replace ${NAME}, ${env:NAME} and ${file:/path/to/secret} references in every string of v, which is a
+// pointer to a Config or a configFragment. The values of any secrets that were read are recorded in c.
+//
+//	${NAME}                   Value of environment variable NAME, except in Routes and Audit rules.
+//	${env:NAME}               Value of environment variable NAME. It is an error if NAME is not set.
+//	${env:NAME:-default}      Value of NAME, or "default" if NAME is not set or is empty.
+//	${file:/run/secrets/x}    Contents of the file, with trailing whitespace removed. Treated as a secret.
+//	${file:/path:-default}    Contents of the file, or "default" if the file does not exist.
+//	$${                       A literal "${".
+//
+// In Routes and Audit rules, ${id} is a named capture group, so environment variables need the env: prefix
+// there. Anything else inside ${} is left alone, so that regex replacements such as ${1}, and the
+// variables of Audit templates such as ${request.url}, keep working.
+func (c *Config) interpolate(v interface{}) error {
+	return rewriteConfigStrings(reflect.ValueOf(v).Elem(), "", func(path, s string) (string, error) {
+		out, secrets, err := interpolateString(s, !hasCaptureGroups(path))
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", path, err)
+		}
+		c.secrets = append(c.secrets, secrets...)
+		return out, nil
+	})
+}
+
+// Returns true if the config field at path may refer to the named capture groups of a regex as ${name}
+func hasCaptureGroups(path string) bool {
+	return strings.HasPrefix(path, "Routes.") || strings.Contains("."+path+".", ".Audit.")
+}
+
+// Returns the interpolated string, and the values of any secrets that were substituted into it.
+// If bareNames is true, then ${NAME} is an environment variable, like ${env:NAME}.
+func interpolateString(s string, bareNames bool) (string, []string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil, nil
+	}
+	out := strings.Builder{}
+	secrets := []string{}
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			out.WriteString(s)
+			break
+		}
+		if start > 0 && s[start-1] == '$' {
+			// $${ is an escaped ${
+			out.WriteString(s[:start-1])
+			out.WriteString("${")
+			s = s[start+2:]
+			continue
+		}
+		end := strings.Index(s[start:], "}")
+		if end == -1 {
+			out.WriteString(s)
+			break
+		}
+		end += start
+		out.WriteString(s[:start])
+		expr := s[start+2 : end]
+		value, isSecret, ok, err := resolveReference(expr, bareNames)
+		if err != nil {
+			return "", nil, err
+		}
+		if !ok {
+			// Not one of ours. Leave it intact.
+			value = s[start : end+1]
+		}
+		if isSecret && value != "" {
+			secrets = append(secrets, value)
+		}
+		out.WriteString(value)
+		s = s[end+1:]
+	}
+	return out.String(), secrets, nil
+}
+
+// Resolve the expression inside ${}. ok is false if the expression is not an env var or file reference.
+func resolveReference(expr string, bareNames bool) (value string, isSecret, ok bool, err error) {
+	name, def, hasDefault := strings.Cut(expr, ":-")
+	switch {
+	case strings.HasPrefix(name, "file:"):
+		filename := name[len("file:"):]
+		raw, err := os.ReadFile(filename)
+		if err != nil {
+			if hasDefault && os.IsNotExist(err) {
+				return def, false, true, nil
+			}
+			return "", false, false, fmt.Errorf("Unable to read secret file '%v': %v", filename, err)
+		}
+		return strings.TrimRight(string(raw), " \t\r\n"), true, true, nil
+	case strings.HasPrefix(name, "env:"):
+		name = name[len("env:"):]
+		if !envVarName.MatchString(name) {
+			return "", false, false, fmt.Errorf("Invalid environment variable name '%v'", name)
+		}
+	default:
+		if !bareNames || !envVarName.MatchString(name) {
+			return "", false, false, nil
+		}
+	}
+	value, exists := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return def, false, true, nil
+	}
+	if !exists {
+		return "", false, false, fmt.Errorf("Environment variable %v is not set", name)
+	}
+	return value, false, true, nil
+}
+
+// Call fn for every string in the config value v, and replace the string with fn's result.
+// path is a dotted description of where the string lives, such as "Targets.MAPS.URL".
+func rewriteConfigStrings(v reflect.Value, path string, fn func(path, s string) (string, error)) error {
+	join := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, err := fn(path, v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return rewriteConfigStrings(v.Elem(), path, fn)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		// The value inside an interface is not settable, so we modify a copy of it, and put that back
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := rewriteConfigStrings(elem, path, fn); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			if err := rewriteConfigStrings(v.Field(i), join(t.Field(i).Name), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := rewriteConfigStrings(v.Index(i), fmt.Sprintf("%v[%v]", path, i), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// Map values are not settable either, so the same copy dance as for interfaces
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := rewriteConfigStrings(elem, join(fmt.Sprint(key.Interface())), fn); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the config with all secrets replaced by asterisks.
+// A secret is any field listed in secretConfigFields, anything that was read via ${file:...},
+// and the password portion of any URL.
+func (c *Config) redactedCopy() *Config {
+	cp := &Config{}
+	raw, _ := json.Marshal(c)
+	json.Unmarshal(raw, cp)
+	rewriteConfigStrings(reflect.ValueOf(cp).Elem(), "", func(path, s string) (string, error) {
+		if s == "" {
+			return s, nil
+		}
+		field := path[strings.LastIndex(path, ".")+1:]
+		if secretConfigFields[field] || secretConfigFields[path] {
+			return redacted, nil
+		}
+		for _, secret := range c.secrets {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				s = strings.Replace(u.String(), url.QueryEscape(redacted), redacted, 1)
+			}
+		}
+		return s, nil
+	})
+	return cp
+}
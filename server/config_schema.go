@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Returns the schema for a field that reflection alone can't describe, or nil
+func schemaOverride(structName, fieldName string) map[string]interface{} {
+	switch structName + "." + fieldName {
+	case "Config.Targets":
+		s := schemaOf(reflect.TypeOf(map[string]ConfigTarget{}))
+		s["propertyNames"] = map[string]interface{}{"pattern": "^[^a-z]*$"} // Target names must be upper case
+		return s
+	case "ConfigPassThroughAuth.Type":
+		types := []interface{}{string(AuthPassThroughNone)}
+		for _, t := range passThroughTypes() {
+			types = append(types, t)
+		}
+		return map[string]interface{}{"type": "string", "enum": types}
+	case "ConfigClientCerts.Mode":
+		return map[string]interface{}{"type": "string", "enum": []interface{}{string(ClientCertNone), string(ClientCertOptional), string(ClientCertRequire)}}
+	case "ConfigForwardIdentity.Mode":
+		return map[string]interface{}{"type": "string", "enum": []interface{}{string(ForwardIdentityNone), string(ForwardIdentityHeaders), string(ForwardIdentityJWT)}}
+	case "ConfigAudit.Unmatched":
+		return map[string]interface{}{"type": "string", "enum": []interface{}{"", AuditUnmatchedAllow, AuditUnmatchedDeny}}
+	case "ConfigOwner.Field":
+		return map[string]interface{}{"type": "string", "enum": []interface{}{"", OwnerFieldUserID, OwnerFieldUsername, OwnerFieldEmail, OwnerFieldTenant}}
+	case "Config.Routes":
+		return map[string]interface{}{
+			"type":          "object",
+			"propertyNames": map[string]interface{}{"pattern": "^/"},
+			"additionalProperties": map[string]interface{}{
+				"oneOf": []interface{}{
+					map[string]interface{}{"type": "string"},
+					schemaOf(reflect.TypeOf(ConfigRoute{})),
+				},
+			},
+		}
+	}
+	return nil
+}
+
+// ConfigJSONSchema returns a JSON Schema that describes the router config file.
+// It is produced by reflection over Config, so it can never drift from what the router will actually accept.
+func ConfigJSONSchema() []byte {
+	s := schemaOf(reflect.TypeOf(Config{}))
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "IMQS Router configuration"
+	b, _ := json.MarshalIndent(s, "", "\t")
+	return append(b, '\n')
+}
+
+func schemaOf(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			if override := schemaOverride(t.Name(), f.Name); override != nil {
+				props[name] = override
+			} else {
+				props[name] = schemaOf(f.Type)
+			}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaOf(t.Elem()),
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaOf(t.Elem()),
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s := map[string]interface{}{"type": "integer", "minimum": 0}
+		if t.Bits() < 64 {
+			s["maximum"] = uint64(1)<<t.Bits() - 1
+		}
+		return s
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	// interface{}, or anything else we can't describe
+	return map[string]interface{}{}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	serviceconfig "github.com/IMQS/serviceconfigsgo"
+)
+
+// ConfigServiceType chooses where the router publishes its address, and fetches its certificates from
+type ConfigServiceType string
+
+const (
+	ConfigServiceIMQS ConfigServiceType = ""     // The IMQS config service. This is the default.
+	ConfigServiceNone ConfigServiceType = "None" // No config service. The router runs stand-alone.
+	ConfigServiceFile ConfigServiceType = "File" // Files are read from a local directory, instead of from the config service
+)
+
+// configService is the router's link to the IMQS config service.
+// This is an interface so that the router can run stand-alone, or inside unit tests,
+// without a live config service.
+type configService interface {
+	// Publish a system variable, such as our hostname, so that other services can find us
+	addSystemVariable(name, value string) error
+	// Fetch a file, such as a TLS certificate. Returns nil, nil if the service has no files to offer.
+	fetchFile(name string) ([]byte, error)
+}
+
+func newConfigService(c *ConfigConfigService) (configService, error) {
+	switch c.Type {
+	case ConfigServiceIMQS:
+		return imqsConfigService{}, nil
+	case ConfigServiceNone:
+		return noConfigService{}, nil
+	case ConfigServiceFile:
+		if c.Directory == "" {
+			return nil, fmt.Errorf("ConfigService type %v needs a Directory", c.Type)
+		}
+		return &fileConfigService{dir: c.Directory}, nil
+	}
+	return nil, fmt.Errorf("Unknown ConfigService type '%v'", c.Type)
+}
+
+type imqsConfigService struct{}
+
+func (imqsConfigService) addSystemVariable(name, value string) error {
+	return serviceconfig.AddSystemVariableToConfigService(name, value)
+}
+
+// Certificates are only distributed by the config service when we're running inside a container
+func (imqsConfigService) fetchFile(name string) ([]byte, error) {
+	if !serviceconfig.IsContainer() {
+		return nil, nil
+	}
+	return serviceconfig.GetConfigJson("", serviceName, serviceConfigVersion, name, false)
+}
+
+type noConfigService struct{}
+
+func (noConfigService) addSystemVariable(name, value string) error {
+	return nil
+}
+
+func (noConfigService) fetchFile(name string) ([]byte, error) {
+	return nil, nil
+}
+
+// fileConfigService stands in for the config service with a plain directory
+type fileConfigService struct {
+	dir string
+}
+
+func (f *fileConfigService) addSystemVariable(name, value string) error {
+	return nil
+}
+
+func (f *fileConfigService) fetchFile(name string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(f.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// These tests exercise config loading. They do not launch a live router.
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func loadConfigFile(t *testing.T, name, content string) *Config {
+	cfg := &Config{}
+	if err := cfg.LoadFile(writeConfigFile(t, name, content)); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func badConfigFile(t *testing.T, name, content, expectErr string) {
+	cfg := &Config{}
+	err := cfg.LoadFile(writeConfigFile(t, name, content))
+	if err == nil {
+		t.Fatalf("Expected %v to fail with '%v', but it succeeded", name, expectErr)
+	}
+	if !strings.Contains(err.Error(), expectErr) {
+		t.Fatalf("Expected %v to fail with '%v', but actually failed with '%v'", name, expectErr, err)
+	}
+}
+
+func verifyFormatsConfig(t *testing.T, cfg *Config) {
+	if cfg.HTTP.Port != 5002 {
+		t.Errorf("Expected HTTP.Port 5002, but got %v", cfg.HTTP.Port)
+	}
+	if cfg.Targets["MAPS"].URL != "http://127.0.0.1:2000" || !cfg.Targets["MAPS"].UseProxy {
+		t.Errorf("Target MAPS not decoded correctly: %+v", cfg.Targets["MAPS"])
+	}
+	rs, err := newUrlTranslator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRoute(t, rs.(*routeSet), "/tile/1/2/3", "http://127.0.0.1:2000/tile/1/2/3")
+	verifyRoute(t, rs.(*routeSet), "/extile/good1/abc", "http://good1/abc")
+	verifyRoute(t, rs.(*routeSet), "/extile/bad/abc", "")
+}
+
+func TestConfigFormats(t *testing.T) {
+	verifyFormatsConfig(t, loadConfigFile(t, "router.json", `{
+		"HTTP": {"Port": 5002},
+		"Targets": {"MAPS": {"URL": "http://127.0.0.1:2000", "UseProxy": true}},
+		"Routes": {
+			"/tile/(.*)": "{MAPS}/tile/$1",
+			"/extile/(.*)": {"Target": "http://$1", "ValidHosts": ["good1"]}
+		}
+	}`))
+
+	verifyFormatsConfig(t, loadConfigFile(t, "router.yaml", `
+HTTP:
+  Port: 5002           # comments are the reason for YAML support
+Targets:
+  MAPS:
+    URL: http://127.0.0.1:2000
+    UseProxy: true
+Routes:
+  /tile/(.*): "{MAPS}/tile/$1"
+  /extile/(.*):
+    Target: http://$1
+    ValidHosts: [good1]
+`))
+
+	verifyFormatsConfig(t, loadConfigFile(t, "router.toml", `
+[HTTP]
+Port = 5002
+
+[Targets.MAPS]
+URL = "http://127.0.0.1:2000"
+UseProxy = true
+
+[Routes]
+"/tile/(.*)" = "{MAPS}/tile/$1"
+
+[Routes."/extile/(.*)"]
+Target = "http://$1"
+ValidHosts = ["good1"]
+`))
+}
+
+func TestConfigErrorLines(t *testing.T) {
+	badConfigFile(t, "router.json", "{\n\t\"HTTP\": {\n\t\t\"Port\": \"abc\"\n\t}\n}", "line 3:")
+	badConfigFile(t, "router.json", "{\n\t\"HTTP\": {\n\t\t\"Port\": 80,\n\t}\n}", "line 4:")
+	badConfigFile(t, "router.yaml", "HTTP:\n  Port: 80\n  EnableHTTPS: maybe\n", "line 3: cannot use \"maybe\" as bool")
+	badConfigFile(t, "router.yaml", "Targets:\n  MAPS: [1, 2]\n", "line 2: cannot use list as server.ConfigTarget")
+	badConfigFile(t, "router.toml", "[HTTP]\nPort = 80\nEnableHTTPS = \"yes\"\n", "line 3")
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.WriteFile(filepath.Join(dir, "conf.d", "maps.json"), []byte(`{
+		"Targets": {"MAPS": {"URL": "http://127.0.0.1:2000"}},
+		"Routes": {"/tile/(.*)": "{MAPS}/tile/$1"}
+	}`), 0644)
+	os.WriteFile(filepath.Join(dir, "conf.d", "docs.yaml"), []byte("Routes:\n  /docs/(.*): http://127.0.0.1:2001/$1\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "conf.d", "ignored.txt"), []byte("not a config file"), 0644)
+	os.WriteFile(filepath.Join(dir, "router.json"), []byte(`{
+		"Include": ["conf.d"],
+		"Routes": {"/(.*)": "http://127.0.0.1/www/$1"}
+	}`), 0644)
+
+	cfg := &Config{}
+	if err := cfg.LoadFile(filepath.Join(dir, "router.json")); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := newUrlTranslator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRoute(t, rs.(*routeSet), "/tile/1", "http://127.0.0.1:2000/tile/1")
+	verifyRoute(t, rs.(*routeSet), "/docs/a", "http://127.0.0.1:2001/a")
+	verifyRoute(t, rs.(*routeSet), "/x", "http://127.0.0.1/www/x")
+	if !strings.Contains(cfg.EffectiveConfig(), `"/docs/(.*)": "http://127.0.0.1:2001/$1"`) {
+		t.Errorf("Effective config is missing the included route:\n%v", cfg.EffectiveConfig())
+	}
+
+	// Duplicate route across fragments
+	os.WriteFile(filepath.Join(dir, "conf.d", "more.json"), []byte(`{"Routes": {"/docs/(.*)": "http://127.0.0.1:2002/$1"}}`), 0644)
+	err = cfg.LoadFile(filepath.Join(dir, "router.json"))
+	expect := "Route /docs/(.*) in '" + filepath.Join(dir, "conf.d", "more.json") + "' is already defined in '" + filepath.Join(dir, "conf.d", "docs.yaml") + "'"
+	if err == nil || err.Error() != expect {
+		t.Fatalf("Expected duplicate error '%v', but got '%v'", expect, err)
+	}
+
+	badConfigFile(t, "router.json", `{"Include": ["missing.json"]}`, "missing.json' not found")
+}
+
+func TestConfigInterpolation(t *testing.T) {
+	secretFile := writeConfigFile(t, "secret.txt", "hunter2\n")
+	os.Setenv("ROUTER_TEST_HOST", "127.0.0.1")
+	os.Setenv("ROUTER_TEST_TOKEN", "abc123")
+	defer os.Unsetenv("ROUTER_TEST_HOST")
+	defer os.Unsetenv("ROUTER_TEST_TOKEN")
+
+	cfg := loadConfigFile(t, "router.json", `{
+		"Proxy": "http://proxyuser:${file:`+secretFile+`}@${env:ROUTER_TEST_HOST}:3128",
+		"Auth": {"TokenStore": {"File": "tokens.dat", "Key": "store-secret"}},
+		"Targets": {
+			"THIRDPARTY": {
+				"URL": "http://${env:ROUTER_TEST_HOST}:${env:ROUTER_TEST_PORT:-2000}",
+				"RateLimit": {"Rate": 1, "Key": "Header:X-Tenant"},
+				"Audit": {"Rules": [{"Path": "/(?P<ROUTER_TEST_HOST>\\w+)", "DidWhat": "${ROUTER_TEST_HOST} at ${env:ROUTER_TEST_HOST}"}]},
+				"PassThroughAuth": {
+					"Type": "SitePro",
+					"Username": "${ROUTER_TEST_TOKEN}",
+					"Password": "${file:`+secretFile+`}"
+				}
+			}
+		},
+		"Routes": {
+			"/3rdparty/(.*)": "{THIRDPARTY}/$${literal}/${1}",
+			"/named/(?P<id>\\d+)": "{THIRDPARTY}/y/${id}/${ROUTER_TEST_HOST}",
+			"/env/(.*)": "{THIRDPARTY}/${env:ROUTER_TEST_TOKEN}/$1"
+		}
+	}`)
+	third := cfg.Targets["THIRDPARTY"]
+	if third.URL != "http://127.0.0.1:2000" {
+		t.Errorf("Target URL not interpolated: %v", third.URL)
+	}
+	if third.PassThroughAuth.Username != "abc123" || third.PassThroughAuth.Password != "hunter2" {
+		t.Errorf("PassThroughAuth not interpolated: %+v", third.PassThroughAuth)
+	}
+	if cfg.Routes["/3rdparty/(.*)"] != "{THIRDPARTY}/${literal}/${1}" {
+		t.Errorf("Route replacement should not have been interpolated: %v", cfg.Routes["/3rdparty/(.*)"])
+	}
+	// Named groups are not environment variables, even when a variable of that name exists
+	if cfg.Routes["/named/(?P<id>\\d+)"] != "{THIRDPARTY}/y/${id}/${ROUTER_TEST_HOST}" {
+		t.Errorf("Named group replacement should not have been interpolated: %v", cfg.Routes["/named/(?P<id>\\d+)"])
+	}
+	if cfg.Routes["/env/(.*)"] != "{THIRDPARTY}/abc123/$1" {
+		t.Errorf("env: reference in route not interpolated: %v", cfg.Routes["/env/(.*)"])
+	}
+	if rule := third.Audit.Rules[0]; rule.DidWhat != "${ROUTER_TEST_HOST} at 127.0.0.1" {
+		t.Errorf("Audit template interpolated wrongly: %v", rule.DidWhat)
+	}
+
+	effective := cfg.EffectiveConfig()
+	if strings.Contains(effective, "hunter2") {
+		t.Errorf("Secret leaked into effective config:\n%v", effective)
+	}
+	if strings.Contains(effective, "store-secret") {
+		t.Errorf("Token store key leaked into effective config:\n%v", effective)
+	}
+	if !strings.Contains(effective, `"Username": "abc123"`) || !strings.Contains(effective, `"Key": "Header:X-Tenant"`) {
+		t.Errorf("Non-secret value was redacted from effective config:\n%v", effective)
+	}
+
+	badConfigFile(t, "router.json", `{"Proxy": "${env:ROUTER_TEST_NOT_SET}"}`, "Proxy: Environment variable ROUTER_TEST_NOT_SET is not set")
+	badConfigFile(t, "router.json", `{"Proxy": "${ROUTER_TEST_NOT_SET}"}`, "Proxy: Environment variable ROUTER_TEST_NOT_SET is not set")
+	badConfigFile(t, "router.json", `{"Proxy": "${env:not a name}"}`, "Proxy: Invalid environment variable name 'not a name'")
+	badConfigFile(t, "router.json", `{"Proxy": "${file:/does/not/exist}"}`, "Proxy: Unable to read secret file '/does/not/exist'")
+}
+
+func TestConfigUnknownFields(t *testing.T) {
+	badConfigFile(t, "router.json", "{\n\t\"Targets\": {\n\t\t\"MAPS\": {\n\t\t\t\"URL\": \"http://127.0.0.1:2000\",\n\t\t\t\"RequirePermision\": \"enabled\"\n\t\t}\n\t}\n}",
+		`line 5: json: unknown field "RequirePermision"`)
+	badConfigFile(t, "router.yaml", "Targets:\n  MAPS:\n    URL: http://127.0.0.1:2000\n    RequirePermision: enabled\n",
+		`line 4: unknown field "RequirePermision" in server.ConfigTarget`)
+	badConfigFile(t, "router.toml", "[Targets.MAPS]\nURL = \"http://127.0.0.1:2000\"\nRequirePermision = \"enabled\"\n",
+		`unknown field "Targets.MAPS.RequirePermision"`)
+	badConfigFile(t, "router.json", `{"Routes": {"/extile/(.*)": {"Target": "http://$1", "ValidHost": ["good1"]}}}`,
+		"Route /extile/(.*) has unknown field 'ValidHost'")
+
+	// The $schema key is allowed, so that editors can find the schema
+	loadConfigFile(t, "router.json", `{"$schema": "router-config.schema.json", "Routes": {"/(.*)": "http://127.0.0.1/$1"}}`)
+}
+
+func TestConfigSchemaUpToDate(t *testing.T) {
+	published, err := os.ReadFile("../docs/router-config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(published) != string(ConfigJSONSchema()) {
+		t.Fatalf("docs/router-config.schema.json is out of date. Regenerate it with 'router -config-schema'")
+	}
+}
@@ -11,6 +11,10 @@ import (
 func printHeader(h http.Header) {
 	for k, vv := range h {
 		for _, v := range vv {
+			if k == "Authorization" || k == "Cookie" {
+				// These may hold credentials that were injected by pass-through authentication
+				v = redacted
+			}
 			fmt.Printf("\t%s:%s\n", k, v)
 		}
 	}
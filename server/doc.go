@@ -30,30 +30,142 @@ for specific IMQS users, via Authaus permission bits.
 The router automatically logs in to the backend authentication service, and stores the
 session tokens in RAM. Future requests to that same backend automatically get the
 session token added into the HTTP headers before forwarding the request.
+A token that is shared by all users (PureHub, OAuth2) is renewed in the background when three
+quarters of its lifetime has passed, so requests keep flowing with the old token while the
+new one is fetched. Failed renewals are retried with jittered exponential backoff. The state
+of each target's token is reported on /router/status.
+
+Tokens live in RAM, so a restart means a fresh login to every backend, and some partners
+rate-limit their logins. Auth.TokenStore saves the tokens to a file, encrypted with AES-256-GCM,
+and the router restores the ones that are still valid when it starts. Each target's tokens are
+tagged with a hash of its config, so that changing a target's URL or credentials discards them.
+
+Each PassThroughAuth Type is a provider (see passThroughProvider), which registers itself
+from an init() function in its own file. A new partner integration is a new provider, and
+needs no changes to the rest of the router.
+
+Not every backend has a login. Header adds fixed headers, such as an X-Api-Key, to every request.
+SigV4 signs every request with AWS Signature Version 4, for S3-compatible stores and other APIs
+that use it. A signature has to cover the request as it is sent, so SigV4 implements
+passThroughOutgoing, which sees the request after its URL has been translated, including requests
+for server-sent events. X-Amz-* headers from the client are removed before signing, unless the
+provider's ForwardHeaders allows them, so that a client can't have us sign an X-Amz-Acl of its choosing.
+
+API Keys
+
+Partner systems that call us without an IMQS session can be given an API key. Auth.APIKeys points
+to a file of hashed keys, each with a name, the routes that it may call, an optional expiry, and
+optional IP restrictions. Targets and routes opt in with AllowAPIKeys. The key is removed from the
+request, and the backend receives the name of the key instead. The file is reloaded when it changes.
+
+Basic Auth
+
+Internal tools, such as dashboards and CouchDB Fauxton, can be protected without imqsauth, by giving
+their target or route a BasicAuth section that points to an htpasswd file. Passwords may be hashed
+with bcrypt, SHA or apr1. An IP address that fails too often is locked out for a minute. The
+Authorization header is removed before the request is forwarded, unless ForwardAuthorization is set.
+
+Client Certificates
+
+Field devices and partner servers may authenticate with client certificates. HTTP.ClientCerts makes
+the HTTPS listener verify them against a CA bundle, either when offered, or on every connection.
+Auth.ClientCertRules maps a verified certificate, by subject, SAN or fingerprint, to the routes that
+it may use, or to synthetic permissions that satisfy a target's RequirePermission. The details of a
+verified certificate are forwarded in X-Client-Cert-* headers, which clients may not set themselves.
+
+Blocking Requests
+
+The Blocklist section refuses requests before they are routed, by IP address (CIDR, IPv4 or IPv6),
+Host, User-Agent or path. Its File is reloaded when it changes. Targets and routes may have their own
+AllowIPs and DenyIPs. Blocked requests are counted on /router/status, and the log gets at most one
+message every ten seconds, so that a flood of bad requests doesn't drown it. Unless the config says
+otherwise, requests to the host yahoo.mail.com are refused with 418, as the router has always done.
+
+Rate Limits
+
+Targets and routes may have a RateLimit, which is a token bucket for each client. A client is
+identified by its IP address, its IMQS user, its API key, or a header, and falls back to its IP
+address when the request has none of these. A route's limit applies on top of its target's.
+Rejected requests get 429, with Retry-After. The buckets are kept in memory, and the least recently
+used ones are dropped when there are too many.
+
+A client's IP address is the address of its connection, unless that is one of HTTP.TrustedProxies,
+in which case it comes from X-Forwarded-For. Rate limits, IP lists, API key AllowedIPs and Basic auth
+lockouts all use this address. Behind a reverse proxy that isn't listed, every client has the
+proxy's address, so they share one rate limit bucket, and an IP list can't tell them apart.
+
+Concurrency Limits
+
+A target's Concurrency setting caps the number of HTTP requests that it handles at once. Requests
+beyond MaxInFlight wait in a FIFO queue of up to MaxQueue requests, for at most QueueTimeout seconds.
+A request that finds the queue full, or waits too long, gets 503. The queue depth and wait times of
+each target are on /router/status. Websocket and UDP routes are not limited.
+
+Permissions
+
+RequirePermission is an expression over permission names, with AND, OR, NOT and parentheses, such
+as "report OR admin". MethodPermissions gives the expressions for particular methods, such as
+{"GET": "read", "POST,DELETE": "admin"}, and HEAD follows GET unless it is listed. Routes may have
+both settings too. For a request, the route's rule for the method wins, then the route's
+RequirePermission, then the target's rule for the method, then the target's RequirePermission.
+A locally validated session is checked against its own permission list. Otherwise imqsauth is asked
+about each permission that the answer depends on, and those answers are cached like any other.
+An expression such as "NOT guest" still needs a valid session, even when the user has no permissions.
+
+Audit Logging
+
+Targets and routes may have Audit rules, which record requests in the imqsauth audit log. Each rule
+matches methods and a path regex, and builds "did what", "to what" and a JSON context from templates
+that use the path's capture groups, the request, and the user. Requests that match no rule are let
+through, or refused with 400 if Unmatched is "Deny". ECS targets without rules of their own get the
+rules that used to be hard-coded into the ECS pass-through.
+
+Ownership
+
+A target or route with an Owner rule belongs to individual users, such as a per-user database. The
+Path regex picks the owner out of the URL, and it must equal a field of the authenticated user: the
+user ID, username, email, or tenant. The tenant is a claim of a locally validated session (see
+Auth.SessionJWT.TenantClaim), because imqsauth doesn't report one. Requests from another user, with
+no user, or to paths that name no owner and aren't Exempt, get 403. CouchDB targets without a rule
+of their own get one that only lets users reach userdb-<their user id>.
+
+Request Signing
+
+A target with Signing receives HTTP requests that carry an HMAC-SHA256 signature, made with a secret
+that the router shares with the backend. The signature covers the method, the path that the client
+sent (X-Original-Path), the query, the chosen headers, a hash of the body, and the time, so that a
+backend can tell that a request really came through the router. Bodies are read into memory to be
+hashed, and bodies larger than MaxBodySize are refused with 413. Backends written in Go verify
+requests with the package github.com/IMQS/router/signing. Websocket connections are not signed.
+
+Forwarding Identity
+
+A target with ForwardIdentity receives the IMQS user that the router authenticated, so that it
+doesn't need to validate the session again. In "Headers" mode, the user ID, username, email and
+permissions are sent as X-IMQS-* headers. In "JWT" mode, they are sent as a short-lived token,
+signed with the key in Auth.IdentityJWT, whose audience is the target. Copies of these headers
+that come from the client are always removed. The permissions are those that the router verified,
+which is every permission of a locally validated session, but only the permissions that imqsauth
+granted when it made the decision.
 
 Stopping A Server
 
 The Go standard library does not make it possible to stop an HTTP server. At least, it is
 not possible to do so without creating your own Listener. BUT, if you create your own
-Listener, then you don't get HTTP/2 functionality. This is why we have no Stop() function.
-
-Known issues:
-
-The pass-through authentication does not handle the situation where the backend
-has cleared its store of session tokens. For example, if one was to login to
-Yellowfin (arbitrary example), and then Yellowfin gets restarted, and
-consequently forgets it's session tokens, the router would not realize that our
-own cached tokens are now invalid.
-To solve this, one would need to implement a check inside ServeHTTP(), which
-would monitor expected error responses such as 401, and then force the
-pass-through authentication system to discard it's cached information.
-I tried implementing this, assuming that Yellowfin would return a 401 upon
-receiving an unauthorized request. However, it does not do this. Instead, it
-sends back a login page. In order to detect this, one would need to perform deep
-inspection on the response body, which is something I'd rather not do unless it
-is absolutely necessary. So, we rely instead on expiring session tokens
-ourselves, and hope that Yellowfin is not restarted without the router also
-being restarted.
+Listener, then you don't get HTTP/2 functionality. This is why we have no Stop() function. Close()
+stops the background work of a server, such as renewing pass-through tokens, and saves the token
+store. The router calls it when its service is stopped, or when it is interrupted in the foreground.
+
+Backends That Forget Their Sessions
+
+When a backend is restarted, it may forget the session tokens that it handed out, and the
+router would carry on using its dead cached token. Yellowfin (arbitrary example) doesn't
+even return a 401 in this case. Instead, it sends back a login page. PassThroughAuth.InvalidateOn
+describes what a rejection looks like for a particular target: a status code, a response header,
+a redirect to a login page, or a pattern in the start of an HTML response body. When one of these
+triggers fires, the provider discards its token, and idempotent requests with small bodies are
+sent once more, with a fresh token. Other requests fail, but the next request gets a new token.
+Only HTTP requests are inspected. Websocket and SSE connections are not.
 
 */
 package server
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+// ForwardIdentityMode controls how a target learns who the user is
+type ForwardIdentityMode string
+
+const (
+	ForwardIdentityNone    ForwardIdentityMode = ""        // Nothing is forwarded. This is the default.
+	ForwardIdentityHeaders ForwardIdentityMode = "Headers" // X-IMQS-User-ID, X-IMQS-Username, X-IMQS-Email and X-IMQS-Permissions
+	ForwardIdentityJWT     ForwardIdentityMode = "JWT"     // A short-lived token, signed by the router (see Auth.IdentityJWT)
+)
+
+// Headers that carry the user's identity to the backend. Clients may not send these themselves.
+const (
+	identityHeaderUserID      = "X-IMQS-User-ID"
+	identityHeaderUsername    = "X-IMQS-Username"
+	identityHeaderEmail       = "X-IMQS-Email"
+	identityHeaderPermissions = "X-IMQS-Permissions" // Comma separated
+)
+
+const (
+	defaultIdentityJWTHeader   = "X-IMQS-Identity"
+	defaultIdentityJWTIssuer   = "imqs-router"
+	defaultIdentityJWTLifetime = 60 * time.Second
+)
+
+var identityHeaders = []string{
+	identityHeaderUserID,
+	identityHeaderUsername,
+	identityHeaderEmail,
+	identityHeaderPermissions,
+}
+
+// The user that the router has authenticated, and the permissions that it verified
+type identity struct {
+	token       *serviceauth.Token
+	permissions []string
+	tenant      string // Only known for sessions that are validated locally
+}
+
+// identitySigner issues the tokens of targets whose ForwardIdentity mode is JWT
+type identitySigner struct {
+	config ConfigIdentityJWT
+	alg    string
+	key    interface{} // []byte for HS256, otherwise crypto.Signer
+	now    func() time.Time
+}
+
+// Returns nil if Auth.IdentityJWT is not configured
+func newIdentitySigner(c *ConfigIdentityJWT) (*identitySigner, error) {
+	if c.KeyFile == "" && c.Secret == "" {
+		return nil, nil
+	}
+	if c.KeyFile != "" && c.Secret != "" {
+		return nil, fmt.Errorf("Auth.IdentityJWT may have a KeyFile or a Secret, but not both")
+	}
+	s := &identitySigner{
+		config: *c,
+		now:    time.Now,
+	}
+	if s.config.Header == "" {
+		s.config.Header = defaultIdentityJWTHeader
+	}
+	if s.config.Issuer == "" {
+		s.config.Issuer = defaultIdentityJWTIssuer
+	}
+	if s.config.Lifetime < 0 {
+		return nil, fmt.Errorf("Auth.IdentityJWT Lifetime may not be negative")
+	}
+	if c.Secret != "" {
+		if len(c.Secret) < 32 {
+			return nil, fmt.Errorf("Auth.IdentityJWT Secret must be at least 32 characters")
+		}
+		s.alg = "HS256"
+		s.key = []byte(c.Secret)
+		return s, nil
+	}
+	pem, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Auth.IdentityJWT KeyFile: %v", err)
+	}
+	signer, err := parseJWTPrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("Auth.IdentityJWT KeyFile %v: %v", c.KeyFile, err)
+	}
+	s.alg = jwtAlgorithmForKey(signer)
+	s.key = signer
+	return s, nil
+}
+
+func (s *identitySigner) lifetime() time.Duration {
+	if s.config.Lifetime == 0 {
+		return defaultIdentityJWTLifetime
+	}
+	return time.Duration(s.config.Lifetime) * time.Second
+}
+
+// Issue a token for id, which only audience should accept
+func (s *identitySigner) sign(id *identity, audience string) (string, error) {
+	now := s.now()
+	claims := jwtClaims{
+		"iss":         s.config.Issuer,
+		"aud":         audience,
+		"iat":         now.Unix(),
+		"exp":         now.Add(s.lifetime()).Unix(),
+		"username":    id.token.Username,
+		"email":       id.token.Email,
+		"permissions": id.permissions,
+	}
+	if id.token.UserID != 0 {
+		claims["sub"] = strconv.Itoa(id.token.UserID)
+	}
+	return signJWT(s.alg, s.config.KeyID, s.key, claims)
+}
+
+// Returns the permissions that were verified for a session, in a stable order
+func sortedPermissions(permissions map[string]bool) []string {
+	list := make([]string, 0, len(permissions))
+	for p, granted := range permissions {
+		if granted {
+			list = append(list, p)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Remove any identity that the client tried to send us, and add the identity that we have verified,
+// if the target wants it. id is nil when there is no IMQS user, such as for a public route, or a
+// request that was authorized by an API key, a client certificate, or another service.
+func (s *Server) forwardIdentity(w http.ResponseWriter, req *http.Request, t *target, id *identity) bool {
+	for _, h := range identityHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Del(defaultIdentityJWTHeader)
+	if s.idSigner != nil {
+		req.Header.Del(s.idSigner.config.Header)
+	}
+	if id == nil || id.token == nil {
+		return true
+	}
+	switch t.forwardIdentity.Mode {
+	case ForwardIdentityHeaders:
+		if id.token.UserID != 0 {
+			req.Header.Set(identityHeaderUserID, strconv.Itoa(id.token.UserID))
+		}
+		if id.token.Username != "" {
+			req.Header.Set(identityHeaderUsername, id.token.Username)
+		}
+		if id.token.Email != "" {
+			req.Header.Set(identityHeaderEmail, id.token.Email)
+		}
+		if len(id.permissions) != 0 {
+			req.Header.Set(identityHeaderPermissions, strings.Join(id.permissions, ","))
+		}
+	case ForwardIdentityJWT:
+		audience := t.forwardIdentity.Audience
+		if audience == "" {
+			audience = t.name
+		}
+		token, err := s.idSigner.sign(id, audience)
+		if err != nil {
+			s.errorLog.Errorf("Unable to sign identity token for %v: %v", t.name, err)
+			http.Error(w, "Unable to sign identity token", http.StatusInternalServerError)
+			return false
+		}
+		req.Header.Set(s.idSigner.config.Header, token)
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardIdentity(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"UserID":      r.Header.Get("X-IMQS-User-ID"),
+			"Username":    r.Header.Get("X-IMQS-Username"),
+			"Permissions": r.Header.Get("X-IMQS-Permissions"),
+			"Token":       r.Header.Get("X-IMQS-Identity"),
+		})
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	sessionKeyFile := filepath.Join(dir, "sessions.json")
+	_, sessionKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWKS(t, sessionKeyFile, map[string]crypto.PublicKey{"s1": sessionKey.Public()})
+
+	routerKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(routerKey)
+	routerKeyFile := filepath.Join(dir, "router.pem")
+	os.WriteFile(routerKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	s, c := newTestServer(t, `{
+		"Auth": {
+			"SessionJWT": {"KeyFile": "`+filepath.ToSlash(sessionKeyFile)+`"},
+			"IdentityJWT": {"KeyFile": "`+filepath.ToSlash(routerKeyFile)+`", "KeyID": "router-1"}
+		},
+		"Targets": {
+			"HEADERS": {"URL": "`+backend.URL+`", "RequirePermission": "enabled", "ForwardIdentity": {"Mode": "Headers"}},
+			"TOKEN": {"URL": "`+backend.URL+`", "RequirePermission": "enabled", "ForwardIdentity": {"Mode": "JWT", "Audience": "reports"}},
+			"PLAIN": {"URL": "`+backend.URL+`", "RequirePermission": "enabled"}
+		},
+		"Routes": {"/headers/(.*)": "{HEADERS}/$1", "/token/(.*)": "{TOKEN}/$1", "/plain/(.*)": "{PLAIN}/$1", "/public/(.*)": "`+backend.URL+`/$1"}}`)
+	var err error
+	if s.sessions, err = newSessionValidator(&c.Auth.SessionJWT); err != nil {
+		t.Fatal(err)
+	}
+	if s.idSigner, err = newIdentitySigner(&c.Auth.IdentityJWT); err != nil {
+		t.Fatal(err)
+	}
+
+	session := signTestJWT(t, "EdDSA", "s1", sessionKey, sessionClaims(map[string]interface{}{"uid": 7, "username": "jo", "permissions": "report enabled"}))
+	send := func(path string, withSession bool) map[string]string {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		if withSession {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		req.Header.Set("X-IMQS-User-ID", "1")
+		req.Header.Set("X-IMQS-Identity", "forged")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, but got %v %v", path, w.Code, w.Body.String())
+		}
+		got := map[string]string{}
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return got
+	}
+
+	got := send("/headers/x", true)
+	if got["UserID"] != "7" || got["Username"] != "jo" || got["Permissions"] != "enabled,report" || got["Token"] != "" {
+		t.Errorf("Unexpected identity headers %v", got)
+	}
+
+	got = send("/token/x", true)
+	if got["UserID"] != "" {
+		t.Errorf("Spoofed header was not removed: %v", got)
+	}
+	claims, err := verifyJWT(got["Token"], jwtKeys{"router-1": {routerKey.Public()}}, time.Now(), 0)
+	if err != nil {
+		t.Fatalf("Identity token did not verify: %v", err)
+	}
+	if claims.str("sub") != "7" || claims.str("aud") != "reports" || claims.str("iss") != "imqs-router" || strings.Join(claims.strings("permissions"), ",") != "enabled,report" {
+		t.Errorf("Unexpected identity claims %v", claims)
+	}
+	if exp, _ := claims.number("exp"); exp > time.Now().Add(61*time.Second).Unix() {
+		t.Errorf("Identity token lives too long")
+	}
+
+	// Targets that don't ask for the identity, and routes without a user, get nothing, but spoofed headers are still removed
+	for _, path := range []string{"/plain/x", "/public/x"} {
+		if got = send(path, path == "/plain/x"); got["UserID"] != "" || got["Token"] != "" {
+			t.Errorf("%v: expected no identity, but got %v", path, got)
+		}
+	}
+
+	c = &Config{}
+	c.LoadString(`{"Targets": {"X": {"URL": "http://a", "ForwardIdentity": {"Mode": "JWT"}}}}`)
+	if _, err := newUrlTranslator(c); err == nil || !strings.Contains(err.Error(), "needs Auth.IdentityJWT") {
+		t.Errorf("Expected JWT mode without a key to fail, but got %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// This is a minimal implementation of signed JSON Web Tokens (JWS compact serialization).
+// For verification, we only support the asymmetric algorithms that we expect from an identity provider,
+// which are RS256, ES256 and EdDSA (Ed25519). We sign with the same algorithms, for the identity tokens
+// that we send to backends, and also with HS256, for assertions that we send to partners who share a
+// secret with us.
+
+var errJWTUnknownKey = errors.New("No key matches the token's key ID")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type jwtClaims map[string]interface{}
+
+// A set of public keys, as loaded from a JWKS document or a PEM file.
+// Keys without an ID are stored under the empty string.
+type jwtKeys map[string][]crypto.PublicKey
+
+// Returns true if token has the shape of a JWS. This is a cheap check, which tells us whether to attempt
+// local validation at all.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// Verify the signature of token against keys, and return its claims.
+// The time-based claims (exp, nbf) are checked against now, with leeway to allow for clock skew.
+func verifyJWT(token string, keys jwtKeys, now time.Time, leeway time.Duration) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+	header := jwtHeader{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Malformed token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed token signature: %v", err)
+	}
+
+	candidates := keys[header.Kid]
+	if len(candidates) == 0 && header.Kid != "" {
+		// Keys from a PEM file have no ID, so they can verify any token
+		candidates = keys[""]
+	}
+	if len(candidates) == 0 {
+		return nil, errJWTUnknownKey
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range candidates {
+		if err = jwtVerifySignature(header.Alg, key, signed, signature); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, err
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Malformed token claims: %v", err)
+	}
+	if exp, ok := claims.number("exp"); ok && now.After(time.Unix(exp, 0).Add(leeway)) {
+		return nil, fmt.Errorf("Token has expired")
+	}
+	if nbf, ok := claims.number("nbf"); ok && now.Add(leeway).Before(time.Unix(nbf, 0)) {
+		return nil, fmt.Errorf("Token is not valid yet")
+	}
+	return claims, nil
+}
+
+// Produce a signed token. key is a []byte for HS256, and a private key (crypto.Signer) for the others.
+func signJWT(alg, kid string, key interface{}, claims jwtClaims) (string, error) {
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok || len(secret) == 0 {
+			return "", fmt.Errorf("HS256 needs a secret")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256", "ES256", "EdDSA":
+		signer, ok := key.(crypto.Signer)
+		if !ok || jwtAlgorithmForKey(signer) != alg {
+			return "", fmt.Errorf("Key type %T can't sign %v", key, alg)
+		}
+		if signature, err = jwtSign(signer, []byte(signed)); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("Unsupported token algorithm '%v'", alg)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Returns the algorithm that signs with key, or an empty string if we don't support the key
+func jwtAlgorithmForKey(key crypto.Signer) string {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return "RS256"
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P256() {
+			return "ES256"
+		}
+	case ed25519.PrivateKey:
+		return "EdDSA"
+	}
+	return ""
+}
+
+func jwtSign(key crypto.Signer, signed []byte) ([]byte, error) {
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		return ed25519.Sign(k, signed), nil
+	}
+	hash := sha256.Sum256(signed)
+	if k, ok := key.(*ecdsa.PrivateKey); ok {
+		// JWS uses the fixed-width r||s encoding, not ASN.1
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	}
+	return key.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+// Parse a PEM private key, in PKCS#8, PKCS#1 (RSA) or SEC 1 (EC) form
+func parseJWTPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block '%v'", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || jwtAlgorithmForKey(signer) == "" {
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func jwtVerifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	hash := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Key type %T can't verify %v", key, alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature); err != nil {
+			return fmt.Errorf("Invalid token signature")
+		}
+		return nil
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || k.Curve != elliptic.P256() {
+			return fmt.Errorf("Key type %T can't verify %v", key, alg)
+		}
+		// JWS uses the fixed-width r||s encoding, not ASN.1
+		if len(signature) != 64 {
+			return fmt.Errorf("Invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, hash[:], r, s) {
+			return fmt.Errorf("Invalid token signature")
+		}
+		return nil
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("Key type %T can't verify %v", key, alg)
+		}
+		if !ed25519.Verify(k, signed, signature) {
+			return fmt.Errorf("Invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported token algorithm '%v'", alg)
+}
+
+// Returns a numeric claim, such as "exp"
+func (c jwtClaims) number(name string) (int64, bool) {
+	switch v := c[name].(type) {
+	case float64:
+		return int64(v), true
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func (c jwtClaims) str(name string) string {
+	switch v := c[name].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprint(int64(v))
+	}
+	return ""
+}
+
+// Returns a claim that may be either a list of strings, or a single space-separated string (like OAuth "scope")
+func (c jwtClaims) strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		list := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// Parse a key set, which is either a JWKS document, or a PEM file that contains public keys and/or certificates
+func parseJWTKeys(data []byte) (jwtKeys, error) {
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		return parseJWKS(data)
+	}
+	keys := jwtKeys{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// PEM keys have no ID, so they're tried for any token that doesn't specify a kid
+		keys[""] = append(keys[""], key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No public keys found")
+	}
+	return keys, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(data []byte) (jwtKeys, error) {
+	doc := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	keys := jwtKeys{}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Key '%v': %v", k.Kid, err)
+		}
+		keys[k.Kid] = append(keys[k.Kid], key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No signing keys found")
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64(k.N)
+		e, err2 := b64(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 {
+			return nil, fmt.Errorf("Invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve '%v'", k.Crv)
+		}
+		x, err1 := b64(k.X)
+		y, err2 := b64(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("Invalid EC key")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("Unsupported curve '%v'", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("Unsupported key type '%v'", k.Kty)
+}
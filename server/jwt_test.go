@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, hash[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testJWK(kid string, pub crypto.PublicKey) map[string]interface{} {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]interface{}{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]interface{}{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]interface{}{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(k)}
+	}
+	return nil
+}
+
+func writeJWKS(t *testing.T, filename string, keys map[string]crypto.PublicKey) {
+	doc := map[string]interface{}{"keys": []interface{}{}}
+	for kid, pub := range keys {
+		doc["keys"] = append(doc["keys"].([]interface{}), testJWK(kid, pub))
+	}
+	b, _ := json.Marshal(doc)
+	if err := os.WriteFile(filename, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := jwtKeys{
+		"rsa": {&rsaKey.PublicKey},
+		"ec":  {&ecKey.PublicKey},
+		"ed":  {edKey.Public()},
+	}
+	now := time.Now()
+	claims := map[string]interface{}{"uid": 12, "exp": now.Add(time.Hour).Unix()}
+
+	for _, c := range []struct {
+		alg string
+		kid string
+		key crypto.Signer
+	}{{"RS256", "rsa", rsaKey}, {"ES256", "ec", ecKey}, {"EdDSA", "ed", edKey}} {
+		token := signTestJWT(t, c.alg, c.kid, c.key, claims)
+		if !looksLikeJWT(token) {
+			t.Errorf("%v token doesn't look like a JWT", c.alg)
+		}
+		got, err := verifyJWT(token, keys, now, 0)
+		if err != nil {
+			t.Errorf("%v: %v", c.alg, err)
+		} else if got.str("uid") != "12" {
+			t.Errorf("%v: uid claim is %v", c.alg, got.str("uid"))
+		}
+		// Our own signer must produce the same thing
+		if signed, err := signJWT(c.alg, c.kid, c.key, claims); err != nil {
+			t.Errorf("%v: %v", c.alg, err)
+		} else if _, err := verifyJWT(signed, keys, now, 0); err != nil {
+			t.Errorf("%v: signJWT produced a token that doesn't verify: %v", c.alg, err)
+		}
+		// Tamper with the payload
+		original := strings.Split(token, ".")
+		tampered := strings.Split(signTestJWT(t, c.alg, c.kid, c.key, map[string]interface{}{"uid": 13}), ".")
+		forged := original[0] + "." + tampered[1] + "." + original[2]
+		if _, err := verifyJWT(forged, keys, now, 0); err == nil {
+			t.Errorf("%v: forged token was accepted", c.alg)
+		}
+	}
+
+	// Algorithm confusion: an RSA key must not verify an EdDSA token
+	if _, err := verifyJWT(signTestJWT(t, "EdDSA", "rsa", edKey, claims), keys, now, 0); err == nil {
+		t.Errorf("Token with mismatched algorithm was accepted")
+	}
+	if _, err := verifyJWT(signTestJWT(t, "RS256", "rsa", rsaKey, claims), keys, now.Add(2*time.Hour), time.Minute); err == nil || err.Error() != "Token has expired" {
+		t.Errorf("Expected expired token to fail, but got %v", err)
+	}
+	if _, err := verifyJWT(signTestJWT(t, "RS256", "other", rsaKey, claims), keys, now, 0); err != errJWTUnknownKey {
+		t.Errorf("Expected unknown key error, but got %v", err)
+	}
+}
+
+func TestJWTKeysFromPEM(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	keys, err := parseJWTKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signTestJWT(t, "ES256", "any", ecKey, map[string]interface{}{"uid": 1})
+	if _, err := verifyJWT(token, keys, time.Now(), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Session tokens must expire, so this adds an expiry an hour from now, unless claims already has one
+func sessionClaims(claims map[string]interface{}) map[string]interface{} {
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	return claims
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWKS(t, keyFile, map[string]crypto.PublicKey{"old": oldKey.Public()})
+
+	v, err := newSessionValidator(&ConfigSessionJWT{KeyFile: keyFile, Issuer: "imqsauth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	claims := sessionClaims(map[string]interface{}{"iss": "imqsauth", "uid": "7", "username": "joe", "permissions": []string{"enabled", "admin"}})
+
+	session, err := v.validate(signTestJWT(t, "EdDSA", "old", oldKey, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.token.UserID != 7 || session.token.Username != "joe" || !session.permissions["admin"] {
+		t.Errorf("Session not decoded correctly: %+v %v", session.token, session.permissions)
+	}
+
+	// Rotate keys. The new key is not picked up immediately, because we've only just loaded the key set.
+	writeJWKS(t, keyFile, map[string]crypto.PublicKey{"old": oldKey.Public(), "new": newKey.Public()})
+	newToken := signTestJWT(t, "EdDSA", "new", newKey, claims)
+	if _, err := v.validate(newToken); err != errJWTUnknownKey {
+		t.Fatalf("Expected unknown key, but got %v", err)
+	}
+	now = now.Add(sessionKeyMinReload * time.Second)
+	if _, err := v.validate(newToken); err != nil {
+		t.Fatalf("New key was not loaded: %v", err)
+	}
+
+	claims["iss"] = "someone-else"
+	if _, err := v.validate(signTestJWT(t, "EdDSA", "new", newKey, claims)); err == nil {
+		t.Errorf("Token from an untrusted issuer was accepted")
+	}
+}
+
+func TestAuthorizeWithSessionJWT(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWKS(t, keyFile, map[string]crypto.PublicKey{"k1": key.Public()})
+	s := &Server{errorLog: log.New(log.Stdout, false)}
+	var err error
+	if s.sessions, err = newSessionValidator(&ConfigSessionJWT{KeyFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(token, permission string, expectCode int) {
+		req := httptest.NewRequest("GET", "/x", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: token})
+		w := httptest.NewRecorder()
+		required, _ := parsePermissionExpr(permission)
+		_, ok := s.authorize(w, req, required)
+		if ok != (expectCode == http.StatusOK) || (!ok && w.Code != expectCode) {
+			t.Errorf("Expected %v, but got ok=%v code=%v", expectCode, ok, w.Code)
+		}
+	}
+	valid := signTestJWT(t, "EdDSA", "k1", key, sessionClaims(map[string]interface{}{"uid": 1, "permissions": "enabled report"}))
+	expect(valid, "enabled", http.StatusOK)
+	expect(valid, "admin", http.StatusForbidden)
+	expired := signTestJWT(t, "EdDSA", "k1", key, map[string]interface{}{"uid": 1, "permissions": "enabled", "exp": 1})
+	expect(expired, "enabled", http.StatusUnauthorized)
+	forever := signTestJWT(t, "EdDSA", "k1", key, map[string]interface{}{"uid": 1, "permissions": "enabled"})
+	expect(forever, "enabled", http.StatusUnauthorized)
+}
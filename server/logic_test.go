@@ -45,7 +45,7 @@ func verifyRoute(t *testing.T, rs *routeSet, inUrl string, expectOutUrl string)
 	req := http.Request{}
 	req.RequestURI = inUrl
 	uri, _ := url.Parse(inUrl)
-	newUrl, _, _ := rs.processRoute(uri)
+	newUrl, _ := rs.processRoute(uri)
 	if newUrl != expectOutUrl {
 		t.Errorf("route match failed: '%v' -> '%v' (expected '%v')", inUrl, newUrl, expectOutUrl)
 	}
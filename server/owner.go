@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The fields of the user that an Owner rule can compare with the owner in the URL
+const (
+	OwnerFieldUserID   = "UserID" // This is the default
+	OwnerFieldUsername = "Username"
+	OwnerFieldEmail    = "Email"  // Compared without regard to case
+	OwnerFieldTenant   = "Tenant" // Only known for sessions that are validated locally (see Auth.SessionJWT)
+)
+
+// "{owner}" in an Owner Path is shorthand for a capture group that matches one path segment
+const ownerPlaceholder = "{owner}"
+
+// The Owner rule of CouchDB targets that don't have their own. Each user may only reach their own
+// database, which is named userdb-<user id>. This used to be hard-coded into the CouchDB pass-through provider.
+var couchDBOwnerDefaults = ConfigOwner{
+	Path:   ".*?userdb-{owner}(?:/.*)?",
+	Exempt: []string{"/userstorage/"},
+}
+
+// ownerRule restricts a route to the user that its URL belongs to, such as a per-user database
+type ownerRule struct {
+	path   *regexp.Regexp
+	group  int    // Capture group of path that holds the owner
+	field  string // One of the OwnerField constants
+	exempt []*regexp.Regexp
+}
+
+// Returns nil if c has no Path
+func newOwnerRule(c *ConfigOwner) (*ownerRule, error) {
+	if c.Path == "" {
+		if c.Field != "" || len(c.Exempt) != 0 {
+			return nil, fmt.Errorf("Owner Path is required")
+		}
+		return nil, nil
+	}
+	r := &ownerRule{field: c.Field}
+	switch r.field {
+	case "":
+		r.field = OwnerFieldUserID
+	case OwnerFieldUserID, OwnerFieldUsername, OwnerFieldEmail, OwnerFieldTenant:
+	default:
+		return nil, fmt.Errorf("Owner Field must be '%v', '%v', '%v' or '%v'", OwnerFieldUserID, OwnerFieldUsername, OwnerFieldEmail, OwnerFieldTenant)
+	}
+	var err error
+	path := strings.Replace(c.Path, ownerPlaceholder, "(?P<owner>[^/]+)", 1)
+	if r.path, err = regexp.Compile("^(?:" + path + ")$"); err != nil {
+		return nil, fmt.Errorf("Invalid Owner Path: %v", err)
+	}
+	if r.group = r.path.SubexpIndex("owner"); r.group < 0 {
+		if r.path.NumSubexp() == 0 {
+			return nil, fmt.Errorf("Owner Path needs a capture group, or %v", ownerPlaceholder)
+		}
+		r.group = 1
+	}
+	for _, e := range c.Exempt {
+		re, err := regexp.Compile("^(?:" + e + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Owner Exempt path: %v", err)
+		}
+		r.exempt = append(r.exempt, re)
+	}
+	return r, nil
+}
+
+// Returns true if the request may continue. Otherwise, a 403 has already been sent.
+// Requests to paths that don't name an owner, and aren't exempt, are refused, as are requests without a user.
+func (r *ownerRule) check(w http.ResponseWriter, req *http.Request, id *identity) bool {
+	for _, e := range r.exempt {
+		if e.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	if groups := r.path.FindStringSubmatch(req.URL.Path); groups != nil && r.isOwner(groups[r.group], id) {
+		return true
+	}
+	http.Error(w, "Only the owner may access this URL", http.StatusForbidden)
+	return false
+}
+
+func (r *ownerRule) isOwner(owner string, id *identity) bool {
+	if id == nil || id.token == nil || owner == "" {
+		return false
+	}
+	switch r.field {
+	case OwnerFieldUserID:
+		userID, err := strconv.Atoi(owner)
+		return err == nil && id.token.UserID != 0 && userID == id.token.UserID
+	case OwnerFieldUsername:
+		return owner == id.token.Username
+	case OwnerFieldEmail:
+		return strings.EqualFold(owner, id.token.Email)
+	default:
+		return owner == id.tenant
+	}
+}
+
+// Returns the owner rule of this route, or nil if it has none
+func (r *route) ownerRule() *ownerRule {
+	if r.owner != nil {
+		return r.owner
+	}
+	return r.target.owner
+}
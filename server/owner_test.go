@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IMQS/serviceauth"
+)
+
+func TestOwner(t *testing.T) {
+	backend := newOKBackend(t)
+
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWKS(t, keyFile, map[string]crypto.PublicKey{"k1": key.Public()})
+
+	s, c := newTestServer(t, `{
+		"Auth": {"SessionJWT": {"KeyFile": "`+filepath.ToSlash(keyFile)+`"}, "DecisionCache": {"TTL": 60, "NegativeTTL": 60}},
+		"Targets": {
+			"COUCH": {"URL": "`+backend.URL+`", "RequirePermission": "enabled", "PassThroughAuth": {"Type": "CouchDB", "Username": "u", "Password": "p"}},
+			"FILES": {"URL": "`+backend.URL+`", "RequirePermission": "enabled", "Owner": {"Path": "/files/{owner}/.*", "Field": "Username"}}
+		},
+		"Routes": {
+			"/userstorage/(.*)": "{COUCH}/$1",
+			"/files/(.*)": "{FILES}/$1",
+			"/tenants/(.*)": {"Target": "{FILES}/$1", "Owner": {"Path": "/tenants/(\\w+)(/.*)?", "Field": "Tenant", "Exempt": ["/tenants/"]}}
+		}}`)
+	var err error
+	if s.sessions, err = newSessionValidator(&c.Auth.SessionJWT); err != nil {
+		t.Fatal(err)
+	}
+	s.decisions = newDecisionCache(&c.Auth)
+
+	jo := signTestJWT(t, "EdDSA", "k1", key, sessionClaims(map[string]interface{}{"uid": 12, "username": "jo", "tenant": "acme", "permissions": "enabled"}))
+	// A session that only imqsauth understands, which knows nothing of tenants
+	s.decisions.put(sessionCacheKey(s.decisions, "opaque"), "enabled", http.StatusOK, "", &serviceauth.Token{UserID: 13, Username: "sam"})
+
+	expect := func(path, session string, code int) {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		if w.Code != code {
+			t.Errorf("%v: expected %v, but got %v %v", path, code, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	// The CouchDB defaults, which used to be hard-coded, and panicked on paths without a database
+	expect("/userstorage/userdb-12/doc", jo, 200)
+	expect("/userstorage/userdb-12", jo, 200)
+	expect("/userstorage/userdb-13/doc", jo, 403)
+	expect("/userstorage/userdb-13/doc", "opaque", 200)
+	expect("/userstorage/_all_dbs", jo, 403)
+	expect("/userstorage/", jo, 200)
+	expect("/userstorage/userdb-12/doc", "", 401)
+
+	expect("/files/jo/a.txt", jo, 200)
+	expect("/files/sam/a.txt", jo, 403)
+	expect("/files/sam/a.txt", "opaque", 200)
+
+	expect("/tenants/acme/a", jo, 200)
+	expect("/tenants/other/a", jo, 403)
+	expect("/tenants/", jo, 200)
+	expect("/tenants/acme/a", "opaque", 403)
+
+	expectTargetErrors(t, "Owner",
+		`{"Path": "/x/.*"}`,
+		`{"Path": "/x/(.*"}`,
+		`{"Path": "/x/{owner}", "Field": "Group"}`,
+		`{"Field": "Username"}`,
+		`{"Path": "/x/{owner}", "Exempt": ["("]}`,
+	)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/serviceauth"
+)
+
+// A passThroughProvider implements one Type of PassThroughAuth. Each target that uses pass-through
+// auth gets its own provider instance, which holds whatever state that target needs, such as a token
+// that is shared by all users of the target.
+// Providers register themselves with registerPassThrough, from an init() function in their own file.
+type passThroughProvider interface {
+	// Prepare req for the backend, typically by adding credentials to it. authData is nil if the
+	// target does not require a permission. Returns false if the request must not continue, in which
+	// case the provider must already have sent an error response to w.
+	inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool
+}
+
+// Providers whose credentials depend on the request exactly as it is sent to the backend, such as a
+// signature over its final URL, implement passThroughOutgoing. prepareOutgoing is called with the
+// translated request, just before it is sent, and follows the same rules as inject.
+type passThroughOutgoing interface {
+	prepareOutgoing(log *log.Logger, w http.ResponseWriter, outgoing *http.Request) bool
+}
+
+// Providers that keep a session per user implement sessionCounter, so that the number of sessions
+// can be reported on /router/status
+type sessionCounter interface {
+	sessionCount() int
+}
+
+// A passThroughFactory creates a provider from its config. Settings that are specific to the provider
+// live in config.Options, which the provider decodes with config.decodeOptions.
+type passThroughFactory func(config *ConfigPassThroughAuth) (passThroughProvider, error)
+
+var passThroughProviders = map[AuthPassThroughType]passThroughFactory{}
+
+func registerPassThrough(typ AuthPassThroughType, factory passThroughFactory) {
+	if _, exists := passThroughProviders[typ]; exists {
+		panic(fmt.Sprintf("PassThroughAuth type '%v' is registered twice", typ))
+	}
+	passThroughProviders[typ] = factory
+}
+
+// Returns the registered Type names, sorted
+func passThroughTypes() []string {
+	names := []string{}
+	for typ := range passThroughProviders {
+		names = append(names, string(typ))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns nil, nil if the config doesn't ask for pass-through auth
+func newPassThroughProvider(config *ConfigPassThroughAuth) (passThroughProvider, error) {
+	if config.Type == AuthPassThroughNone {
+		if len(config.Options) != 0 {
+			return nil, fmt.Errorf("PassThroughAuth has Options, but no Type")
+		}
+		return nil, nil
+	}
+	factory := passThroughProviders[config.Type]
+	if factory == nil {
+		return nil, fmt.Errorf("Unknown PassThroughAuth type '%v'. Must be one of %v", config.Type, passThroughTypes())
+	}
+	return factory(config)
+}
+
+// Decode Options into v, which is a pointer to a provider's own options struct.
+// Unknown fields are rejected, the same as everywhere else in the config.
+func (c *ConfigPassThroughAuth) decodeOptions(v interface{}) error {
+	if c.Options == nil {
+		return nil
+	}
+	raw, _ := json.Marshal(c.Options)
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("Invalid %v Options: %v", c.Type, err)
+	}
+	return nil
+}
+
+// Returns true if the request should continue to be passed through the router
+// If you return false, then you must already have sent an appropriate error response to 'w'.
+func authPassThrough(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token, target *targetPassThroughAuth) bool {
+	if target == nil || target.provider == nil {
+		return true
+	}
+	return target.provider.inject(log, w, req, authData)
+}
+
+// Returns true if the translated request may be sent to the backend
+func authPassThroughOutgoing(log *log.Logger, w http.ResponseWriter, outgoing *http.Request, target *targetPassThroughAuth) bool {
+	if target == nil {
+		return true
+	}
+	if p, ok := target.provider.(passThroughOutgoing); ok {
+		return p.prepareOutgoing(log, w, outgoing)
+	}
+	return true
+}
@@ -0,0 +1,454 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/serviceauth"
+)
+
+/*
+Delegated pass-through auth gives each IMQS user their own session with the backend. The first request
+from a user triggers a login call to LoginURL, which carries the user's identity, and the resulting
+session is cached for that user until it expires. Concurrent requests from one user share a single login.
+
+	"PassThroughAuth": {
+		"Type": "Delegated",
+		"LoginURL": "https://partner.example.com/api/session",
+		"Options": {
+			"Method": "POST",										Default POST
+			"ContentType": "application/json",						Default application/json
+			"Body": "{\"user\": {{json .Username}}, \"assertion\": {{json .Assertion}}}",
+			"Headers": {"X-Api-Key": "${env:PARTNER_KEY}"},				Extra headers on the login call. Values are templates too.
+			"AssertionKey": "${file:/run/secrets/partner-hmac}",	If set, .Assertion is an HS256 JWT about the user, signed with this secret
+			"AssertionIssuer": "imqs-router",
+			"AssertionAudience": "partner",
+			"AssertionLifetime": 60,								Seconds. Default 60
+			"TokenField": "session.id",								Dotted path to the session token in the JSON response. Default access_token
+			"TokenCookie": "",										Alternatively, take the token from this Set-Cookie
+			"ExpiresInField": "expires_in",							Dotted path to the session lifetime in seconds. Default expires_in
+			"SessionLifetime": 1800,								Seconds, if the response doesn't say. Default 1800
+			"InjectHeader": "Authorization",						Default Authorization
+			"InjectValue": "Bearer {{.Token}}",						Default "Bearer {{.Token}}"
+			"MaxSessions": 10000									Default 10000
+		}
+	}
+
+Body, Headers and InjectValue are Go text/template strings. The login templates see .UserID, .Username,
+.Email and .Assertion. Use {{json .X}} to produce a quoted JSON string, and {{urlquery .X}} for a form.
+The target must have a RequirePermission, otherwise we don't know who the user is.
+*/
+
+func init() {
+	registerPassThrough(AuthPassThroughDelegated, newDelegatedProvider)
+}
+
+const (
+	defaultDelegatedSessionLifetime   = 30 * 60 // seconds
+	defaultDelegatedAssertionLifetime = 60      // seconds
+	defaultDelegatedMaxSessions       = 10000
+	delegatedSessionExpiryMargin      = 30 // seconds
+	maxDelegatedResponseSize          = 1 << 20
+)
+
+type delegatedOptions struct {
+	Method            string
+	ContentType       string
+	Body              string
+	Headers           map[string]string
+	AssertionKey      string
+	AssertionIssuer   string
+	AssertionAudience string
+	AssertionLifetime int
+	TokenField        string
+	TokenCookie       string
+	ExpiresInField    string
+	SessionLifetime   int
+	InjectHeader      string
+	InjectValue       string
+	MaxSessions       int
+}
+
+// The data that the login templates see
+type delegatedLoginData struct {
+	UserID    int
+	Username  string
+	Email     string
+	Assertion string
+}
+
+// A user's session with the backend. While the login is in flight, ready is open, and other
+// requests from the same user wait on it. header, expires and err may only be read after ready is closed.
+type delegatedSession struct {
+	ready   chan struct{}
+	header  string // The value that we inject
+	expires time.Time
+	err     error
+}
+
+type delegatedProvider struct {
+	config  ConfigPassThroughAuth
+	options delegatedOptions
+	client  *http.Client
+	now     func() time.Time
+
+	body        *template.Template
+	headers     map[string]*template.Template
+	injectValue *template.Template
+
+	lock     sync.Mutex
+	sessions map[string]*delegatedSession // Keyed on user
+}
+
+var delegatedTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func newDelegatedProvider(config *ConfigPassThroughAuth) (passThroughProvider, error) {
+	p := &delegatedProvider{
+		config:   *config,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		now:      time.Now,
+		headers:  map[string]*template.Template{},
+		sessions: map[string]*delegatedSession{},
+	}
+	o := &p.options
+	if err := config.decodeOptions(o); err != nil {
+		return nil, err
+	}
+	if config.LoginURL == "" {
+		return nil, fmt.Errorf("Delegated needs a LoginURL")
+	}
+	if o.Method == "" {
+		o.Method = "POST"
+	}
+	if o.ContentType == "" {
+		o.ContentType = "application/json"
+	}
+	if o.AssertionLifetime <= 0 {
+		o.AssertionLifetime = defaultDelegatedAssertionLifetime
+	}
+	if o.TokenField == "" {
+		o.TokenField = "access_token"
+	}
+	if o.ExpiresInField == "" {
+		o.ExpiresInField = "expires_in"
+	}
+	if o.SessionLifetime <= 0 {
+		o.SessionLifetime = defaultDelegatedSessionLifetime
+	}
+	if o.InjectHeader == "" {
+		o.InjectHeader = "Authorization"
+	}
+	if o.InjectValue == "" {
+		o.InjectValue = "Bearer {{.Token}}"
+	}
+	if o.MaxSessions <= 0 {
+		o.MaxSessions = defaultDelegatedMaxSessions
+	}
+
+	var err error
+	parse := func(name, text string) *template.Template {
+		t, e := template.New(name).Funcs(delegatedTemplateFuncs).Option("missingkey=error").Parse(text)
+		if e != nil && err == nil {
+			err = fmt.Errorf("Delegated %v template: %v", name, e)
+		}
+		return t
+	}
+	p.body = parse("Body", o.Body)
+	p.injectValue = parse("InjectValue", o.InjectValue)
+	for name, value := range o.Headers {
+		p.headers[name] = parse("Headers."+name, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *delegatedProvider) inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	if authData == nil {
+		http.Error(w, "Delegated authentication needs a logged-in user", http.StatusUnauthorized)
+		return false
+	}
+	user := delegatedUserKey(authData)
+	if user == "" {
+		http.Error(w, "Delegated authentication needs a logged-in user", http.StatusUnauthorized)
+		return false
+	}
+
+	session := p.session(log, user, authData)
+	select {
+	case <-session.ready:
+	case <-req.Context().Done():
+		http.Error(w, "Request cancelled", http.StatusServiceUnavailable)
+		return false
+	}
+	if session.err != nil {
+		http.Error(w, "Unable to authenticate with backend", http.StatusBadGateway)
+		return false
+	}
+	req.Header.Set(p.options.InjectHeader, session.header)
+	return true
+}
+
+// Returns the user's current session, or starts a login. Only one login per user is ever in flight.
+func (p *delegatedProvider) session(log *log.Logger, user string, authData *serviceauth.Token) *delegatedSession {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s := p.sessions[user]; s != nil {
+		select {
+		case <-s.ready:
+			if s.err == nil && p.now().Before(s.expires) {
+				return s
+			}
+		default:
+			// Login in progress
+			return s
+		}
+	}
+	if len(p.sessions) >= p.options.MaxSessions {
+		p.evict()
+	}
+	s := &delegatedSession{ready: make(chan struct{})}
+	p.sessions[user] = s
+	go p.login(log, user, authData, s)
+	return s
+}
+
+// Make room for a new session. Must be called with the lock held.
+func (p *delegatedProvider) evict() {
+	now := p.now()
+	var oldestUser string
+	var oldest *delegatedSession
+	for user, s := range p.sessions {
+		select {
+		case <-s.ready:
+			if s.err != nil || !now.Before(s.expires) {
+				delete(p.sessions, user)
+			} else if oldest == nil || s.expires.Before(oldest.expires) {
+				oldestUser, oldest = user, s
+			}
+		default:
+		}
+	}
+	if len(p.sessions) >= p.options.MaxSessions && oldest != nil {
+		delete(p.sessions, oldestUser)
+	}
+}
+
+// The login runs on its own goroutine, so that it completes even if the request that started it is cancelled
+func (p *delegatedProvider) login(log *log.Logger, user string, authData *serviceauth.Token, s *delegatedSession) {
+	token, expires, err := p.requestSession(authData)
+	if err == nil {
+		s.header, err = render(p.injectValue, map[string]string{"Token": token})
+	}
+	s.expires = expires
+	s.err = err
+	if err != nil {
+		log.Errorf("Delegated login of user %v to %v failed: %v", user, p.config.LoginURL, err)
+		p.lock.Lock()
+		if p.sessions[user] == s {
+			// Don't remember failures. The next request will try again.
+			delete(p.sessions, user)
+		}
+		p.lock.Unlock()
+	} else {
+		log.Infof("Delegated login of user %v to %v, valid until %v", user, p.config.LoginURL, expires.Format(time.RFC3339))
+	}
+	close(s.ready)
+}
+
+func (p *delegatedProvider) requestSession(authData *serviceauth.Token) (string, time.Time, error) {
+	data := delegatedLoginData{
+		UserID:   authData.UserID,
+		Username: authData.Username,
+		Email:    authData.Email,
+	}
+	started := p.now()
+	if p.options.AssertionKey != "" {
+		var err error
+		data.Assertion, err = signJWT("HS256", "", []byte(p.options.AssertionKey), jwtClaims{
+			"iss":      p.options.AssertionIssuer,
+			"aud":      p.options.AssertionAudience,
+			"sub":      strconv.Itoa(authData.UserID),
+			"username": authData.Username,
+			"email":    authData.Email,
+			"iat":      started.Unix(),
+			"exp":      started.Add(time.Duration(p.options.AssertionLifetime) * time.Second).Unix(),
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	body, err := render(p.body, data)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req, err := http.NewRequest(p.options.Method, p.config.LoginURL, strings.NewReader(body))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", p.options.ContentType)
+	}
+	for name, t := range p.headers {
+		value, err := render(t, data)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxDelegatedResponseSize))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%v: %v", resp.Status, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", time.Time{}, fmt.Errorf("%v", resp.Status)
+	}
+
+	var doc interface{}
+	json.Unmarshal(respBody, &doc) // The response may legitimately be empty, if the token comes in a cookie
+	token := ""
+	if p.options.TokenCookie != "" {
+		for _, c := range resp.Cookies() {
+			if c.Name == p.options.TokenCookie {
+				token = c.Value
+			}
+		}
+	} else if v, ok := jsonPath(doc, p.options.TokenField).(string); ok {
+		token = v
+	}
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("Login response has no session token")
+	}
+	lifetime := time.Duration(p.options.SessionLifetime) * time.Second
+	if v, ok := jsonPath(doc, p.options.ExpiresInField).(float64); ok && v > 0 {
+		lifetime = time.Duration(v) * time.Second
+	}
+	// Leave some margin, so that we don't send a session that expires while the request is on the wire
+	return token, expiryWithMargin(started, lifetime, delegatedSessionExpiryMargin*time.Second), nil
+}
+
+// Discard the session that was injected into rejected
+func (p *delegatedProvider) invalidate(rejected *http.Request) {
+	header := rejected.Header.Get(p.options.InjectHeader)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for user, s := range p.sessions {
+		select {
+		case <-s.ready:
+			if s.header == header {
+				delete(p.sessions, user)
+			}
+		default:
+		}
+	}
+}
+
+func (p *delegatedProvider) sessionCount() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.sessions)
+}
+
+// savedDelegatedSession is how a user's session is kept in the token store
+type savedDelegatedSession struct {
+	Header  string
+	Expires time.Time
+}
+
+// Only sessions that have finished logging in, and have not expired, are saved
+func (p *delegatedProvider) exportTokens() interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+	saved := map[string]*savedDelegatedSession{}
+	for user, s := range p.sessions {
+		select {
+		case <-s.ready:
+			if s.err == nil && now.Before(s.expires) {
+				saved[user] = &savedDelegatedSession{Header: s.header, Expires: s.expires}
+			}
+		default:
+		}
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+	return saved
+}
+
+func (p *delegatedProvider) importTokens(raw json.RawMessage) error {
+	saved := map[string]*savedDelegatedSession{}
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+	for user, s := range saved {
+		if s == nil || s.Header == "" || !now.Before(s.Expires) || p.sessions[user] != nil {
+			continue
+		}
+		if len(p.sessions) >= p.options.MaxSessions {
+			p.evict()
+		}
+		ready := make(chan struct{})
+		close(ready)
+		p.sessions[user] = &delegatedSession{ready: ready, header: s.Header, expires: s.Expires}
+	}
+	return nil
+}
+
+// Identify a user by their ID, or failing that, their username or email
+func delegatedUserKey(authData *serviceauth.Token) string {
+	if authData.UserID != 0 {
+		return strconv.Itoa(authData.UserID)
+	}
+	if authData.Username != "" {
+		return "username:" + authData.Username
+	}
+	if authData.Email != "" {
+		return "email:" + authData.Email
+	}
+	return ""
+}
+
+func render(t *template.Template, data interface{}) (string, error) {
+	buf := bytes.Buffer{}
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Look up a dotted path, such as "session.id", in a decoded JSON document
+func jsonPath(doc interface{}, path string) interface{} {
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		doc = obj[part]
+	}
+	return doc
+}
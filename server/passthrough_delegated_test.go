@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+func TestDelegatedSessions(t *testing.T) {
+	var logins atomic.Int32
+	release := make(chan struct{})
+	fail := atomic.Bool{}
+	login := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		req := struct{ User, Assertion string }{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if fail.Load() || r.Header.Get("X-Api-Key") != "k-"+req.User {
+			http.Error(w, "no", http.StatusForbidden)
+			return
+		}
+		// Check the assertion's signature
+		parts := strings.Split(req.Assertion, ".")
+		mac := hmac.New(sha256.New, []byte("shared"))
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if len(parts) != 3 || parts[2] != base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "bad assertion", http.StatusForbidden)
+			return
+		}
+		n := logins.Add(1)
+		fmt.Fprintf(w, `{"session": {"id": "%v-%v"}, "expires_in": 600}`, req.User, n)
+	}))
+	defer login.Close()
+
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "Delegated", "LoginURL": "`+login.URL+`",
+		"Options": {"Body": "{\"User\": {{json .Username}}, \"Assertion\": {{json .Assertion}}}", "Headers": {"X-Api-Key": "k-{{.Username}}"},
+		"AssertionKey": "shared", "TokenField": "session.id", "InjectHeader": "X-Session", "InjectValue": "sid={{.Token}}"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp := p.(*delegatedProvider)
+	now := time.Now()
+	nowLock := sync.Mutex{}
+	dp.now = func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+
+	joe := &serviceauth.Token{UserID: 1, Username: "joe"}
+	ann := &serviceauth.Token{UserID: 2, Username: "ann"}
+	send := func(user *serviceauth.Token) string {
+		req := httptest.NewRequest("GET", "/x", nil)
+		w := httptest.NewRecorder()
+		if !p.inject(testLog(), w, req, user) {
+			return fmt.Sprintf("rejected %v", w.Code)
+		}
+		return req.Header.Get("X-Session")
+	}
+
+	// Many concurrent requests from one user produce a single login
+	results := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		go func() { results <- send(joe) }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 10; i++ {
+		if r := <-results; r != "sid=joe-1" {
+			t.Errorf("Unexpected session %v", r)
+		}
+	}
+	if logins.Load() != 1 {
+		t.Errorf("Expected 1 login, but got %v", logins.Load())
+	}
+
+	// Each user gets their own session
+	if s := send(ann); s != "sid=ann-2" {
+		t.Errorf("Unexpected session for second user: %v", s)
+	}
+	if s := send(joe); s != "sid=joe-1" {
+		t.Errorf("Session was not reused: %v", s)
+	}
+
+	// Sessions expire
+	nowLock.Lock()
+	now = now.Add(10 * time.Minute)
+	nowLock.Unlock()
+	if s := send(joe); s != "sid=joe-3" {
+		t.Errorf("Expired session was not renewed: %v", s)
+	}
+
+	// Failures are not cached
+	nowLock.Lock()
+	now = now.Add(10 * time.Minute)
+	nowLock.Unlock()
+	fail.Store(true)
+	if s := send(joe); s != "rejected 502" {
+		t.Errorf("Expected failed login to produce 502, but got %v", s)
+	}
+	fail.Store(false)
+	if s := send(joe); s != "sid=joe-4" {
+		t.Errorf("Login was not retried after failure: %v", s)
+	}
+
+	// Invalidation drops only the rejected session
+	rejected := httptest.NewRequest("GET", "/x", nil)
+	rejected.Header.Set("X-Session", "sid=joe-4")
+	dp.invalidate(rejected)
+	if dp.sessions["1"] != nil || dp.sessions["2"] == nil {
+		t.Errorf("Wrong session invalidated")
+	}
+
+	if s := send(nil); s != "rejected 401" {
+		t.Errorf("Anonymous request must be rejected, but got %v", s)
+	}
+}
+
+func TestDelegatedShortSession(t *testing.T) {
+	var logins atomic.Int32
+	login := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"access_token": "s%v", "expires_in": 20}`, logins.Add(1))
+	}))
+	defer login.Close()
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "Delegated", "LoginURL": "`+login.URL+`", "Options": {"Body": "{}"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	p.(*delegatedProvider).now = func() time.Time { return now }
+	joe := &serviceauth.Token{UserID: 1, Username: "joe"}
+
+	// A session that lives for less than the expiry margin is still used for half its life
+	for _, c := range []struct {
+		after    time.Duration
+		expected int32
+	}{{0, 1}, {9 * time.Second, 1}, {2 * time.Second, 2}} {
+		now = now.Add(c.after)
+		if !p.inject(testLog(), httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil), joe) {
+			t.Fatal("Login failed")
+		}
+		if logins.Load() != c.expected {
+			t.Errorf("After %v: expected %v logins, but got %v", c.after, c.expected, logins.Load())
+		}
+	}
+}
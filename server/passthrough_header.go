@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/serviceauth"
+)
+
+/*
+Header pass-through auth adds fixed headers, such as an API key, to every request.
+
+	"PassThroughAuth": {
+		"Type": "Header",
+		"Options": {
+			"Headers": {"X-Api-Key": "${file:/run/secrets/partner-key}"}	Read secrets from files, so that they are redacted from -show-config
+		}
+	}
+
+Copies of these headers that the client sends are replaced.
+*/
+
+func init() {
+	registerPassThrough(AuthPassThroughHeader, newHeaderProvider)
+}
+
+type headerOptions struct {
+	Headers map[string]string
+}
+
+type headerProvider struct {
+	headers map[string]string
+}
+
+func newHeaderProvider(config *ConfigPassThroughAuth) (passThroughProvider, error) {
+	o := headerOptions{}
+	if err := config.decodeOptions(&o); err != nil {
+		return nil, err
+	}
+	if len(o.Headers) == 0 {
+		return nil, fmt.Errorf("Header needs at least one entry in Headers")
+	}
+	p := &headerProvider{headers: map[string]string{}}
+	for name, value := range o.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("Header has an invalid header name '%v'", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("Header %v has a line break in its value", name)
+		}
+		p.headers[name] = value
+	}
+	return p, nil
+}
+
+func (p *headerProvider) inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	for name, value := range p.headers {
+		req.Header.Set(name, value)
+	}
+	return true
+}
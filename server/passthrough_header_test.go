@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderPassThrough(t *testing.T) {
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "Header", "Options": {"Headers": {"x-api-key": "k1", "X-Tenant": "imqs"}}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set("X-Api-Key", "from-the-client")
+	if !p.inject(testLog(), httptest.NewRecorder(), req, nil) {
+		t.Fatal("Header refused a request")
+	}
+	if v := req.Header.Values("X-Api-Key"); len(v) != 1 || v[0] != "k1" || req.Header.Get("X-Tenant") != "imqs" {
+		t.Errorf("Unexpected headers %v", req.Header)
+	}
+
+	for _, bad := range []string{`{}`, `{"Headers": {"Bad Name": "x"}}`, `{"Headers": {"X-Key": "a\r\nb"}}`} {
+		if _, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "Header", "Options": `+bad+`}}`); err == nil {
+			t.Errorf("Expected %v to fail", bad)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	invalidateBodyPeekSize = 8 * 1024  // bytes of the response body that BodyPattern is matched against
+	maxRetryBodySize       = 64 * 1024 // requests with larger bodies are not retried
+)
+
+// Only these responses are matched against BodyPattern, unless the config says otherwise.
+// Login pages are HTML, and peeking into other bodies, such as streams, could hold up the response.
+var invalidateBodyContentTypes = []string{"text/html"}
+
+// A provider that caches credentials implements passThroughInvalidator, so that the credentials
+// can be discarded when the backend no longer accepts them. This happens when the backend restarts,
+// and forgets the sessions that it handed out.
+type passThroughInvalidator interface {
+	// Discard the credentials that were injected into rejected. If the provider has already
+	// replaced those credentials, then it must keep the new ones.
+	invalidate(rejected *http.Request)
+}
+
+// invalidationRules decide whether a backend response means that our pass-through credentials were rejected
+type invalidationRules struct {
+	statusCodes map[int]bool
+	header      string
+	body        *regexp.Regexp
+	bodyTypes   []string // Media types whose bodies are matched against body
+	redirect    *regexp.Regexp
+}
+
+// Returns nil if no rules are configured
+func newInvalidationRules(c *ConfigInvalidateOn) (*invalidationRules, error) {
+	if len(c.StatusCodes) == 0 && c.Header == "" && c.BodyPattern == "" && len(c.BodyContentTypes) == 0 && c.RedirectPattern == "" {
+		return nil, nil
+	}
+	r := &invalidationRules{
+		statusCodes: map[int]bool{},
+		header:      c.Header,
+	}
+	for _, code := range c.StatusCodes {
+		r.statusCodes[code] = true
+	}
+	var err error
+	if c.BodyPattern != "" {
+		if r.body, err = regexp.Compile(c.BodyPattern); err != nil {
+			return nil, fmt.Errorf("Failed to compile InvalidateOn.BodyPattern '%v': %v", c.BodyPattern, err)
+		}
+		r.bodyTypes = invalidateBodyContentTypes
+		if len(c.BodyContentTypes) != 0 {
+			r.bodyTypes = nil
+			for _, t := range c.BodyContentTypes {
+				r.bodyTypes = append(r.bodyTypes, strings.ToLower(t))
+			}
+		}
+	} else if len(c.BodyContentTypes) != 0 {
+		return nil, fmt.Errorf("InvalidateOn.BodyContentTypes needs a BodyPattern")
+	}
+	if c.RedirectPattern != "" {
+		if r.redirect, err = regexp.Compile(c.RedirectPattern); err != nil {
+			return nil, fmt.Errorf("Failed to compile InvalidateOn.RedirectPattern '%v': %v", c.RedirectPattern, err)
+		}
+	}
+	return r, nil
+}
+
+// Returns true if resp says that the backend rejected our credentials.
+// If the body needs to be inspected, then the start of it is read, and resp.Body is replaced
+// so that the caller still sees the whole body. Only bodies of the configured content types
+// are inspected, and the read never waits for more than the backend has sent, unless the
+// body has a Content-Length, so that streams and long polls are not held up.
+func (r *invalidationRules) rejected(resp *http.Response) bool {
+	if r.statusCodes[resp.StatusCode] {
+		return true
+	}
+	if r.header != "" && resp.Header.Get(r.header) != "" {
+		return true
+	}
+	if r.redirect != nil && resp.StatusCode >= 300 && resp.StatusCode < 400 && r.redirect.MatchString(resp.Header.Get("Location")) {
+		return true
+	}
+	if r.body != nil && resp.Body != nil && resp.Body != http.NoBody && resp.ContentLength != 0 && r.bodyTypeMatches(resp) {
+		peek := make([]byte, invalidateBodyPeekSize)
+		n := 0
+		if resp.ContentLength > 0 {
+			// The whole body is on its way, so we can wait for the start of it
+			if resp.ContentLength < int64(len(peek)) {
+				peek = peek[:resp.ContentLength]
+			}
+			n, _ = io.ReadFull(resp.Body, peek)
+		} else {
+			// Chunked, or terminated by closing the connection. Take whatever has arrived.
+			n, _ = resp.Body.Read(peek)
+		}
+		peek = peek[:n]
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(peek), resp.Body), resp.Body}
+		return r.body.Match(peek)
+	}
+	return false
+}
+
+func (r *invalidationRules) bodyTypeMatches(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, t := range r.bodyTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if req may be sent a second time. We only retry idempotent requests, and only when
+// the body is small enough to hold in memory. The body is buffered, so that it can be replayed.
+func prepareRetry(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		if req.Header.Get("Idempotency-Key") == "" {
+			return false
+		}
+	}
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return true
+	}
+	if req.ContentLength < 0 || req.ContentLength > maxRetryBodySize {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBodySize+1))
+	req.Body.Close()
+	if err == nil && int64(len(body)) != req.ContentLength {
+		err = fmt.Errorf("Request body does not match Content-Length")
+	}
+	if err != nil {
+		// We've consumed the body, so the request can't be sent at all
+		req.Body = io.NopCloser(errorReader{err})
+		return false
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return true
+}
+
+type errorReader struct {
+	err error
+}
+
+func (e errorReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
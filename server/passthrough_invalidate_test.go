@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassThroughInvalidation(t *testing.T) {
+	tokens := newFakeTokenServer()
+	defer tokens.Close()
+
+	// The backend forgets its sessions whenever 'restarted' is set, and then only accepts the next token
+	accepted := "Bearer access1"
+	restarted := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if restarted {
+			accepted = fmt.Sprintf("Bearer access%v", tokens.issued+1)
+			restarted = false
+		}
+		if r.Header.Get("Authorization") != accepted {
+			if r.URL.Path == "/page" {
+				http.Redirect(w, r, "/Account/Login?next=/page", http.StatusFound)
+			} else {
+				http.Error(w, "who are you?", http.StatusUnauthorized)
+			}
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "ok %v %s", r.Method, body)
+	}))
+	defer backend.Close()
+
+	c := &Config{}
+	c.LoadString(`{"Targets": {"X": {"URL": "` + backend.URL + `", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "` + tokens.URL + `",
+		"InvalidateOn": {"StatusCodes": [401], "RedirectPattern": "/Account/Login"}}}}, "Routes": {"/x/(.*)": "{X}/$1"}}`)
+	translator, err := newUrlTranslator(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{errorLog: testLog(), httpTransport: &http.Transport{}, translator: translator}
+
+	send := func(method, path, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		newurl, route := s.translator.processRoute(req.URL)
+		auth := &route.target.auth
+		w := httptest.NewRecorder()
+		if authPassThrough(s.errorLog, w, req, nil, auth) {
+			s.forwardHttp(w, req, newurl, auth, nil, nil)
+		}
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := send("GET", "/x/a", ""); code != 200 || body != "ok GET " {
+		t.Fatalf("First request failed: %v %v", code, body)
+	}
+
+	restarted = true
+	if code, body := send("PUT", "/x/a", "payload"); code != 200 || body != "ok PUT payload" {
+		t.Errorf("Idempotent request was not retried with its body: %v %v", code, body)
+	}
+	if tokens.issued != 2 {
+		t.Errorf("Expected a second token, but %v were issued", tokens.issued)
+	}
+
+	// A redirect to the login page is also a rejection
+	restarted = true
+	if code, _ := send("GET", "/x/page", ""); code != 200 {
+		t.Errorf("Redirect to login page did not trigger a retry: %v", code)
+	}
+
+	// POST is not retried, but the token is still discarded, so the next request succeeds
+	restarted = true
+	if code, _ := send("POST", "/x/a", "once"); code != http.StatusUnauthorized {
+		t.Errorf("Non-idempotent request was retried: %v", code)
+	}
+	if code, body := send("POST", "/x/a", "again"); code != 200 || body != "ok POST again" {
+		t.Errorf("Token was not discarded: %v %v", code, body)
+	}
+
+	// InvalidateOn makes no sense for a provider that doesn't cache credentials
+	c.LoadString(`{"Targets": {"X": {"URL": "http://a", "PassThroughAuth": {"Type": "SitePro", "InvalidateOn": {"StatusCodes": [401]}}}}}`)
+	if _, err := newUrlTranslator(c); err == nil {
+		t.Errorf("Expected InvalidateOn to be rejected for SitePro")
+	}
+}
+
+func TestInvalidationBodyPattern(t *testing.T) {
+	rules, err := newInvalidationRules(&ConfigInvalidateOn{BodyPattern: "<title>Login</title>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		contentType string
+		body        string
+		rejected    bool
+	}{
+		{"text/html; charset=utf-8", "<html><title>Login</title>", true},
+		{"text/html", "<html><title>Report</title>", false},
+		{"application/json", `{"title": "<title>Login</title>"}`, false},
+		{"text/event-stream", "data: <title>Login</title>", false},
+		{"", "<html><title>Login</title>", false},
+	} {
+		resp := &http.Response{StatusCode: 200, Header: http.Header{}, ContentLength: -1, Body: io.NopCloser(strings.NewReader(c.body))}
+		resp.Header.Set("Content-Type", c.contentType)
+		if rules.rejected(resp) != c.rejected {
+			t.Errorf("Wrong decision for %v %v", c.contentType, c.body)
+		}
+		if all, _ := io.ReadAll(resp.Body); string(all) != c.body {
+			t.Errorf("Body was not preserved: %v", string(all))
+		}
+	}
+
+	// A body that arrives slowly must not hold up the response
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("<html>"))
+	resp := &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/html"}}, ContentLength: -1, Body: pr}
+	done := make(chan bool)
+	go func() { done <- rules.rejected(resp) }()
+	select {
+	case rejected := <-done:
+		if rejected {
+			t.Errorf("Expected the start of a slow body not to match")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Peeking into a slow body blocked")
+	}
+
+	if _, err := newInvalidationRules(&ConfigInvalidateOn{BodyContentTypes: []string{"text/plain"}}); err == nil {
+		t.Errorf("Expected BodyContentTypes without BodyPattern to fail")
+	}
+	rules, _ = newInvalidationRules(&ConfigInvalidateOn{BodyPattern: "Login", BodyContentTypes: []string{"Text/Plain"}})
+	resp = &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain"}}, ContentLength: 5, Body: io.NopCloser(strings.NewReader("Login"))}
+	if !rules.rejected(resp) {
+		t.Errorf("Expected a configured content type to be matched")
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/serviceauth"
+)
+
+/*
+OAuth2 pass-through auth obtains a token from an OAuth2 token endpoint (RFC 6749), and shares it
+between all users of the target. The token endpoint is LoginURL.
+
+	"PassThroughAuth": {
+		"Type": "OAuth2",
+		"LoginURL": "https://partner.example.com/oauth/token",
+		"Username": "me@example.com",				Only for the password grant
+		"Password": "${file:/run/secrets/partner}",	Only for the password grant
+		"Options": {
+			"GrantType": "client_credentials",		client_credentials (default), password, or refresh_token
+			"ClientID": "imqs",
+			"ClientSecret": "${env:PARTNER_SECRET}",
+			"ClientAuth": "basic",					basic (default) sends the client credentials in an Authorization header. body sends them in the form.
+			"Scopes": ["read", "write"],
+			"Audience": "https://api.partner.example.com",
+			"RefreshToken": "${env:PARTNER_REFRESH}",	The initial refresh token, for the refresh_token grant
+			"DefaultExpiry": 3600,					Seconds that a token lives, if the server doesn't send expires_in
+			"ExpiryMargin": 60						Renew the token this many seconds before it expires, or at half its lifetime if that is sooner
+		}
+	}
+
+If the token server hands out a refresh token, then we use that to renew the access token, and
+only fall back to the original grant if the refresh is rejected.
+*/
+
+func init() {
+	registerPassThrough(AuthPassThroughOAuth2, newOAuth2Provider)
+}
+
+const (
+	defaultOAuth2Expiry       = 3600 // seconds
+	defaultOAuth2ExpiryMargin = 60   // seconds
+	maxOAuth2ResponseSize     = 1 << 20
+)
+
+type oauth2Options struct {
+	GrantType     string
+	ClientID      string
+	ClientSecret  string
+	ClientAuth    string
+	Scopes        []string
+	Audience      string
+	RefreshToken  string
+	DefaultExpiry int
+	ExpiryMargin  int
+}
+
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type oauth2Provider struct {
+	config  ConfigPassThroughAuth
+	options oauth2Options
+	client  *http.Client
+	now     func() time.Time
+	token   *sharedToken
+
+	refreshLock  sync.Mutex // renew never runs concurrently, but the token store reads refreshToken at any time
+	refreshToken string
+}
+
+func newOAuth2Provider(config *ConfigPassThroughAuth) (passThroughProvider, error) {
+	p := &oauth2Provider{
+		config: *config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		now:    time.Now,
+	}
+	o := &p.options
+	if err := config.decodeOptions(o); err != nil {
+		return nil, err
+	}
+	if config.LoginURL == "" {
+		return nil, fmt.Errorf("OAuth2 needs a LoginURL, which is the token endpoint")
+	}
+	if o.GrantType == "" {
+		o.GrantType = "client_credentials"
+	}
+	switch o.GrantType {
+	case "client_credentials":
+	case "password":
+		if config.Username == "" {
+			return nil, fmt.Errorf("OAuth2 password grant needs a Username")
+		}
+	case "refresh_token":
+		if o.RefreshToken == "" {
+			return nil, fmt.Errorf("OAuth2 refresh_token grant needs a RefreshToken")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported OAuth2 GrantType '%v'", o.GrantType)
+	}
+	if o.ClientAuth == "" {
+		o.ClientAuth = "basic"
+	}
+	if o.ClientAuth != "basic" && o.ClientAuth != "body" {
+		return nil, fmt.Errorf("OAuth2 ClientAuth must be 'basic' or 'body'")
+	}
+	if o.DefaultExpiry <= 0 {
+		o.DefaultExpiry = defaultOAuth2Expiry
+	}
+	if o.ExpiryMargin <= 0 {
+		o.ExpiryMargin = defaultOAuth2ExpiryMargin
+	}
+	p.refreshToken = o.RefreshToken
+	p.token = newSharedToken("OAuth2 token from "+config.LoginURL, func() time.Time { return p.now() }, p.renew)
+	return p, nil
+}
+
+func (p *oauth2Provider) inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	header, err := p.token.get(log)
+	if err != nil {
+		// This is not the user's fault, so we don't send a 401, which would look like their session has expired
+		http.Error(w, "Unable to authenticate with backend", http.StatusBadGateway)
+		return false
+	}
+	req.Header.Set("Authorization", header)
+	return true
+}
+
+// The refresh token is kept, because it's likely that only the access token was lost
+func (p *oauth2Provider) invalidate(rejected *http.Request) {
+	p.token.invalidate(rejected.Header.Get("Authorization"))
+}
+
+func (p *oauth2Provider) passThroughToken() *sharedToken {
+	return p.token
+}
+
+func (p *oauth2Provider) currentRefreshToken() string {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+	return p.refreshToken
+}
+
+func (p *oauth2Provider) setRefreshToken(refreshToken string) {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+	p.refreshToken = refreshToken
+}
+
+// savedOAuth2Tokens is how an OAuth2 provider is kept in the token store
+type savedOAuth2Tokens struct {
+	Token        *savedSharedToken `json:",omitempty"`
+	RefreshToken string            `json:",omitempty"`
+}
+
+// The refresh token is saved even when the access token has expired, because it usually
+// outlives the access token, and using it is cheaper for the backend than a full login.
+func (p *oauth2Provider) exportTokens() interface{} {
+	saved := &savedOAuth2Tokens{
+		Token:        p.token.save(),
+		RefreshToken: p.currentRefreshToken(),
+	}
+	if saved.Token == nil && (saved.RefreshToken == "" || saved.RefreshToken == p.options.RefreshToken) {
+		return nil
+	}
+	return saved
+}
+
+func (p *oauth2Provider) importTokens(raw json.RawMessage) error {
+	saved := &savedOAuth2Tokens{}
+	if err := json.Unmarshal(raw, saved); err != nil {
+		return err
+	}
+	if saved.RefreshToken != "" {
+		p.setRefreshToken(saved.RefreshToken)
+	}
+	p.token.restore(saved.Token)
+	return nil
+}
+
+// Acquire a new token, and return the Authorization header value
+func (p *oauth2Provider) renew() (string, time.Time, error) {
+	if refreshToken := p.currentRefreshToken(); refreshToken != "" {
+		header, validUntil, err := p.requestToken(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+		if err == nil || p.options.GrantType == "refresh_token" {
+			return header, validUntil, err
+		}
+		// The refresh token may have expired, or been revoked, so start afresh
+		p.setRefreshToken("")
+	}
+	form := url.Values{"grant_type": {p.options.GrantType}}
+	if p.options.GrantType == "password" {
+		form.Set("username", p.config.Username)
+		form.Set("password", p.config.Password)
+	}
+	return p.requestToken(form)
+}
+
+func (p *oauth2Provider) requestToken(form url.Values) (string, time.Time, error) {
+	if len(p.options.Scopes) != 0 {
+		form.Set("scope", strings.Join(p.options.Scopes, " "))
+	}
+	if p.options.Audience != "" {
+		form.Set("audience", p.options.Audience)
+	}
+	if p.options.ClientAuth == "body" {
+		form.Set("client_id", p.options.ClientID)
+		if p.options.ClientSecret != "" {
+			form.Set("client_secret", p.options.ClientSecret)
+		}
+	}
+	req, err := http.NewRequest("POST", p.config.LoginURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.options.ClientAuth == "basic" && p.options.ClientID != "" {
+		// RFC 6749 section 2.3.1 says that the client credentials are form-encoded before being base64 encoded
+		req.SetBasicAuth(url.QueryEscape(p.options.ClientID), url.QueryEscape(p.options.ClientSecret))
+	}
+
+	started := p.now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOAuth2ResponseSize))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%v: %v", resp.Status, err)
+	}
+	token := oauth2TokenResponse{}
+	decodeErr := json.Unmarshal(body, &token)
+	if resp.StatusCode != http.StatusOK {
+		if token.Error != "" {
+			return "", time.Time{}, fmt.Errorf("%v: %v %v", resp.Status, token.Error, token.ErrorDescription)
+		}
+		return "", time.Time{}, fmt.Errorf("%v", resp.Status)
+	}
+	if decodeErr != nil {
+		return "", time.Time{}, fmt.Errorf("Error decoding JSON: %v", decodeErr)
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("Response has no access_token")
+	}
+
+	expiresIn := token.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = int64(p.options.DefaultExpiry)
+	}
+	if token.RefreshToken != "" {
+		// Servers may rotate refresh tokens, so always keep the latest one
+		p.setRefreshToken(token.RefreshToken)
+	}
+	tokenType := token.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	// Measure expiry from before we sent the request, so that network latency can't stretch it
+	validUntil := expiryWithMargin(started, time.Duration(expiresIn)*time.Second, time.Duration(p.options.ExpiryMargin)*time.Second)
+	return tokenType + " " + token.AccessToken, validUntil, nil
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand-in OAuth2 token server, which records the requests that it receives
+type fakeTokenServer struct {
+	*httptest.Server
+	lock          sync.Mutex
+	requests      []url.Values
+	basicUser     string
+	issued        int
+	expiresIn     int
+	refreshTokens bool
+	rejectRefresh bool
+}
+
+func newFakeTokenServer() *fakeTokenServer {
+	f := &fakeTokenServer{expiresIn: 600}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		r.ParseForm()
+		f.requests = append(f.requests, r.PostForm)
+		f.basicUser, _, _ = r.BasicAuth()
+		if r.PostForm.Get("grant_type") == "refresh_token" && (f.rejectRefresh || r.PostForm.Get("refresh_token") == "") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "refresh token expired"}`)
+			return
+		}
+		f.issued++
+		resp := map[string]interface{}{
+			"access_token": fmt.Sprintf("access%v", f.issued),
+			"token_type":   "bearer",
+			"expires_in":   f.expiresIn,
+		}
+		if f.refreshTokens {
+			resp["refresh_token"] = fmt.Sprintf("refresh%v", f.issued)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return f
+}
+
+func (f *fakeTokenServer) lastRequest() url.Values {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+func injectOAuth2(t *testing.T, p passThroughProvider) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/x", nil)
+	w := httptest.NewRecorder()
+	if !p.inject(testLog(), w, req, nil) {
+		return fmt.Sprintf("rejected %v", w.Code)
+	}
+	return req.Header.Get("Authorization")
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	server := newFakeTokenServer()
+	defer server.Close()
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "`+server.URL+`",
+		"Options": {"ClientID": "imqs router", "ClientSecret": "s3cret", "Scopes": ["read", "write"], "Audience": "api"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	p.(*oauth2Provider).now = func() time.Time { return now }
+
+	if h := injectOAuth2(t, p); h != "Bearer access1" {
+		t.Fatalf("Unexpected Authorization %v", h)
+	}
+	form := server.lastRequest()
+	if form.Get("grant_type") != "client_credentials" || form.Get("scope") != "read write" || form.Get("audience") != "api" || form.Get("client_secret") != "" {
+		t.Errorf("Unexpected token request %v", form)
+	}
+	if server.basicUser != "imqs+router" {
+		t.Errorf("Client ID must be form-encoded in basic auth, but got %v", server.basicUser)
+	}
+
+	// The token is reused until it is within ExpiryMargin of expires_in
+	now = now.Add(500 * time.Second)
+	if h := injectOAuth2(t, p); h != "Bearer access1" {
+		t.Errorf("Token was not reused: %v", h)
+	}
+	now = now.Add(50 * time.Second)
+	if h := injectOAuth2(t, p); h != "Bearer access2" {
+		t.Errorf("Token was not renewed before expiry: %v", h)
+	}
+
+	// A token that lives no longer than ExpiryMargin is still used for half its life
+	server.expiresIn = 40
+	now = now.Add(time.Hour)
+	if h := injectOAuth2(t, p); h != "Bearer access3" {
+		t.Fatalf("Expected a new token, but got %v", h)
+	}
+	now = now.Add(19 * time.Second)
+	if h := injectOAuth2(t, p); h != "Bearer access3" {
+		t.Errorf("Short-lived token was not reused: %v", h)
+	}
+	now = now.Add(2 * time.Second)
+	if h := injectOAuth2(t, p); h != "Bearer access4" {
+		t.Errorf("Short-lived token was not renewed at half its life: %v", h)
+	}
+}
+
+func TestOAuth2PasswordAndRefresh(t *testing.T) {
+	server := newFakeTokenServer()
+	defer server.Close()
+	server.refreshTokens = true
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "`+server.URL+`",
+		"Username": "joe", "Password": "pw", "Options": {"GrantType": "password", "ClientID": "imqs", "ClientSecret": "s", "ClientAuth": "body"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	p.(*oauth2Provider).now = func() time.Time { return now }
+
+	injectOAuth2(t, p)
+	form := server.lastRequest()
+	if form.Get("grant_type") != "password" || form.Get("username") != "joe" || form.Get("password") != "pw" || form.Get("client_id") != "imqs" || form.Get("client_secret") != "s" {
+		t.Errorf("Unexpected token request %v", form)
+	}
+	if server.basicUser != "" {
+		t.Errorf("Client credentials sent in both body and header")
+	}
+
+	// Renewal uses the refresh token
+	now = now.Add(time.Hour)
+	if h := injectOAuth2(t, p); h != "Bearer access2" || server.lastRequest().Get("refresh_token") != "refresh1" {
+		t.Errorf("Token was not refreshed: %v %v", h, server.lastRequest())
+	}
+
+	// If the refresh token is rejected, we log in again
+	server.rejectRefresh = true
+	now = now.Add(time.Hour)
+	if h := injectOAuth2(t, p); h != "Bearer access3" || server.lastRequest().Get("grant_type") != "password" {
+		t.Errorf("Did not fall back to password grant: %v %v", h, server.lastRequest())
+	}
+}
+
+func TestOAuth2Errors(t *testing.T) {
+	server := newFakeTokenServer()
+	defer server.Close()
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "`+server.URL+`",
+		"Options": {"GrantType": "refresh_token", "RefreshToken": "stale"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.rejectRefresh = true
+	if h := injectOAuth2(t, p); h != "rejected 502" {
+		t.Errorf("Expected failed token request to produce 502, but got %v", h)
+	}
+
+	for _, bad := range []string{
+		`{"Type": "OAuth2"}`,
+		`{"Type": "OAuth2", "LoginURL": "http://x", "Options": {"GrantType": "implicit"}}`,
+		`{"Type": "OAuth2", "LoginURL": "http://x", "Options": {"GrantType": "password"}}`,
+		`{"Type": "OAuth2", "LoginURL": "http://x", "Options": {"ClientAuth": "jwt"}}`,
+	} {
+		if _, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": `+bad+`}`); err == nil {
+			t.Errorf("Expected config to fail: %v", bad)
+		}
+	}
+}
+
+func TestOAuth2SecretsRedacted(t *testing.T) {
+	c := &Config{}
+	if err := c.LoadString(`{"Targets": {"X": {"URL": "http://a", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "http://x",
+		"Options": {"ClientID": "imqs", "ClientSecret": "hunter2"}}}}}`); err != nil {
+		t.Fatal(err)
+	}
+	if opt := c.redactedCopy().Targets["X"].PassThroughAuth.Options; opt["ClientSecret"] != redacted || opt["ClientID"] != "imqs" {
+		t.Errorf("ClientSecret was not redacted: %v", opt)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Known answers from the AWS Signature Version 4 test suite
+func TestSigV4KnownAnswers(t *testing.T) {
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "SigV4", "Options": {
+		"AccessKeyID": "AKIDEXAMPLE", "SecretAccessKey": "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "Region": "us-east-1", "Service": "service"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := p.(*sigV4Provider)
+	signer.now = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+
+	for _, c := range []struct {
+		name      string
+		method    string
+		url       string
+		signature string
+	}{
+		{"get-vanilla", "GET", "/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "GET", "/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"post-vanilla", "POST", "/", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	} {
+		req := httptest.NewRequest(c.method, "http://example.amazonaws.com"+c.url, nil)
+		if !signer.prepareOutgoing(testLog(), httptest.NewRecorder(), req) {
+			t.Fatalf("%v: signing failed", c.name)
+		}
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + c.signature
+		if got := req.Header.Get("Authorization"); got != expected {
+			t.Errorf("%v: expected\n%v\nbut got\n%v", c.name, expected, got)
+		}
+	}
+}
+
+func TestSigV4(t *testing.T) {
+	type seen struct{ path, auth, contentHash, token, acl, owner, body string }
+	var got seen
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 100)
+		n, _ := r.Body.Read(buf)
+		got = seen{r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256"), r.Header.Get("X-Amz-Security-Token"),
+			r.Header.Get("X-Amz-Acl"), r.Header.Get("X-Amz-Meta-Owner"), string(buf[:n])}
+	}))
+	defer backend.Close()
+
+	s, _ := newTestServer(t, `{
+		"Targets": {
+			"S3": {"URL": "`+backend.URL+`", "PassThroughAuth": {"Type": "SigV4", "Options": {
+				"AccessKeyID": "AKID", "SecretAccessKey": "secret", "SessionToken": "session", "Region": "af-south-1", "Service": "s3", "MaxBodySize": 10,
+				"ForwardHeaders": ["X-Amz-Meta-Owner"]}}},
+			"STREAM": {"URL": "`+backend.URL+`", "PassThroughAuth": {"Type": "SigV4", "Options": {
+				"AccessKeyID": "AKID", "SecretAccessKey": "secret", "Region": "af-south-1", "Service": "s3", "UnsignedPayload": true}}}
+		},
+		"Routes": {"/files/(.*)": "{S3}/bucket/$1", "/stream/(.*)": "{STREAM}/bucket/$1"}}`)
+	send := func(path, body string) int {
+		t.Helper()
+		req := httptest.NewRequest("PUT", path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer from-the-client")
+		req.Header.Set("X-Amz-Acl", "public-read")
+		req.Header.Set("X-Amz-Meta-Owner", "joe")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		return w.Code
+	}
+
+	// The signature is made over the translated path, and the body still reaches the backend.
+	// Only the X-Amz-* headers that the config allows are kept from the client.
+	if code := send("/files/a.txt", "hello"); code != http.StatusOK {
+		t.Fatalf("Expected 200, but got %v", code)
+	}
+	if got.path != "/bucket/a.txt" || got.body != "hello" || got.token != "session" || got.acl != "" || got.owner != "joe" ||
+		got.contentHash != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" ||
+		!regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKID/\d{8}/af-south-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-meta-owner;x-amz-security-token, Signature=[0-9a-f]{64}$`).MatchString(got.auth) {
+		t.Errorf("Unexpected request at the backend %+v", got)
+	}
+
+	// Server-sent event requests are signed too
+	req := httptest.NewRequest("GET", "/files/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	s.ServeHTTP(false, httptest.NewRecorder(), req)
+	if got.path != "/bucket/events" || !strings.HasPrefix(got.auth, "AWS4-HMAC-SHA256 ") {
+		t.Errorf("Event stream request was not signed: %+v", got)
+	}
+
+	if code := send("/files/a.txt", "more than ten bytes"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a large body to be refused, but got %v", code)
+	}
+	if code := send("/stream/a.txt", "more than ten bytes"); code != http.StatusOK || got.contentHash != "UNSIGNED-PAYLOAD" || got.body != "more than ten bytes" {
+		t.Errorf("Expected an unsigned payload, but got %v %+v", code, got)
+	}
+
+	for _, bad := range []string{
+		`{"AccessKeyID": "AKID", "Region": "us-east-1", "Service": "s3"}`,
+		`{"AccessKeyID": "AKID", "SecretAccessKey": "x", "Region": "us-east-1", "Service": "execute-api", "UnsignedPayload": true}`,
+		`{"AccessKeyID": "AKID", "SecretAccessKey": "x", "Region": "us-east-1", "Service": "s3", "MaxBodySize": -1}`,
+		`{"AccessKeyID": "AKID", "SecretAccessKey": "x", "Region": "us-east-1", "Service": "s3", "ForwardHeaders": ["Authorization"]}`,
+	} {
+		if _, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "SigV4", "Options": `+bad+`}}`); err == nil {
+			t.Errorf("Expected %v to fail", bad)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+const (
+	tokenStoreKeyEnv       = "ROUTER_TOKEN_STORE_KEY"
+	tokenStoreMagic        = "IMQS-ROUTER-TOKENS-1\n"
+	tokenStoreSaveInterval = 30 * time.Second
+)
+
+// Providers whose credentials can survive a restart implement tokenExporter, so that the
+// token store can save them. Only credentials that are still valid should be exported.
+type tokenExporter interface {
+	// Returns a JSON-serializable snapshot of the provider's credentials, or nil if there is nothing to save
+	exportTokens() interface{}
+	// Restore a snapshot that was produced by exportTokens. Credentials that have since expired must be ignored.
+	importTokens(raw json.RawMessage) error
+}
+
+// tokenStore saves pass-through tokens to an encrypted file, so that a restart of the router doesn't
+// cause a burst of logins to partner systems. The file is encrypted with AES-256-GCM.
+// Each target's tokens are stored along with a fingerprint of the target's config. If the config
+// changes, then the saved tokens of that target are discarded, because they may belong to a different
+// account or a different backend.
+type tokenStore struct {
+	filename  string
+	aead      cipher.AEAD
+	saveLock  sync.Mutex // Guards lastSaved, and serializes writes to the file
+	lastSaved []byte     // Plaintext of the last save, so that we only write when something has changed
+}
+
+type tokenStoreFile struct {
+	Saved   time.Time
+	Targets map[string]*tokenStoreTarget
+}
+
+type tokenStoreTarget struct {
+	Fingerprint string
+	Tokens      json.RawMessage
+}
+
+// Returns nil if the token store is not enabled
+func newTokenStore(c *ConfigTokenStore) (*tokenStore, error) {
+	if c.File == "" {
+		return nil, nil
+	}
+	key := c.Key
+	if key == "" {
+		key = os.Getenv(tokenStoreKeyEnv)
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("TokenStore needs a Key of at least 16 characters, either in the config, or in the environment variable %v", tokenStoreKeyEnv)
+	}
+	// The key is a long random string, so a plain hash is enough to turn it into an AES-256 key
+	hashed := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(hashed[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenStore{
+		filename: c.File,
+		aead:     aead,
+	}, nil
+}
+
+// A hash of everything about a target that could make its saved tokens invalid
+func targetFingerprint(t *target) string {
+	raw, _ := json.Marshal(struct {
+		URL  string
+		Auth ConfigPassThroughAuth
+	}{t.baseUrl, t.auth.config})
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// Restore saved tokens into the providers of targets. Problems are logged, but they are never fatal,
+// because the worst outcome is that we log in again.
+func (ts *tokenStore) load(targets map[string]*target, log *log.Logger) {
+	sealed, err := os.ReadFile(ts.filename)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Errorf("Unable to read token store: %v", err)
+		return
+	}
+	plain, err := ts.open(sealed)
+	if err != nil {
+		log.Warnf("Discarding token store %v: %v", ts.filename, err)
+		return
+	}
+	file := tokenStoreFile{}
+	if err := json.Unmarshal(plain, &file); err != nil {
+		log.Warnf("Discarding token store %v: %v", ts.filename, err)
+		return
+	}
+	for name, saved := range file.Targets {
+		t := targets[name]
+		if t == nil {
+			continue
+		}
+		exporter, ok := t.auth.provider.(tokenExporter)
+		if !ok {
+			continue
+		}
+		if saved.Fingerprint != targetFingerprint(t) {
+			log.Infof("Config of target %v has changed, so its saved tokens are discarded", name)
+			continue
+		}
+		if err := exporter.importTokens(saved.Tokens); err != nil {
+			log.Warnf("Unable to restore saved tokens of target %v: %v", name, err)
+			continue
+		}
+		log.Infof("Restored saved tokens of target %v", name)
+	}
+}
+
+// Write the tokens of targets to the file, if anything has changed since the last save
+func (ts *tokenStore) save(targets map[string]*target) error {
+	ts.saveLock.Lock()
+	defer ts.saveLock.Unlock()
+	file := tokenStoreFile{Targets: map[string]*tokenStoreTarget{}}
+	for name, t := range targets {
+		exporter, ok := t.auth.provider.(tokenExporter)
+		if !ok {
+			continue
+		}
+		snapshot := exporter.exportTokens()
+		if snapshot == nil {
+			continue
+		}
+		raw, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		file.Targets[name] = &tokenStoreTarget{
+			Fingerprint: targetFingerprint(t),
+			Tokens:      raw,
+		}
+	}
+	// Compare without the timestamp, which always changes
+	plain, _ := json.Marshal(&file)
+	if bytes.Equal(plain, ts.lastSaved) {
+		return nil
+	}
+	file.Saved = time.Now().UTC()
+	stamped, _ := json.Marshal(&file)
+	if err := writeFileAtomic(ts.filename, ts.seal(stamped), 0600); err != nil {
+		return err
+	}
+	ts.lastSaved = plain
+	return nil
+}
+
+// Save periodically, until stop is closed
+func (ts *tokenStore) saveLoop(targets map[string]*target, log *log.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(tokenStoreSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ts.save(targets); err != nil {
+				log.Errorf("Unable to save token store: %v", err)
+			}
+		}
+	}
+}
+
+func (ts *tokenStore) seal(plain []byte) []byte {
+	nonce := make([]byte, ts.aead.NonceSize())
+	rand.Read(nonce)
+	out := append([]byte(tokenStoreMagic), nonce...)
+	return ts.aead.Seal(out, nonce, plain, []byte(tokenStoreMagic))
+}
+
+func (ts *tokenStore) open(sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, []byte(tokenStoreMagic)) {
+		return nil, fmt.Errorf("Not a token store file, or an unsupported version")
+	}
+	sealed = sealed[len(tokenStoreMagic):]
+	if len(sealed) < ts.aead.NonceSize() {
+		return nil, fmt.Errorf("File is truncated")
+	}
+	plain, err := ts.aead.Open(nil, sealed[:ts.aead.NonceSize()], sealed[ts.aead.NonceSize():], []byte(tokenStoreMagic))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt. Has the key changed?")
+	}
+	return plain, nil
+}
+
+// Write a file so that a reader either sees the old contents, or the new contents, but never a mixture
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after a successful rename
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
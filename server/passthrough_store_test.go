@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+func TestTokenStore(t *testing.T) {
+	tokens := newFakeTokenServer()
+	defer tokens.Close()
+	tokens.refreshTokens = true
+	login := httptest.NewServer(nil) // Delegated logins are never made, because the session is seeded directly
+	defer login.Close()
+
+	// Build the pass-through targets of a fresh router, as a restart would
+	startRouter := func(scope string) map[string]*target {
+		t.Helper()
+		c := &Config{}
+		err := c.LoadString(`{"Targets": {
+			"PARTNER": {"URL": "http://a", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "` + tokens.URL + `", "Options": {"Scopes": ["` + scope + `"]}}},
+			"PORTAL": {"URL": "http://b", "PassThroughAuth": {"Type": "Delegated", "LoginURL": "` + login.URL + `"}}},
+			"Routes": {"/p/(.*)": "{PARTNER}/$1", "/q/(.*)": "{PORTAL}/$1"}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		translator, err := newUrlTranslator(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{errorLog: testLog(), translator: translator}
+		return s.passThroughTargets()
+	}
+	accessToken := func(targets map[string]*target) string {
+		header, _ := targets["PARTNER"].auth.provider.(sharedTokenHolder).passThroughToken().current()
+		return header
+	}
+
+	file := filepath.Join(t.TempDir(), "tokens.bin")
+	store, err := newTokenStore(&ConfigTokenStore{File: file, Key: "0123456789abcdef0123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := startRouter("read")
+	first["PARTNER"].auth.provider.(sharedTokenHolder).passThroughToken().get(testLog())
+	portal := first["PORTAL"].auth.provider.(*delegatedProvider)
+	ready := make(chan struct{})
+	close(ready)
+	portal.sessions["1"] = &delegatedSession{ready: ready, header: "Bearer joe", expires: time.Now().Add(time.Hour)}
+	portal.sessions["2"] = &delegatedSession{ready: ready, header: "Bearer old", expires: time.Now().Add(-time.Minute)}
+	if err := store.save(first); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(file)
+	if strings.Contains(string(raw), "access1") || strings.Contains(string(raw), "Bearer joe") {
+		t.Fatalf("Tokens are stored in plain text")
+	}
+
+	// After a restart, valid tokens are restored without logging in again
+	second := startRouter("read")
+	store.load(second, testLog())
+	if h := accessToken(second); h != "Bearer access1" {
+		t.Errorf("Shared token was not restored: %q", h)
+	}
+	if p := second["PARTNER"].auth.provider.(*oauth2Provider); p.currentRefreshToken() != "refresh1" {
+		t.Errorf("Refresh token was not restored: %q", p.currentRefreshToken())
+	}
+	req := httptest.NewRequest("GET", "/q/x", nil)
+	if !second["PORTAL"].auth.provider.inject(testLog(), httptest.NewRecorder(), req, &serviceauth.Token{UserID: 1}) || req.Header.Get("Authorization") != "Bearer joe" {
+		t.Errorf("Delegated session was not restored: %q", req.Header.Get("Authorization"))
+	}
+	if n := second["PORTAL"].auth.provider.(sessionCounter).sessionCount(); n != 1 {
+		t.Errorf("Expected only the unexpired session to be restored, but got %v", n)
+	}
+	if tokens.issued != 1 {
+		t.Errorf("Expected a single login, but got %v", tokens.issued)
+	}
+
+	// A target whose config has changed starts afresh
+	third := startRouter("write")
+	store.load(third, testLog())
+	if h := accessToken(third); h != "" {
+		t.Errorf("Token of a changed target was restored: %q", h)
+	}
+	if third["PORTAL"].auth.provider.(sessionCounter).sessionCount() != 1 {
+		t.Errorf("Sessions of an unchanged target were discarded")
+	}
+
+	// A different key can't read the file, and that is not fatal
+	otherKey, _ := newTokenStore(&ConfigTokenStore{File: file, Key: "another key of sufficient length"})
+	fourth := startRouter("read")
+	otherKey.load(fourth, testLog())
+	if h := accessToken(fourth); h != "" {
+		t.Errorf("Token was restored with the wrong key: %q", h)
+	}
+
+	// The key may come from the environment, but it can't be missing or short
+	t.Setenv(tokenStoreKeyEnv, "")
+	if _, err := newTokenStore(&ConfigTokenStore{File: file}); err == nil || !strings.Contains(err.Error(), tokenStoreKeyEnv) {
+		t.Errorf("Expected missing key to fail, but got %v", err)
+	}
+	t.Setenv(tokenStoreKeyEnv, "0123456789abcdef0123")
+	fromEnv, err := newTokenStore(&ConfigTokenStore{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fifth := startRouter("read")
+	fromEnv.load(fifth, testLog())
+	if h := accessToken(fifth); h != "Bearer access1" {
+		t.Errorf("Key from the environment could not read the file: %q", h)
+	}
+}
+
+func TestTokenStoreSavedOnClose(t *testing.T) {
+	tokens := newFakeTokenServer()
+	defer tokens.Close()
+	c := &Config{}
+	c.LoadString(`{"Targets": {"PARTNER": {"URL": "http://a", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "` + tokens.URL + `"}}},
+		"Routes": {"/p/(.*)": "{PARTNER}/$1"}}`)
+	store, err := newTokenStore(&ConfigTokenStore{File: filepath.Join(t.TempDir(), "tokens.bin"), Key: "0123456789abcdef0123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func() *Server {
+		t.Helper()
+		translator, err := newUrlTranslator(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Server{errorLog: testLog(), translator: translator, tokenStore: store, stop: make(chan struct{})}
+	}
+
+	s := newServer()
+	s.passThroughTargets()["PARTNER"].auth.provider.(sharedTokenHolder).passThroughToken().get(testLog())
+	s.Close()
+
+	restarted := newServer()
+	store.load(restarted.passThroughTargets(), testLog())
+	if h, _ := restarted.passThroughTargets()["PARTNER"].auth.provider.(sharedTokenHolder).passThroughToken().current(); h != "Bearer access1" {
+		t.Errorf("Token was not saved when the server closed: %q", h)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/serviceauth"
+)
+
+// A provider that stamps a header onto each request, for testing the registry
+type stampProvider struct {
+	header string
+}
+
+func (p *stampProvider) inject(log *log.Logger, w http.ResponseWriter, req *http.Request, authData *serviceauth.Token) bool {
+	req.Header.Set(p.header, "stamped")
+	return true
+}
+
+func testLog() *log.Logger {
+	return log.New(log.Stdout, false)
+}
+
+// A router with the Targets and Routes of config, for tests that send requests through ServeHTTP.
+// Other parts of the server are left for the test to build from the returned config.
+func newTestServer(t *testing.T, config string) (*Server, *Config) {
+	t.Helper()
+	c := &Config{}
+	err := c.LoadString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{errorLog: testLog(), httpTransport: &http.Transport{}, wsdlMatch: regexp.MustCompile(`([^/]\w+)\.(wsdl)$`)}
+	if s.translator, err = newUrlTranslator(c); err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+// A backend that answers "ok" to everything, and is closed when the test ends
+func newOKBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// Fail for each of the values of a target's field that the router accepts
+func expectTargetErrors(t *testing.T, field string, bad ...string) {
+	t.Helper()
+	for _, value := range bad {
+		c := &Config{}
+		if err := c.LoadString(`{"Targets": {"X": {"URL": "http://a", "` + field + `": ` + value + `}}}`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newUrlTranslator(c); err == nil {
+			t.Errorf("Expected %v %v to fail", field, value)
+		}
+	}
+}
+
+// Build a provider from a JSON target config
+func passThroughFromJSON(t *testing.T, targetJSON string) (passThroughProvider, error) {
+	c := &Config{}
+	if err := c.LoadString(`{"Targets": {"X": ` + targetJSON + `}}`); err != nil {
+		t.Fatal(err)
+	}
+	auth := c.Targets["X"].PassThroughAuth
+	return newPassThroughProvider(&auth)
+}
+
+func TestPassThroughRegistry(t *testing.T) {
+	registerPassThrough("Stamp", func(c *ConfigPassThroughAuth) (passThroughProvider, error) {
+		opt := struct{ Header string }{"X-Stamp"}
+		if err := c.decodeOptions(&opt); err != nil {
+			return nil, err
+		}
+		return &stampProvider{header: opt.Header}, nil
+	})
+	defer delete(passThroughProviders, "Stamp")
+
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "Stamp", "Options": {"Header": "X-Custom"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/x", nil)
+	if !authPassThrough(testLog(), httptest.NewRecorder(), req, nil, &targetPassThroughAuth{provider: p}) || req.Header.Get("X-Custom") != "stamped" {
+		t.Errorf("Custom provider did not run")
+	}
+
+	expectError := func(targetJSON, errorContains string) {
+		t.Helper()
+		if _, err := passThroughFromJSON(t, targetJSON); err == nil || !strings.Contains(err.Error(), errorContains) {
+			t.Errorf("Expected error containing %q, but got %v", errorContains, err)
+		}
+	}
+	expectError(`{"URL": "http://a", "PassThroughAuth": {"Type": "Stamp", "Options": {"Heder": "X"}}}`, `unknown field "Heder"`)
+	expectError(`{"URL": "http://a", "PassThroughAuth": {"Type": "SitePro", "Options": {"Foo": 1}}}`, `unknown field "Foo"`)
+	expectError(`{"URL": "http://a", "PassThroughAuth": {"Type": "Nope"}}`, "Unknown PassThroughAuth type 'Nope'")
+	expectError(`{"URL": "http://a", "PassThroughAuth": {"Type": "PureHub"}}`, "needs a LoginURL")
+
+	// An unknown type is caught when the server's routes are built
+	c := &Config{}
+	c.LoadString(`{"Targets": {"X": {"URL": "http://a", "PassThroughAuth": {"Type": "Nope"}}}, "Routes": {"/x/(.*)": "{X}/$1"}}`)
+	if _, err := newUrlTranslator(c); err == nil || !strings.HasPrefix(err.Error(), "Target X: ") {
+		t.Errorf("Expected unknown type to fail, but got %v", err)
+	}
+}
+
+func TestPassThroughPureHub(t *testing.T) {
+	logins := 0
+	fail := false
+	login := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if fail || r.Form.Get("username") != "joe" || r.Form.Get("password") != "pw" {
+			http.Error(w, "nope", http.StatusUnauthorized)
+			return
+		}
+		logins++
+		fmt.Fprintf(w, `{"access_token": "tok%v", ".expires": "%v"}`, logins, time.Now().Add(time.Hour).UTC().Format(time.RFC1123))
+	}))
+	defer login.Close()
+
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "PureHub", "LoginURL": "`+login.URL+`", "Username": "joe", "Password": "pw"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/x", nil)
+		if !p.inject(testLog(), httptest.NewRecorder(), req, nil) {
+			t.Fatalf("inject failed")
+		}
+		if req.Header.Get("Authorization") != "Bearer tok1" {
+			t.Errorf("Unexpected Authorization header %v", req.Header.Get("Authorization"))
+		}
+	}
+	if logins != 1 {
+		t.Errorf("Expected token to be reused, but logged in %v times", logins)
+	}
+
+	// A failed login must stop the request
+	p.(*pureHubProvider).token.invalidate("Bearer tok1")
+	fail = true
+	w := httptest.NewRecorder()
+	if p.inject(testLog(), w, httptest.NewRequest("GET", "/x", nil), nil) || w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected failed login to be rejected with 401, but got %v", w.Code)
+	}
+}
+
+func TestPassThroughBasicProviders(t *testing.T) {
+	p, err := passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "SitePro", "Username": "u", "Password": "p"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/x", nil)
+	p.inject(testLog(), httptest.NewRecorder(), req, nil)
+	if user, pass, _ := req.BasicAuth(); user != "u" || pass != "p" {
+		t.Errorf("SitePro did not inject basic auth")
+	}
+
+	// ECS URLs are checked by the target's audit rules (see TestAudit)
+	p, _ = passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "ECS", "Username": "u", "Password": "p"}}`)
+	req = httptest.NewRequest("GET", "/ecs/sam/ForceSim1/site7", nil)
+	p.inject(testLog(), httptest.NewRecorder(), req, nil)
+	if user, pass, _ := req.BasicAuth(); user != "u" || pass != "p" {
+		t.Errorf("ECS did not inject basic auth")
+	}
+
+	p, _ = passThroughFromJSON(t, `{"URL": "http://a", "PassThroughAuth": {"Type": "CouchDB", "Username": "u", "Password": "p"}}`)
+	// Ownership of the database is checked by the target's Owner rule (see TestOwner), so paths without a
+	// database, or without a user, must not trip up the provider.
+	req = httptest.NewRequest("GET", "/userstorage/_all_dbs", nil)
+	if !p.inject(testLog(), httptest.NewRecorder(), req, nil) {
+		t.Errorf("CouchDB refused a request")
+	}
+	if user, pass, _ := req.BasicAuth(); user != "u" || pass != "p" {
+		t.Errorf("CouchDB did not inject basic auth")
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+const (
+	sharedTokenRefreshAt  = 0.75            // Renew a token when this fraction of its lifetime has passed
+	sharedTokenMinWait    = time.Second     // Never renew more often than this
+	sharedTokenMaxBackoff = 5 * time.Minute // Longest wait between failed renewals
+	sharedTokenBaseDelay  = 2 * time.Second // First wait after a failed renewal
+)
+
+// Providers that share one token between all users of a target implement sharedTokenHolder, so that the
+// token can be renewed in the background, and reported on /router/status.
+type sharedTokenHolder interface {
+	passThroughToken() *sharedToken
+}
+
+// sharedToken is a credential that is shared by all users of a target, such as an OAuth2 access token.
+// Requests read the token without waiting on a renewal. The token is renewed in the background before it
+// expires, and a request only waits for a renewal when there is no valid token at all.
+type sharedToken struct {
+	description string // For log messages, eg "OAuth2 token from https://example.com/token"
+	// Fetch a new token from the backend, and return the header value to inject, and the time after which
+	// it may not be used. This is called without any lock held, but never concurrently.
+	acquire func() (header string, validUntil time.Time, err error)
+	now     func() time.Time
+	wake    chan struct{} // Tells the refresh loop that a request acquired a token
+
+	renewLock   sync.Mutex   // Held for the duration of a renewal, so that only one is ever in flight
+	lock        sync.RWMutex // Guards the fields below
+	header      string
+	validUntil  time.Time
+	acquired    time.Time
+	renewals    int64
+	failures    int // Consecutive failed renewals
+	lastError   string
+	lastErrorAt time.Time
+	nextRefresh time.Time
+}
+
+type sharedTokenStatus struct {
+	Valid               bool
+	ValidUntil          *time.Time `json:",omitempty"`
+	Acquired            *time.Time `json:",omitempty"`
+	NextRefresh         *time.Time `json:",omitempty"`
+	Renewals            int64
+	ConsecutiveFailures int
+	LastError           string     `json:",omitempty"`
+	LastErrorAt         *time.Time `json:",omitempty"`
+}
+
+func newSharedToken(description string, now func() time.Time, acquire func() (string, time.Time, error)) *sharedToken {
+	return &sharedToken{
+		description: description,
+		acquire:     acquire,
+		now:         now,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Returns the token, if it is still valid
+func (t *sharedToken) current() (string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.header, t.header != "" && t.now().Before(t.validUntil)
+}
+
+// Returns a valid token, acquiring one if necessary
+func (t *sharedToken) get(log *log.Logger) (string, error) {
+	if header, ok := t.current(); ok {
+		return header, nil
+	}
+	header, err := t.renew(log, false)
+	if err == nil {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+	return header, err
+}
+
+// Acquire a new token. If force is false, and another thread renewed the token while we were
+// waiting our turn, then we use that token instead.
+// On failure, the old token is kept, because it may still be valid.
+func (t *sharedToken) renew(log *log.Logger, force bool) (string, error) {
+	t.renewLock.Lock()
+	defer t.renewLock.Unlock()
+	if header, ok := t.current(); ok && !force {
+		return header, nil
+	}
+
+	header, validUntil, err := t.acquire()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err != nil {
+		t.failures++
+		t.lastError = err.Error()
+		t.lastErrorAt = t.now()
+		log.Errorf("Error acquiring %v (attempt %v): %v", t.description, t.failures, err)
+		return "", err
+	}
+	t.header = header
+	t.validUntil = validUntil
+	t.acquired = t.now()
+	t.renewals++
+	t.failures = 0
+	log.Infof("Acquired %v, valid until %v", t.description, validUntil.Format(time.RFC3339))
+	return header, nil
+}
+
+// Discard the token, if it is the one that the backend rejected
+func (t *sharedToken) invalidate(rejected string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.header == rejected {
+		t.header = ""
+	}
+}
+
+// savedSharedToken is how a sharedToken is kept in the token store
+type savedSharedToken struct {
+	Header     string
+	ValidUntil time.Time
+	Acquired   time.Time
+}
+
+// Returns nil if there is no valid token to save
+func (t *sharedToken) save() *savedSharedToken {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.header == "" || !t.now().Before(t.validUntil) {
+		return nil
+	}
+	return &savedSharedToken{
+		Header:     t.header,
+		ValidUntil: t.validUntil,
+		Acquired:   t.acquired,
+	}
+}
+
+// Use a token that was saved before a restart, unless it has expired, or we already have a token.
+// Returns true if the token was restored.
+func (t *sharedToken) restore(saved *savedSharedToken) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if saved == nil || saved.Header == "" || !t.now().Before(saved.ValidUntil) || t.header != "" {
+		return false
+	}
+	t.header = saved.Header
+	t.validUntil = saved.ValidUntil
+	t.acquired = saved.Acquired
+	// The refresh loop must schedule a renewal for the restored token
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Keep the token fresh, until stop is closed. Nothing happens until a request has acquired the
+// first token, so that we don't log in to backends that nobody uses.
+func (t *sharedToken) refreshLoop(log *log.Logger, stop <-chan struct{}) {
+	for {
+		wait, ok := t.nextWait()
+		var timer *time.Timer
+		var fire <-chan time.Time
+		t.lock.Lock()
+		t.nextRefresh = time.Time{}
+		if ok {
+			t.nextRefresh = t.now().Add(wait)
+			timer = time.NewTimer(wait)
+			fire = timer.C
+		}
+		t.lock.Unlock()
+		select {
+		case <-stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-t.wake:
+		case <-fire:
+			t.renew(log, true)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Returns the time until the next renewal, or false if there is nothing to renew yet
+func (t *sharedToken) nextWait() (time.Duration, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.failures != 0 {
+		// Exponential backoff, with jitter so that several routers don't hammer the backend in lockstep
+		backoff := sharedTokenBaseDelay << min(t.failures-1, 16)
+		if backoff > sharedTokenMaxBackoff {
+			backoff = sharedTokenMaxBackoff
+		}
+		return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)), true
+	}
+	if t.header == "" {
+		return 0, false
+	}
+	lifetime := t.validUntil.Sub(t.acquired)
+	due := t.acquired.Add(time.Duration(float64(lifetime) * sharedTokenRefreshAt))
+	// Jitter by up to 5% of the lifetime, in either direction
+	if jitter := int64(lifetime / 20); jitter > 0 {
+		due = due.Add(time.Duration(rand.Int63n(2*jitter+1) - jitter))
+	}
+	return max(due.Sub(t.now()), sharedTokenMinWait), true
+}
+
+func (t *sharedToken) status() *sharedTokenStatus {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	timeOrNil := func(tm time.Time) *time.Time {
+		if tm.IsZero() {
+			return nil
+		}
+		return &tm
+	}
+	return &sharedTokenStatus{
+		Valid:               t.header != "" && t.now().Before(t.validUntil),
+		ValidUntil:          timeOrNil(t.validUntil),
+		Acquired:            timeOrNil(t.acquired),
+		NextRefresh:         timeOrNil(t.nextRefresh),
+		Renewals:            t.renewals,
+		ConsecutiveFailures: t.failures,
+		LastError:           t.lastError,
+		LastErrorAt:         timeOrNil(t.lastErrorAt),
+	}
+}
+
+// Returns the time after which a credential that was requested at started, and lives for lifetime,
+// should no longer be used. We stop using it margin early, so that it doesn't expire on the wire, but
+// never more than half its lifetime early, so that a short-lived credential is not born expired.
+func expiryWithMargin(started time.Time, lifetime, margin time.Duration) time.Time {
+	return started.Add(lifetime - min(margin, lifetime/2))
+}
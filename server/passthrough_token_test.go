@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedTokenRenewal(t *testing.T) {
+	var issued atomic.Int32
+	block := make(chan struct{})
+	fail := atomic.Bool{}
+	token := newSharedToken("test token", time.Now, func() (string, time.Time, error) {
+		<-block
+		if fail.Load() {
+			return "", time.Time{}, fmt.Errorf("login server is down")
+		}
+		return fmt.Sprintf("Bearer %v", issued.Add(1)), time.Now().Add(time.Hour), nil
+	})
+	close(block)
+	if h, err := token.get(testLog()); h != "Bearer 1" || err != nil {
+		t.Fatalf("Unexpected token %v %v", h, err)
+	}
+
+	// While a renewal is in flight, requests carry on with the old token
+	block = make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := token.renew(testLog(), true)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if h, _ := token.get(testLog()); h != "Bearer 1" {
+		t.Errorf("Request did not use the old token during renewal: %v", h)
+	}
+	close(block)
+	<-done
+	if h, _ := token.get(testLog()); h != "Bearer 2" {
+		t.Errorf("Renewed token was not used: %v", h)
+	}
+
+	// A failed renewal keeps the old token, and schedules a retry with backoff
+	fail.Store(true)
+	if _, err := token.renew(testLog(), true); err == nil {
+		t.Fatalf("Expected renewal to fail")
+	}
+	if h, _ := token.get(testLog()); h != "Bearer 2" {
+		t.Errorf("Old token was lost after a failed renewal: %v", h)
+	}
+	if wait, ok := token.nextWait(); !ok || wait < sharedTokenBaseDelay/2 || wait > sharedTokenBaseDelay {
+		t.Errorf("Unexpected backoff %v", wait)
+	}
+	token.renew(testLog(), true)
+	token.renew(testLog(), true)
+	if wait, _ := token.nextWait(); wait < 2*sharedTokenBaseDelay || wait > 4*sharedTokenBaseDelay {
+		t.Errorf("Backoff did not grow: %v", wait)
+	}
+	st := token.status()
+	if !st.Valid || st.ConsecutiveFailures != 3 || st.LastError != "login server is down" || st.Renewals != 2 {
+		t.Errorf("Unexpected status %+v", st)
+	}
+
+	// Once healthy, the next renewal is due at about 3/4 of the token's lifetime
+	fail.Store(false)
+	token.renew(testLog(), true)
+	if wait, _ := token.nextWait(); wait < 40*time.Minute || wait > 50*time.Minute {
+		t.Errorf("Unexpected refresh time %v", wait)
+	}
+}
+
+func TestSharedTokenRefreshLoop(t *testing.T) {
+	var issued atomic.Int32
+	token := newSharedToken("test token", time.Now, func() (string, time.Time, error) {
+		// A lifetime this short means that the loop renews after its minimum wait of one second
+		return fmt.Sprintf("Bearer %v", issued.Add(1)), time.Now().Add(500 * time.Millisecond), nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go token.refreshLoop(testLog(), stop)
+
+	time.Sleep(100 * time.Millisecond)
+	if issued.Load() != 0 {
+		t.Errorf("The loop must not acquire a token before any request needs one")
+	}
+	token.get(testLog())
+	time.Sleep(1500 * time.Millisecond)
+	if n := issued.Load(); n != 2 {
+		t.Errorf("Expected the loop to renew the token once, but %v tokens were issued", n)
+	}
+}
+
+func TestCloseStopsRefresh(t *testing.T) {
+	c := &Config{}
+	c.LoadString(`{"Targets": {"PARTNER": {"URL": "http://a", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "http://tokens"}}},
+		"Routes": {"/p/(.*)": "{PARTNER}/$1"}}`)
+	translator, err := newUrlTranslator(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{errorLog: testLog(), translator: translator, stop: make(chan struct{})}
+	s.startTokenRefresh()
+	s.Close()
+	s.Close() // A second Close does nothing
+	select {
+	case <-s.stop:
+	default:
+		t.Errorf("Close did not stop the refresh loops")
+	}
+}
+
+func TestPassThroughStatus(t *testing.T) {
+	tokens := newFakeTokenServer()
+	defer tokens.Close()
+	c := &Config{}
+	c.LoadString(`{"Targets": {"PARTNER": {"URL": "http://a", "PassThroughAuth": {"Type": "OAuth2", "LoginURL": "` + tokens.URL + `"}}},
+		"Routes": {"/p/(.*)": "{PARTNER}/$1"}}`)
+	translator, err := newUrlTranslator(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{errorLog: testLog(), translator: translator}
+	s.passThroughTargets()["PARTNER"].auth.provider.(sharedTokenHolder).passThroughToken().get(s.errorLog)
+
+	req := httptest.NewRequest("GET", "/router/status", nil)
+	req.RemoteAddr = "[::1]:1234"
+	s.status.allowLoopback = true
+	w := httptest.NewRecorder()
+	s.serveStatus(w, req)
+	status := routerStatus{}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	partner := status.PassThrough["PARTNER"]
+	if partner == nil || partner.Type != AuthPassThroughOAuth2 || partner.Token == nil || !partner.Token.Valid || partner.Token.Renewals != 1 {
+		t.Errorf("Unexpected status %v", w.Body.String())
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+permissionExpr is a boolean expression over permission names, such as
+
+	report OR admin
+	enabled AND NOT guest
+	(read AND write) OR admin
+
+NOT binds tighter than AND, which binds tighter than OR. The operators must be upper case, so that
+they can't be confused with permissions. A single name, which is all that RequirePermission used to
+allow, is the simplest expression.
+*/
+type permissionExpr struct {
+	op          permissionOp
+	name        string          // For permOpName
+	left, right *permissionExpr // right is nil for permOpNot
+}
+
+type permissionOp int
+
+const (
+	permOpName permissionOp = iota
+	permOpNot
+	permOpAnd
+	permOpOr
+)
+
+// Stops the evaluation of an expression when imqsauth gives an answer other than yes or no
+var errPermissionCheckFailed = errors.New("Permission check failed")
+
+// Returns nil if s is empty
+func parsePermissionExpr(s string) (*permissionExpr, error) {
+	p := &permissionParser{tokens: tokenizePermissionExpr(s)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid permission expression '%v': %v", s, err)
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("Invalid permission expression '%v': unexpected '%v'", s, p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+func tokenizePermissionExpr(s string) []string {
+	tokens := []string{}
+	for _, field := range strings.Fields(s) {
+		// Parentheses don't need to be separated by spaces
+		start := 0
+		for i, ch := range field {
+			if ch == '(' || ch == ')' {
+				if i > start {
+					tokens = append(tokens, field[start:i])
+				}
+				tokens = append(tokens, string(ch))
+				start = i + 1
+			}
+		}
+		if start < len(field) {
+			tokens = append(tokens, field[start:])
+		}
+	}
+	return tokens
+}
+
+type permissionParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *permissionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *permissionParser) parseOr() (*permissionExpr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek() == "OR" {
+		p.pos++
+		var right *permissionExpr
+		if right, err = p.parseAnd(); err == nil {
+			left = &permissionExpr{op: permOpOr, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *permissionParser) parseAnd() (*permissionExpr, error) {
+	left, err := p.parseNot()
+	for err == nil && p.peek() == "AND" {
+		p.pos++
+		var right *permissionExpr
+		if right, err = p.parseNot(); err == nil {
+			left = &permissionExpr{op: permOpAnd, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *permissionParser) parseNot() (*permissionExpr, error) {
+	switch tok := p.peek(); tok {
+	case "NOT":
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &permissionExpr{op: permOpNot, left: operand}, nil
+	case "(":
+		p.pos++
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return e, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("unexpected '%v'", tok)
+	default:
+		p.pos++
+		return &permissionExpr{op: permOpName, name: tok}, nil
+	}
+}
+
+// Evaluate the expression. has answers whether the user holds a permission. It is only called for
+// the permissions that are needed to reach an answer, because each call may be a round trip to imqsauth.
+// Evaluation stops at the first error from has.
+func (e *permissionExpr) eval(has func(permission string) (bool, error)) (bool, error) {
+	switch e.op {
+	case permOpName:
+		return has(e.name)
+	case permOpNot:
+		v, err := e.left.eval(has)
+		return !v, err
+	case permOpAnd:
+		if v, err := e.left.eval(has); err != nil || !v {
+			return false, err
+		}
+		return e.right.eval(has)
+	default:
+		if v, err := e.left.eval(has); err != nil || v {
+			return v, err
+		}
+		return e.right.eval(has)
+	}
+}
+
+// Evaluate the expression against a fixed set of permissions
+func (e *permissionExpr) evalSet(permissions map[string]bool) bool {
+	v, _ := e.eval(func(permission string) (bool, error) {
+		return permissions[permission], nil
+	})
+	return v
+}
+
+func (e *permissionExpr) String() string {
+	switch e.op {
+	case permOpName:
+		return e.name
+	case permOpNot:
+		return "NOT " + e.left.operandString(e.op)
+	case permOpAnd:
+		return e.left.operandString(e.op) + " AND " + e.right.operandString(e.op)
+	default:
+		return e.left.operandString(e.op) + " OR " + e.right.operandString(e.op)
+	}
+}
+
+// Parenthesize e if it binds more loosely than its parent
+func (e *permissionExpr) operandString(parent permissionOp) string {
+	if e.op != permOpName && e.op > parent {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+// permissionRules are the permissions that a target or a route requires, optionally by HTTP method
+type permissionRules struct {
+	all      *permissionExpr            // Methods that aren't in byMethod. nil if they need no permission.
+	byMethod map[string]*permissionExpr // Keyed on upper case method
+}
+
+// Returns nil if nothing is required
+func newPermissionRules(requirePermission string, byMethod map[string]string) (*permissionRules, error) {
+	r := &permissionRules{byMethod: map[string]*permissionExpr{}}
+	var err error
+	if r.all, err = parsePermissionExpr(requirePermission); err != nil {
+		return nil, fmt.Errorf("RequirePermission: %v", err)
+	}
+	// Sort the keys, so that errors are deterministic
+	keys := make([]string, 0, len(byMethod))
+	for k := range byMethod {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		expr, err := parsePermissionExpr(byMethod[key])
+		if err != nil {
+			return nil, fmt.Errorf("MethodPermissions %v: %v", key, err)
+		}
+		if expr == nil {
+			return nil, fmt.Errorf("MethodPermissions %v is empty", key)
+		}
+		// "POST,DELETE" is shorthand for two entries
+		for _, method := range strings.Split(key, ",") {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if method == "" || strings.ContainsAny(method, " \t/()") {
+				return nil, fmt.Errorf("MethodPermissions has an invalid method '%v'", key)
+			}
+			if r.byMethod[method] != nil {
+				return nil, fmt.Errorf("MethodPermissions has method %v more than once", method)
+			}
+			r.byMethod[method] = expr
+		}
+	}
+	if r.all == nil && len(r.byMethod) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Returns the expression for method. found is false if these rules don't mention the method,
+// in which case a fallback (such as the target's rules) should be consulted.
+func (r *permissionRules) forMethod(method string) (expr *permissionExpr, found bool) {
+	if r == nil {
+		return nil, false
+	}
+	if e := r.byMethod[method]; e != nil {
+		return e, true
+	}
+	if e := r.byMethod[http.MethodGet]; e != nil && method == http.MethodHead {
+		// HEAD reveals as much as GET, so unless it has its own rule, it needs the same permissions
+		return e, true
+	}
+	return r.all, r.all != nil
+}
+
+// Returns the permissions that a request needs, or nil if it needs none. The route's rules take
+// precedence over the target's: first the route's rule for the method, then the route's
+// RequirePermission, then the target's rule for the method, then the target's RequirePermission.
+func (r *route) requiredPermission(req *http.Request) *permissionExpr {
+	if e, found := r.permissions.forMethod(req.Method); found {
+		return e
+	}
+	e, _ := r.target.permissions.forMethod(req.Method)
+	return e
+}
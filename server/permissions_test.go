@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IMQS/serviceauth"
+)
+
+func TestPermissionExpr(t *testing.T) {
+	held := map[string]bool{"read": true, "report": true, "guest": true}
+	for _, c := range []struct {
+		expr     string
+		str      string
+		expected bool
+	}{
+		{"read", "read", true},
+		{"admin", "admin", false},
+		{"report OR admin", "report OR admin", true},
+		{"read AND NOT guest", "read AND NOT guest", false},
+		{"NOT (guest OR admin)", "NOT (guest OR admin)", false},
+		{"(read AND report) OR admin", "read AND report OR admin", true},
+		{"read AND (admin OR report)", "read AND (admin OR report)", true},
+		{"admin OR read AND NOT guest", "admin OR read AND NOT guest", false},
+		{"NOT NOT read", "NOT NOT read", true},
+		{"((read))", "read", true},
+	} {
+		e, err := parsePermissionExpr(c.expr)
+		if err != nil {
+			t.Errorf("%v: %v", c.expr, err)
+			continue
+		}
+		if e.String() != c.str {
+			t.Errorf("%v: expected %q, but got %q", c.expr, c.str, e.String())
+		}
+		if e.evalSet(held) != c.expected {
+			t.Errorf("%v: expected %v", c.expr, c.expected)
+		}
+	}
+
+	for _, bad := range []string{"read AND", "OR read", "(read", "read)", "read admin", "NOT", "()"} {
+		if _, err := parsePermissionExpr(bad); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+	if e, err := parsePermissionExpr("  "); e != nil || err != nil {
+		t.Errorf("Expected an empty expression to require nothing")
+	}
+
+	// Only the permissions that decide the answer are asked about
+	e, _ := parsePermissionExpr("report OR admin")
+	asked := []string{}
+	e.eval(func(p string) (bool, error) {
+		asked = append(asked, p)
+		return held[p], nil
+	})
+	if len(asked) != 1 {
+		t.Errorf("Expected evaluation to stop after 'report', but asked about %v", asked)
+	}
+}
+
+func TestMethodPermissions(t *testing.T) {
+	backend := newOKBackend(t)
+
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWKS(t, keyFile, map[string]crypto.PublicKey{"k1": key.Public()})
+
+	s, c := newTestServer(t, `{
+		"Auth": {"SessionJWT": {"KeyFile": "`+filepath.ToSlash(keyFile)+`"}, "DecisionCache": {"TTL": 60, "NegativeTTL": 60}},
+		"Targets": {"DOCS": {"URL": "`+backend.URL+`", "RequirePermission": "read OR admin", "MethodPermissions": {"POST,delete": "admin"}}},
+		"Routes": {
+			"/docs/(.*)": "{DOCS}/$1",
+			"/drafts/(.*)": {"Target": "{DOCS}/drafts/$1", "MethodPermissions": {"GET": "read AND NOT guest"}}
+		}}`)
+	var err error
+	if s.sessions, err = newSessionValidator(&c.Auth.SessionJWT); err != nil {
+		t.Fatal(err)
+	}
+	s.decisions = newDecisionCache(&c.Auth)
+
+	reader := signTestJWT(t, "EdDSA", "k1", key, sessionClaims(map[string]interface{}{"uid": 1, "permissions": "read"}))
+	guest := signTestJWT(t, "EdDSA", "k1", key, sessionClaims(map[string]interface{}{"uid": 2, "permissions": "read guest"}))
+	admin := signTestJWT(t, "EdDSA", "k1", key, sessionClaims(map[string]interface{}{"uid": 3, "permissions": "admin"}))
+
+	// A session that only imqsauth understands. Its answers are already in the decision cache.
+	s.decisions.put(sessionCacheKey(s.decisions, "opaque"), "read", http.StatusForbidden, "Permission denied", nil)
+	s.decisions.put(sessionCacheKey(s.decisions, "opaque"), "admin", http.StatusOK, "", &serviceauth.Token{UserID: 4})
+
+	expect := func(method, path, session string, code int) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		if w.Code != code {
+			t.Errorf("%v %v: expected %v, but got %v %v", method, path, code, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	expect("GET", "/docs/a", reader, 200)
+	expect("POST", "/docs/a", reader, 403)
+	expect("DELETE", "/docs/a", reader, 403)
+	expect("POST", "/docs/a", admin, 200)
+	expect("GET", "/docs/a", admin, 200)
+	expect("GET", "/docs/a", "opaque", 200)
+	expect("DELETE", "/docs/a", "opaque", 200)
+
+	// The route's rule for GET (and HEAD) takes precedence, and other methods fall back to the target
+	expect("GET", "/drafts/a", reader, 200)
+	expect("GET", "/drafts/a", guest, 403)
+	expect("HEAD", "/drafts/a", guest, 403)
+	expect("GET", "/drafts/a", admin, 403)
+	expect("GET", "/drafts/a", "opaque", 403)
+	expect("POST", "/drafts/a", admin, 200)
+	expect("POST", "/drafts/a", guest, 403)
+
+	// An expression that only needs a permission to be absent still needs a logged in user
+	onlyNot, _ := parsePermissionExpr("NOT read")
+	check := func(session string) (*identity, int) {
+		req := httptest.NewRequest("GET", "/x", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		w := httptest.NewRecorder()
+		id, _ := s.authorize(w, req, onlyNot)
+		return id, w.Code
+	}
+	s.decisions.put(sessionCacheKey(s.decisions, "opaque"), "", http.StatusOK, "", &serviceauth.Token{UserID: 4})
+	if id, _ := check("opaque"); id == nil || id.token == nil || id.token.UserID != 4 {
+		t.Errorf("Expected the user behind a NOT-only expression to be known, but got %+v", id)
+	}
+	s.decisions.put(sessionCacheKey(s.decisions, "expired"), "read", http.StatusForbidden, "Permission denied", nil)
+	s.decisions.put(sessionCacheKey(s.decisions, "expired"), "", http.StatusUnauthorized, "Not logged in", nil)
+	if id, code := check("expired"); id != nil || code != http.StatusUnauthorized {
+		t.Errorf("Expected a NOT-only expression to require a session, but got %+v %v", id, code)
+	}
+
+	expectTargetErrors(t, "RequirePermission", `"read OR"`)
+	expectTargetErrors(t, "MethodPermissions", `{"GET": ""}`, `{"GET": "a", "get,POST": "b"}`)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+const maxRateLimitBuckets = 100000
+
+// What a rate limit is keyed on
+const (
+	rateLimitKeyIP     = "IP"
+	rateLimitKeyUser   = "User"
+	rateLimitKeyAPIKey = "APIKey"
+	rateLimitKeyHeader = "Header:" // Followed by the name of the header
+)
+
+// rateLimit is a token bucket limit on a target or route. Every client, as identified by the limit's
+// key, gets its own bucket, which holds up to burst tokens, and refills at rate tokens per second.
+// A request takes one token, and is rejected with 429 if the bucket is empty.
+type rateLimit struct {
+	scope  string // Distinguishes the buckets of this limit from those of other limits, eg "route:/api/(.*)"
+	rate   float64
+	burst  float64
+	key    string // One of the rateLimitKey constants. For rateLimitKeyHeader, this is the header name.
+	header bool   // True if key is a header name
+	store  *rateLimitStore
+}
+
+// Returns nil if the config has no limit
+func newRateLimit(c *ConfigRateLimit, scope string, store *rateLimitStore) (*rateLimit, error) {
+	if c.Rate == 0 {
+		if c.Burst != 0 || c.Key != "" {
+			return nil, fmt.Errorf("RateLimit needs a Rate")
+		}
+		return nil, nil
+	}
+	if c.Rate < 0 || c.Burst < 0 {
+		return nil, fmt.Errorf("RateLimit Rate and Burst may not be negative")
+	}
+	l := &rateLimit{
+		scope: scope,
+		rate:  c.Rate,
+		burst: float64(c.Burst),
+		key:   c.Key,
+		store: store,
+	}
+	if l.burst == 0 {
+		l.burst = math.Max(1, math.Ceil(c.Rate))
+	}
+	switch {
+	case l.key == "":
+		l.key = rateLimitKeyIP
+	case l.key == rateLimitKeyIP || l.key == rateLimitKeyUser || l.key == rateLimitKeyAPIKey:
+	case strings.HasPrefix(l.key, rateLimitKeyHeader) && len(l.key) > len(rateLimitKeyHeader):
+		l.key = l.key[len(rateLimitKeyHeader):]
+		l.header = true
+	default:
+		return nil, fmt.Errorf("RateLimit Key must be IP, User, APIKey, or Header:<name>")
+	}
+	return l, nil
+}
+
+// Who a request is from. A limit whose key is missing from the request falls back to the client's IP address.
+type rateLimitClient struct {
+	req      *http.Request
+	authData *serviceauth.Token // nil if the request has no IMQS session
+	apiKey   string             // Name of the API key, if the request used one
+}
+
+func (l *rateLimit) clientKey(c *rateLimitClient) string {
+	switch {
+	case l.header:
+		if v := c.req.Header.Get(l.key); v != "" {
+			return "header:" + v
+		}
+	case l.key == rateLimitKeyUser:
+		if c.authData != nil {
+			if c.authData.UserID != 0 {
+				return "user:" + strconv.Itoa(c.authData.UserID)
+			}
+			if c.authData.Username != "" {
+				return "username:" + c.authData.Username
+			}
+		}
+	case l.key == rateLimitKeyAPIKey:
+		if c.apiKey != "" {
+			return "apikey:" + c.apiKey
+		}
+	}
+	return "ip:" + remoteIP(c.req)
+}
+
+// The outcome of taking a token
+type rateLimitResult struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration // Until the bucket is full again
+	retryAfter time.Duration // Until the next token is available. Zero if allowed.
+}
+
+func (l *rateLimit) take(c *rateLimitClient) rateLimitResult {
+	return l.store.take(l.scope+"|"+l.clientKey(c), l.rate, l.burst)
+}
+
+// Set the RateLimit-* headers, which tell well behaved clients how to pace themselves
+func (r *rateLimitResult) setHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(r.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(r.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(r.reset.Seconds()))))
+}
+
+// rateLimitStore holds the token buckets of all limits. When it is full, the least recently used
+// bucket is dropped. A dropped bucket is full when it comes back, so the bound only ever makes
+// limits more lenient, and only for clients that have been quiet for a while.
+type rateLimitStore struct {
+	maxBuckets int
+	now        func() time.Time
+
+	lock    sync.Mutex
+	lru     *list.List // Most recently used at the front. Values are *tokenBucket.
+	buckets map[string]*list.Element
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimitStore(maxBuckets int) *rateLimitStore {
+	return &rateLimitStore{
+		maxBuckets: maxBuckets,
+		now:        time.Now,
+		lru:        list.New(),
+		buckets:    map[string]*list.Element{},
+	}
+}
+
+func (s *rateLimitStore) take(key string, rate, burst float64) rateLimitResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.now()
+	var b *tokenBucket
+	if el := s.buckets[key]; el != nil {
+		s.lru.MoveToFront(el)
+		b = el.Value.(*tokenBucket)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	} else {
+		if s.lru.Len() >= s.maxBuckets {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		b = &tokenBucket{key: key, tokens: burst, last: now}
+		s.buckets[key] = s.lru.PushFront(b)
+	}
+
+	result := rateLimitResult{limit: int(burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.allowed = true
+	} else {
+		result.retryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	result.remaining = int(b.tokens)
+	result.reset = time.Duration((burst - b.tokens) / rate * float64(time.Second))
+	return result
+}
+
+// Apply the rate limits of the route and its target. Returns false if the request was rejected,
+// in which case a 429 has already been sent.
+func (s *Server) checkRateLimits(w http.ResponseWriter, route *route, client *rateLimitClient) bool {
+	var strictest *rateLimitResult
+	for _, limit := range []*rateLimit{route.rateLimit, route.target.rateLimit} {
+		if limit == nil {
+			continue
+		}
+		result := limit.take(client)
+		if !result.allowed {
+			result.setHeaders(w.Header())
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.retryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return false
+		}
+		if strictest == nil || result.remaining < strictest.remaining {
+			strictest = &result
+		}
+	}
+	if strictest != nil {
+		strictest.setHeaders(w.Header())
+	}
+	return true
+}
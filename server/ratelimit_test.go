@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	backend := newOKBackend(t)
+
+	s, c := newTestServer(t, `{
+		"Targets": {"API": {"URL": "`+backend.URL+`", "RateLimit": {"Rate": 1, "Burst": 3, "Key": "Header:X-Tenant"}}},
+		"Routes": {
+			"/api/(.*)": "{API}/$1",
+			"/slow/(.*)": {"Target": "{API}/$1", "RateLimit": {"Rate": 0.5, "Burst": 1}}
+		}}`)
+	now := time.Now()
+	s.translator.allRoutes()[0].target.rateLimit.store.now = func() time.Time { return now }
+
+	send := func(path, from, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = from
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		return w
+	}
+	expect := func(path, from, tenant string, code int, remaining string) {
+		t.Helper()
+		w := send(path, from, tenant)
+		if w.Code != code || w.Header().Get("RateLimit-Remaining") != remaining {
+			t.Errorf("%v from %v (%v): expected %v with %v remaining, but got %v with %v remaining", path, from, tenant, code, remaining, w.Code, w.Header().Get("RateLimit-Remaining"))
+		}
+	}
+
+	// The target's limit is per tenant, regardless of address
+	expect("/api/x", "10.0.0.1:1000", "a", 200, "2")
+	expect("/api/x", "10.0.0.2:1000", "a", 200, "1")
+	expect("/api/x", "10.0.0.3:1000", "a", 200, "0")
+	w := send("/api/x", "10.0.0.1:1000", "a")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || w.Header().Get("RateLimit-Limit") != "3" {
+		t.Errorf("Expected 429 with Retry-After, but got %v %v", w.Code, w.Header())
+	}
+	expect("/api/x", "10.0.0.1:1000", "b", 200, "2")
+
+	// Tokens come back over time
+	now = now.Add(time.Second)
+	expect("/api/x", "10.0.0.1:1000", "a", 200, "0")
+
+	// The route's limit is per address, and applies on top of the target's
+	expect("/slow/x", "10.0.0.5:1000", "c", 200, "0")
+	w = send("/slow/x", "10.0.0.5:1000", "d")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected 429 with Retry-After 2, but got %v %v", w.Code, w.Header())
+	}
+	expect("/slow/x", "10.0.0.6:1000", "d", 200, "0")
+
+	// The number of buckets is bounded, and the least recently used bucket goes first
+	store := newRateLimitStore(2)
+	store.take("a", 1, 1)
+	store.take("b", 1, 1)
+	store.take("a", 1, 1)
+	store.take("c", 1, 1)
+	if store.lru.Len() != 2 || store.buckets["b"] != nil || store.buckets["a"] == nil {
+		t.Errorf("Expected the least recently used bucket to be evicted")
+	}
+
+	c = &Config{}
+	c.LoadString(`{"Targets": {"X": {"URL": "http://a", "RateLimit": {"Rate": 1, "Key": "Cookie"}}}}`)
+	if _, err := newUrlTranslator(c); err == nil || !strings.Contains(err.Error(), "RateLimit Key") {
+		t.Errorf("Expected an unknown Key to fail, but got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+const defaultReloadInterval = 10 // seconds
+
+// reloadingFile holds the parsed contents of a file, and re-reads the file when it changes, so that
+// lists such as API keys can be edited without restarting the router.
+// The file is checked at most once every interval, when somebody asks for its contents. A file that
+// fails to parse is logged, and the previous contents remain in use.
+type reloadingFile struct {
+	filename string
+	interval time.Duration
+	parse    func(data []byte) (interface{}, error)
+	now      func() time.Time
+
+	loadLock sync.Mutex // Held while reloading, so that only one thread does so at a time
+	lock     sync.RWMutex
+	value    interface{}
+	checked  time.Time
+	modTime  time.Time
+	size     int64
+}
+
+// Load the file, which must be valid at startup. interval is in seconds, and zero means the default.
+func newReloadingFile(filename string, interval int, parse func(data []byte) (interface{}, error)) (*reloadingFile, error) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	f := &reloadingFile{
+		filename: filename,
+		interval: time.Duration(interval) * time.Second,
+		parse:    parse,
+		now:      time.Now,
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *reloadingFile) load() error {
+	// Record the attempt even if it fails, so that we don't hammer a broken file
+	f.lock.Lock()
+	f.checked = f.now()
+	f.lock.Unlock()
+
+	st, err := os.Stat(f.filename)
+	if err != nil {
+		return err
+	}
+	f.lock.RLock()
+	unchanged := f.value != nil && st.ModTime().Equal(f.modTime) && st.Size() == f.size
+	f.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(f.filename)
+	if err != nil {
+		return err
+	}
+	value, err := f.parse(data)
+	if err != nil {
+		return fmt.Errorf("Error loading %v: %v", f.filename, err)
+	}
+	f.lock.Lock()
+	f.value = value
+	f.modTime = st.ModTime()
+	f.size = st.Size()
+	f.lock.Unlock()
+	return nil
+}
+
+// Returns the parsed contents of the file, reloading it first if it has changed. If another thread
+// is busy reloading, then we don't wait for it, but carry on with what we have.
+func (f *reloadingFile) get(log *log.Logger) interface{} {
+	f.lock.RLock()
+	stale := f.now().Sub(f.checked) >= f.interval
+	f.lock.RUnlock()
+	if stale && f.loadLock.TryLock() {
+		if err := f.load(); err != nil {
+			log.Errorf("%v. The previous contents are still in use.", err)
+		}
+		f.loadLock.Unlock()
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.value
+}
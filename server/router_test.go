@@ -38,6 +38,9 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -52,6 +55,9 @@ const mainConfig = `
 	"HTTP": {
 		"Port": 5002
 	},
+	"ConfigService": {
+		"Type": "None"
+	},
 	"Targets": {
 		"PORT5000": {
 			"URL": "http://127.0.0.1:5000"
@@ -153,6 +159,52 @@ func TestMethods(t *testing.T) {
 	}
 }
 
+// Start a complete router, with no config service, and no backends other than a local test server.
+func TestStandaloneServer(t *testing.T) {
+	certDir := t.TempDir()
+	back := httptest.NewServer(newBackend())
+	defer back.Close()
+
+	config := &Config{}
+	err := config.LoadString(fmt.Sprintf(`{
+		"AccessLog": "router-access-test.log",
+		"ErrorLog":  "router-error-test.log",
+		"HTTP": {"Port": 5012},
+		"ConfigService": {"Type": "File", "Directory": %q},
+		"Routes": {"/standalone/(.*)": "%v/echo/$1"}
+	}`, certDir, back.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	front, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Could not start server without a config service: %v", err)
+	}
+	go front.ListenAndServe()
+	time.Sleep(200 * time.Millisecond)
+
+	doHttp(t, "GET", "http://127.0.0.1:5012/standalone/abc", "", "Method GET URL /echo/abc BODY ")
+	doHttpFunc(t, "GET", "http://127.0.0.1:5012/router/ping", "", func(t *testing.T, body string) {
+		if !strings.HasPrefix(body, `{"Timestamp":`) {
+			t.Errorf("Unexpected ping response: %v", body)
+		}
+	})
+
+	// The File config service provides certificates from its directory
+	os.WriteFile(filepath.Join(certDir, "ssl.crt"), []byte("certificate"), 0644)
+	certFile := filepath.Join(t.TempDir(), "conf", "ssl.crt")
+	keyFile := filepath.Join(t.TempDir(), "conf", "ssl.key")
+	if err := front.fetchCerts(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(certFile); err != nil || string(b) != "certificate" {
+		t.Errorf("Certificate was not fetched from the File config service: %v, %v", string(b), err)
+	}
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Errorf("Key file should not have been created, because the config service does not hold it")
+	}
+}
+
 /*
 Im leaving this out as it is more a test of the testbox and the tcp protocol than router,
 leaves lots of sockets in time_wait state, allowing following test to fail if run
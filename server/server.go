@@ -17,13 +17,14 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	// "github.com/cespare/hutil/apachelog" // Newer, but doesn't support websockets
 	apachelog "github.com/IMQS/go-apachelog" // Older, but supports websockets. Forked to include time zone in access logs.
 	"github.com/IMQS/log"
+	"github.com/IMQS/router/signing"
 	"github.com/IMQS/serviceauth"
-	serviceconfig "github.com/IMQS/serviceconfigsgo"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/websocket"
@@ -40,6 +41,18 @@ type Server struct {
 	errorLog      *log.Logger
 	wsdlMatch     *regexp.Regexp // hack for serving static content
 	udpConnPool   *UDPConnectionPool
+	configService configService
+	sessions      *sessionValidator // nil unless session tokens are validated locally
+	decisions     *decisionCache    // nil unless imqsauth decisions are cached
+	tokenStore    *tokenStore       // nil unless pass-through tokens are kept across restarts
+	apiKeys       *apiKeys          // nil unless machine clients may use API keys
+	clientCerts   *clientCertAuth   // nil unless the HTTPS listener verifies client certificates
+	blocklist     *blocklist        // Requests that are refused before routing
+	idSigner      *identitySigner   // nil unless identity tokens are forwarded to backends
+	stop          chan struct{}     // Closed when the server shuts down, to stop background work
+	stopOnce      sync.Once         // Close only does its work once
+	status        statusAccess      // Who may read /router/status
+	proxies       trustedProxies    // Reverse proxies whose X-Forwarded-For we believe
 }
 
 type frontServer struct {
@@ -55,6 +68,7 @@ func (f *frontServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func NewServer(config *Config) (*Server, error) {
 	var err error
 	s := &Server{}
+	s.stop = make(chan struct{})
 	s.configHttp = config.HTTP
 	s.udpConnPool = NewUDPConnectionPool()
 
@@ -83,15 +97,48 @@ func NewServer(config *Config) (*Server, error) {
 		return s.translator.getProxy(s.errorLog, req.URL.Host)
 	}
 
+	if s.configService, err = newConfigService(&config.ConfigService); err != nil {
+		return nil, err
+	}
+
+	if s.sessions, err = newSessionValidator(&config.Auth.SessionJWT); err != nil {
+		return nil, err
+	}
+	s.decisions = newDecisionCache(&config.Auth)
+	if s.proxies, err = newTrustedProxies(config.HTTP.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if s.status, err = newStatusAccess(&config.Status); err != nil {
+		return nil, err
+	}
+	if s.blocklist, err = newBlocklist(&config.Blocklist); err != nil {
+		return nil, err
+	}
+	if s.clientCerts, err = newClientCertAuth(&config.HTTP.ClientCerts, config.Auth.ClientCertRules); err != nil {
+		return nil, err
+	}
+	if s.apiKeys, err = newAPIKeys(&config.Auth.APIKeys); err != nil {
+		return nil, err
+	}
+	if s.idSigner, err = newIdentitySigner(&config.Auth.IdentityJWT); err != nil {
+		return nil, err
+	}
+	if s.tokenStore, err = newTokenStore(&config.Auth.TokenStore); err != nil {
+		return nil, err
+	}
+	if s.tokenStore != nil {
+		s.tokenStore.load(s.passThroughTargets(), s.errorLog)
+	}
+
 	// Set both the host and port as system config variables
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
-	if err := serviceconfig.AddSystemVariableToConfigService("router_http_host", hostname); err != nil {
+	if err := s.configService.addSystemVariable("router_http_host", hostname); err != nil {
 		return nil, err
 	}
-	if err := serviceconfig.AddSystemVariableToConfigService("router_http_port", getRouterPort(s.configHttp.Port)); err != nil {
+	if err := s.configService.addSystemVariable("router_http_port", getRouterPort(s.configHttp.Port)); err != nil {
 		return nil, err
 	}
 
@@ -126,6 +173,8 @@ func (s *Server) ListenAndServe() error {
 		}
 	}
 
+	s.startTokenRefresh()
+
 	errors := make(chan error)
 	defer close(errors)
 
@@ -148,16 +197,17 @@ func (s *Server) ListenAndServe() error {
 		var err error
 		for {
 			if secure {
-				if serviceconfig.IsContainer() {
-					err = fetchCerts(s.configHttp.CertFile, s.configHttp.CertKeyFile)
-					if err != nil {
-						break
-					}
+				err = s.fetchCerts(s.configHttp.CertFile, s.configHttp.CertKeyFile)
+				if err != nil {
+					break
 				}
 				hs.TLSConfig = &tls.Config{
 					MinVersion:               tls.VersionTLS12,
 					PreferServerCipherSuites: true,
 				}
+				if s.clientCerts != nil {
+					s.clientCerts.apply(hs.TLSConfig)
+				}
 				err = hs.ListenAndServeTLS(s.configHttp.CertFile, s.configHttp.CertKeyFile)
 			} else {
 				err = hs.ListenAndServe()
@@ -189,38 +239,24 @@ func (s *Server) ListenAndServe() error {
 	return nil
 }
 
-// Fetches the certs from the config service and stores them locally
-func fetchCerts(certPath, certKeyPath string) error {
-	var err error
-	//create the directories
-	err = os.MkdirAll(filepath.Dir(certPath), os.ModePerm)
-	if err != nil {
-		return err
-	}
-	err = os.MkdirAll(filepath.Dir(certKeyPath), os.ModePerm)
-	if err != nil {
-		return err
-	}
-
-	//fetch the file contents and store them in the paths supplied
-	bytes, err := serviceconfig.GetConfigJson("", serviceName, serviceConfigVersion, filepath.Base(certPath), false)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(certPath, bytes, os.ModePerm)
-	if err != nil {
-		return err
-	}
-
-	bytes, err = serviceconfig.GetConfigJson("", serviceName, serviceConfigVersion, filepath.Base(certKeyPath), false)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(certKeyPath, bytes, os.ModePerm)
-	if err != nil {
-		return err
+// Fetches the certs from the config service and stores them locally.
+// If the config service has no certs to offer, then we use whatever is already on disk.
+func (s *Server) fetchCerts(certPath, certKeyPath string) error {
+	for _, path := range []string{certPath, certKeyPath} {
+		bytes, err := s.configService.fetchFile(filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		if bytes == nil {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.WriteFile(path, bytes, os.ModePerm); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
@@ -241,15 +277,10 @@ func (s *Server) autoRestartAfterError(err error) bool {
 	return false
 }
 
-// Detect illegal requests
-func (s *Server) isLegalRequest(req *http.Request) bool {
-	// We were getting a whole lot of requests to the 'telco' server where the hostname was "yahoo.mail.com".
-	// TODO: move this to blacklist config file
-	if req.URL.Host == "yahoo.mail.com" {
-		s.errorLog.Errorf("Illegal hostname (%s) - closing connection", req.URL.Host)
-		return false
-	}
-	return true
+// Detect illegal requests, as described by the Blocklist section of the config.
+// Returns the reason for refusing the request, or an empty string if it is legal.
+func (s *Server) isLegalRequest(req *http.Request) string {
+	return s.blocklist.check(s.errorLog, req)
 }
 
 // ServeHTTP is the single router access point to the frontdoor server. All
@@ -257,6 +288,9 @@ func (s *Server) isLegalRequest(req *http.Request) bool {
 // and then switches on scheme type to connect to the backend copying between
 // these pipes.
 func (s *Server) ServeHTTP(isSecure bool, w http.ResponseWriter, req *http.Request) {
+	// Everything below that cares about the client's address sees the real client, not our proxy
+	req = s.proxies.resolve(req)
+
 	// HACK! Doesn't belong here!
 	// Catch wsdl here to statically serve.
 	filename := s.wsdlMatch.FindString(req.RequestURI)
@@ -266,8 +300,8 @@ func (s *Server) ServeHTTP(isSecure bool, w http.ResponseWriter, req *http.Reque
 	}
 
 	// Detect malware, DOS, etc
-	if !s.isLegalRequest(req) {
-		http.Error(w, "", http.StatusTeapot)
+	if reason := s.isLegalRequest(req); reason != "" {
+		s.blocklist.block(s.errorLog, w, req, reason)
 		return
 	}
 
@@ -305,8 +339,27 @@ func (s *Server) ServeHTTP(isSecure bool, w http.ResponseWriter, req *http.Reque
 		s.Pong(w, req)
 		return
 	}
+	if req.RequestURI == "/router/status" {
+		s.serveStatus(w, req)
+		return
+	}
+
+	// Forget cached permissions when a session logs out. We do this again once the logout has
+	// gone through, in case a concurrent request re-populated the cache in the meantime.
+	if s.decisions != nil && req.URL.Path == s.decisions.logoutPath {
+		if token := s.decisions.tokenOf(req); token != "" {
+			s.decisions.evictSession(token)
+			defer s.decisions.evictSession(token)
+		}
+	}
+
+	// The key must be removed before the route is rewritten, in case it's in the query string
+	apiKey := ""
+	if s.apiKeys != nil {
+		apiKey = s.apiKeys.extract(req)
+	}
 
-	newurl, requirePermission, passThroughAuth := s.translator.processRoute(req.URL)
+	newurl, route := s.translator.processRoute(req.URL)
 
 	if s.debugRoutes {
 		s.errorLog.Infof("(%v) -> (%v)", req.RequestURI, newurl)
@@ -317,8 +370,64 @@ func (s *Server) ServeHTTP(isSecure bool, w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	authData, authOK := s.authorize(w, req, requirePermission)
-	if !authOK {
+	if !route.allowsIP(req, net.ParseIP(remoteIP(req))) {
+		s.blocklist.block(s.errorLog, w, req, blockReasonIP)
+		return
+	}
+
+	if basic := route.basicAuthRules(); basic != nil && !basic.authorize(s.errorLog, w, req) {
+		return
+	}
+
+	requirePermission := route.requiredPermission(req)
+	passThroughAuth := &route.target.auth
+
+	// A client certificate may take the place of an IMQS session
+	stripClientCertHeaders(req)
+	certGranted := false
+	if s.clientCerts != nil {
+		var certOK bool
+		if certGranted, certOK = s.authorizeClientCert(w, req, route); !certOK {
+			return
+		}
+	}
+
+	// A route that accepts API keys, but doesn't require a permission, would otherwise be open to
+	// everybody, so an API key is required in that case.
+	var id *identity
+	apiKeyName := ""
+	switch {
+	case certGranted:
+	case s.apiKeys != nil && route.acceptsAPIKeys() && (apiKey != "" || requirePermission == nil):
+		var keyOK bool
+		if apiKeyName, keyOK = s.authorizeAPIKey(w, req, apiKey, route); !keyOK {
+			return
+		}
+	default:
+		var authOK bool
+		if id, authOK = s.authorize(w, req, requirePermission); !authOK {
+			return
+		}
+	}
+	var authData *serviceauth.Token
+	if id != nil {
+		authData = id.token
+	}
+
+	// Limits are applied after authentication, so that they can be keyed on who the client is
+	if !s.checkRateLimits(w, route, &rateLimitClient{req: req, authData: authData, apiKey: apiKeyName}) {
+		return
+	}
+
+	if owner := route.ownerRule(); owner != nil && !owner.check(w, req, id) {
+		return
+	}
+
+	if !s.forwardIdentity(w, req, route.target, id) {
+		return
+	}
+
+	if audit := route.auditRules(); audit != nil && !audit.record(s.errorLog, w, req, authData) {
 		return
 	}
 
@@ -326,15 +435,26 @@ func (s *Server) ServeHTTP(isSecure bool, w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	switch parseScheme(newurl, &req.Header) {
+	scheme := parseScheme(newurl, &req.Header)
+	switch scheme {
+	case schemeHTTP, schemeHTTPS, schemeHTTPSSE, schemeHTTPSSSE:
+		if route.target.concurrency != nil {
+			if !s.acquireTargetSlot(w, req, route.target) {
+				return
+			}
+			defer route.target.concurrency.release()
+		}
+	}
+
+	switch scheme {
 	case schemeHTTPSSE:
 		fallthrough
 	case schemeHTTPSSSE:
-		s.forwardHttpSse(w, req, newurl)
+		s.forwardHttpSse(w, req, newurl, passThroughAuth, route.target.signer)
 	case schemeHTTP:
 		fallthrough
 	case schemeHTTPS:
-		s.forwardHttp(w, req, newurl)
+		s.forwardHttp(w, req, newurl, passThroughAuth, authData, route.target.signer)
 	case schemeWS:
 		s.forwardWebsocket(w, req, newurl)
 	case schemeUDP:
@@ -354,7 +474,7 @@ func (s *Server) ServeHTTP(isSecure bool, w http.ResponseWriter, req *http.Reque
 //     is limited on the front-end to 100 (not the 6 of http 1.1)
 //  2. this can be viewed as a lite weight single direction websocket where the only
 //     purpose is to keep the user informed of long running transaction (if they so choose)
-func (s *Server) forwardHttpSse(w http.ResponseWriter, req *http.Request, newurl string) {
+func (s *Server) forwardHttpSse(w http.ResponseWriter, req *http.Request, newurl string, auth *targetPassThroughAuth, signer *signing.Signer) {
 	cleaned, err := http.NewRequest(req.Method, newurl, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -369,6 +489,13 @@ func (s *Server) forwardHttpSse(w http.ResponseWriter, req *http.Request, newurl
 	}
 
 	s.addXOriginalPath(req, cleaned)
+	if !signRequest(w, cleaned, signer) {
+		return
+	}
+	// Providers that sign the outgoing request, such as SigV4, must sign this one too
+	if !authPassThroughOutgoing(s.errorLog, w, cleaned, auth) {
+		return
+	}
 
 	settings := []http2.Setting{
 		{ID: http2.SettingMaxConcurrentStreams, Val: 10},
@@ -456,32 +583,30 @@ router would react to the "Connection: close" header by closing the TCP connecti
 the response was sent. This would then result in s.httpTransport.RoundTrip(cleaned) returning
 an EOF error when it tried to re-use that TCP connection.
 */
-func (s *Server) forwardHttp(w http.ResponseWriter, req *http.Request, newurl string) {
-	cleaned, err := http.NewRequest(req.Method, newurl, req.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+func (s *Server) forwardHttp(w http.ResponseWriter, req *http.Request, newurl string, auth *targetPassThroughAuth, authData *serviceauth.Token, signer *signing.Signer) {
+	// If the backend may reject our pass-through credentials, then be ready to send the request a second time
+	canRetry := auth != nil && auth.invalidateOn != nil && prepareRetry(req)
 
-	// srcHost := req.Host     // Client address.
-	// dstHost := cleaned.Host // Destination address, e.g. 127.0.0.1:5984.
-
-	// Copy headers from client req into cleaned req, replacing Location header value if found.
-	copyheadersIn(req.Header, cleaned.Header)
-	cleaned.Proto = req.Proto
-	cleaned.ContentLength = req.ContentLength
-
-	if remoteAddrNoPort, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		cleaned.Header.Add("X-Forwarded-For", remoteAddrNoPort)
+	resp, cleaned, ok := s.roundTrip(w, req, newurl, auth, signer)
+	if !ok {
+		return
 	}
 
-	s.addXOriginalPath(req, cleaned)
-
-	resp, err := s.httpTransport.RoundTrip(cleaned)
-	if err != nil {
-		s.errorLog.Info("HTTP RoundTrip error: " + err.Error())
-		http.Error(w, err.Error(), http.StatusGatewayTimeout)
-		return
+	if auth != nil && auth.invalidateOn != nil && auth.invalidateOn.rejected(resp) {
+		s.errorLog.Infof("Backend %v rejected our pass-through credentials. Discarding them.", cleaned.URL.Host)
+		auth.provider.(passThroughInvalidator).invalidate(cleaned)
+		if canRetry {
+			resp.Body.Close()
+			if !authPassThrough(s.errorLog, w, req, authData, auth) {
+				return
+			}
+			if req.GetBody != nil {
+				req.Body, _ = req.GetBody()
+			}
+			if resp, _, ok = s.roundTrip(w, req, newurl, auth, signer); !ok {
+				return
+			}
+		}
 	}
 
 	var responseWriter io.Writer = w
@@ -540,6 +665,44 @@ func (s *Server) forwardHttp(w http.ResponseWriter, req *http.Request, newurl st
 	}
 }
 
+// Send req to the backend at newurl, signed by signer if it is not nil. If this fails, then an error
+// response is sent to w, and ok is false. auth may be nil.
+func (s *Server) roundTrip(w http.ResponseWriter, req *http.Request, newurl string, auth *targetPassThroughAuth, signer *signing.Signer) (resp *http.Response, cleaned *http.Request, ok bool) {
+	cleaned, err := http.NewRequest(req.Method, newurl, req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	// srcHost := req.Host     // Client address.
+	// dstHost := cleaned.Host // Destination address, e.g. 127.0.0.1:5984.
+
+	// Copy headers from client req into cleaned req, replacing Location header value if found.
+	copyheadersIn(req.Header, cleaned.Header)
+	cleaned.Proto = req.Proto
+	cleaned.ContentLength = req.ContentLength
+
+	if remoteAddrNoPort, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		cleaned.Header.Add("X-Forwarded-For", remoteAddrNoPort)
+	}
+
+	s.addXOriginalPath(req, cleaned)
+	if !signRequest(w, cleaned, signer) {
+		return nil, nil, false
+	}
+	if !authPassThroughOutgoing(s.errorLog, w, cleaned, auth) {
+		return nil, nil, false
+	}
+
+	resp, err = s.httpTransport.RoundTrip(cleaned)
+	if err != nil {
+		s.errorLog.Info("HTTP RoundTrip error: " + err.Error())
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return nil, nil, false
+	}
+	return resp, cleaned, true
+}
+
 /*
 forwardWebsocket does for websockets what forwardHTTP does for http requests. A new socket connection is made to the backend and messages are forwarded both ways.
 */
@@ -624,6 +787,7 @@ func (s *Server) forwardUDP(w http.ResponseWriter, req *http.Request, newurl str
 // Example replaced Path: /reload_schema
 // In this example, we will set "X-Original-Path: /crud/reload_schema"
 // original and modified may be the same object
+// A client may not send its own X-Original-Path, because backends that verify signatures trust it.
 func (s *Server) addXOriginalPath(original *http.Request, modified *http.Request) {
 	// I originally thought that RawPath was the right thing to use here, but it turns out that url.Parse/url.ParseRequestURI will only set
 	// RawPath if EscapedPath() is different from RawPath. This header was originally added for our request signing system, so that
@@ -634,15 +798,20 @@ func (s *Server) addXOriginalPath(original *http.Request, modified *http.Request
 		rawPath = original.RequestURI[:question]
 	}
 	// fmt.Printf("%v\n", rawPath)
-	modified.Header.Add("X-Original-Path", rawPath)
+	modified.Header.Set("X-Original-Path", rawPath)
 }
 
 // Returns true if the request should continue to be passed through the router
 // We make a round-trip to imqsauth here to check the credentials of the incoming request.
 // This adds about a 0.5ms latency to the request. It might be worthwhile to embed
 // imqsauth inside imqsrouter.
-func (s *Server) authorize(w http.ResponseWriter, req *http.Request, requirePermission string) (authData *serviceauth.Token, authOK bool) {
-	if requirePermission == "" {
+// If Auth.SessionJWT is configured, then signed session tokens are validated locally instead,
+// and imqsauth is only consulted for tokens that we can't validate ourselves.
+// If Auth.DecisionCache is configured, then the answers from imqsauth are cached for a few seconds.
+// An expression that names several permissions may need one round-trip per permission.
+// The identity is nil if the request is not from an IMQS user.
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request, required *permissionExpr) (id *identity, authOK bool) {
+	if required == nil {
 		return nil, true
 	}
 
@@ -650,9 +819,63 @@ func (s *Server) authorize(w http.ResponseWriter, req *http.Request, requirePerm
 		return nil, true
 	}
 
-	if httpCode, errorMsg, authData := serviceauth.VerifyUserHasPermission(req, requirePermission); httpCode == http.StatusOK {
-		return authData, true
+	if s.sessions != nil {
+		if token := sessionTokenFromRequest(req, s.sessions.config.Cookie); looksLikeJWT(token) {
+			session, err := s.sessions.validate(token)
+			if err == nil {
+				if required.evalSet(session.permissions) {
+					return &identity{token: session.token, permissions: sortedPermissions(session.permissions), tenant: session.tenant}, true
+				}
+				http.Error(w, "Permission denied", http.StatusForbidden)
+				return nil, false
+			} else if err != errJWTUnknownKey {
+				s.errorLog.Infof("Session token rejected: %v", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return nil, false
+			}
+			// Not signed by any key that we know, so let imqsauth decide
+		}
+	}
+
+	// Ask imqsauth about each permission that the expression needs. A 403 means that the user
+	// lacks the permission, and any other failure ends the evaluation.
+	cacheToken := ""
+	if s.decisions != nil {
+		cacheToken = s.decisions.tokenOf(req)
+	}
+	var httpCode int
+	var errorMsg string
+	var authData *serviceauth.Token
+	var permissions []string
+	granted, _ := required.eval(func(permission string) (bool, error) {
+		var data *serviceauth.Token
+		httpCode, errorMsg, data = s.askImqsauth(req, cacheToken, permission)
+		switch httpCode {
+		case http.StatusOK:
+			authData = data
+			permissions = append(permissions, permission)
+			return true, nil
+		case http.StatusForbidden:
+			return false, nil
+		}
+		return false, errPermissionCheckFailed
+	})
+
+	if granted && authData == nil {
+		// The expression was satisfied only by permissions that the user lacks, and a 403 doesn't tell us
+		// who the user is, or whether they are logged in at all. A check without a permission does.
+		httpCode, errorMsg, authData = s.askImqsauth(req, cacheToken, "")
+		granted = httpCode == http.StatusOK
+	}
+
+	if granted {
+		// imqsauth only tells us about the permissions that we asked for
+		return &identity{token: authData, permissions: permissions}, true
 	} else { // Not OK
+		if httpCode == http.StatusOK {
+			// Every permission that we asked about was granted, but the expression wants one of them to be absent
+			httpCode, errorMsg = http.StatusForbidden, "Permission denied"
+		}
 		if httpCode == http.StatusUnauthorized {
 			s.errorLog.Info(errorMsg) // we expect some unauthorized requests, so don't log them as errors
 		} else {
@@ -663,12 +886,60 @@ func (s *Server) authorize(w http.ResponseWriter, req *http.Request, requirePerm
 	}
 }
 
+// Ask imqsauth whether the user has a permission, unless we've recently asked the same question for this session
+func (s *Server) askImqsauth(req *http.Request, cacheToken, permission string) (httpCode int, errorMsg string, authData *serviceauth.Token) {
+	if cacheToken != "" {
+		if cached := s.decisions.get(cacheToken, permission); cached != nil {
+			return cached.httpCode, cached.errorMsg, cached.authData
+		}
+	}
+	httpCode, errorMsg, authData = serviceauth.VerifyUserHasPermission(req, permission)
+	if cacheToken != "" {
+		s.decisions.put(cacheToken, permission, httpCode, errorMsg, authData)
+	}
+	return
+}
+
 func (s *Server) Pong(w http.ResponseWriter, req *http.Request) {
 	timestamp := time.Now().Unix()
 	fmt.Fprintf(w, `{"Timestamp":%v}`, timestamp)
 }
 
-func (s *Server) close() {
+// Close stops background work, such as the renewal of pass-through tokens, and saves the token store.
+// Call it before the process exits. The listeners are not stopped (see "Stopping A Server").
+func (s *Server) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		if s.tokenStore != nil {
+			if err := s.tokenStore.save(s.passThroughTargets()); err != nil {
+				s.errorLog.Errorf("Unable to save token store: %v", err)
+			}
+		}
+	})
+}
+
+// Returns the named targets that have pass-through auth, keyed on name
+func (s *Server) passThroughTargets() map[string]*target {
+	targets := map[string]*target{}
+	for _, r := range s.translator.allRoutes() {
+		if r.target.name != "" && r.target.auth.provider != nil {
+			targets[r.target.name] = r.target
+		}
+	}
+	return targets
+}
+
+// Renew shared pass-through tokens in the background, so that requests don't wait for them,
+// and save them periodically if the token store is enabled
+func (s *Server) startTokenRefresh() {
+	for _, t := range s.passThroughTargets() {
+		if holder, ok := t.auth.provider.(sharedTokenHolder); ok {
+			go holder.passThroughToken().refreshLoop(s.errorLog, s.stop)
+		}
+	}
+	if s.tokenStore != nil {
+		go s.tokenStore.saveLoop(s.passThroughTargets(), s.errorLog, s.stop)
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/IMQS/router/signing"
+)
+
+// Returns nil if the target doesn't sign the requests that we forward to it
+func newRequestSigner(c *ConfigSigning) (*signing.Signer, error) {
+	if c.Secret == "" {
+		if len(c.Headers) != 0 || c.MaxBodySize != 0 {
+			return nil, fmt.Errorf("Signing needs a Secret")
+		}
+		return nil, nil
+	}
+	if len(c.Secret) < signing.MinSecretLength {
+		return nil, fmt.Errorf("Signing Secret must be at least %v characters long", signing.MinSecretLength)
+	}
+	if c.MaxBodySize < 0 {
+		return nil, fmt.Errorf("Signing MaxBodySize may not be negative")
+	}
+	headers := c.Headers
+	if headers == nil {
+		headers = []string{"Content-Type"}
+	}
+	return &signing.Signer{
+		Secret:      []byte(c.Secret),
+		Headers:     headers,
+		MaxBodySize: c.MaxBodySize,
+	}, nil
+}
+
+// Sign a request that is about to be sent to a backend. Returns false if it can't be signed, in which
+// case an error has already been sent. A nil signer does nothing.
+func signRequest(w http.ResponseWriter, outgoing *http.Request, signer *signing.Signer) bool {
+	if signer == nil {
+		return true
+	}
+	if err := signer.Sign(outgoing, outgoing.Header.Get(signing.HeaderOriginalPath)); err != nil {
+		if err == signing.ErrBodyTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/IMQS/router/signing"
+)
+
+func TestRequestSigning(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+	verifier := &signing.Verifier{Secrets: [][]byte{[]byte(secret)}, RequireHeaders: []string{"X-IMQS-User-ID"}}
+	backend := httptest.NewServer(verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Header.Get("X-Original-Path") + " " + string(body)))
+	})))
+	defer backend.Close()
+
+	s, _ := newTestServer(t, `{
+		"Targets": {
+			"SIGNED": {"URL": "`+backend.URL+`", "Signing": {"Secret": "`+secret+`", "Headers": ["Content-Type", "X-IMQS-User-ID"], "MaxBodySize": 10}},
+			"UNSIGNED": {"URL": "`+backend.URL+`"}
+		},
+		"Routes": {"/signed/(.*)": "{SIGNED}/$1", "/unsigned/(.*)": "{UNSIGNED}/$1"}}`)
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		// Neither of these may fool the backend
+		req.Header.Set("X-Original-Path", "/admin/delete")
+		req.Header.Set(signing.HeaderSignature, strings.Repeat("00", 32))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(false, w, req)
+		return w
+	}
+
+	if w := send("/signed/save?x=1", "hello"); w.Code != http.StatusOK || w.Body.String() != "/signed/save hello" {
+		t.Errorf("Expected the signed request to be accepted, but got %v %v", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	if w := send("/unsigned/save", "hello"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the backend to refuse an unsigned request, but got %v", w.Code)
+	}
+	if w := send("/signed/save", "more than ten bytes"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a large body to be refused, but got %v", w.Code)
+	}
+
+	expectTargetErrors(t, "Signing",
+		`{"Secret": "short"}`,
+		`{"Headers": ["Content-Type"]}`,
+		`{"Secret": "`+secret+`", "MaxBodySize": -1}`,
+	)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/IMQS/serviceauth"
+)
+
+// routerStatus is the body of /router/status. Sections are omitted when the feature that they
+// describe is not enabled.
+type routerStatus struct {
+	DecisionCache *decisionCacheStatus          `json:",omitempty"`
+	PassThrough   map[string]*passThroughStatus `json:",omitempty"` // Keyed on target name
+	Blocked       map[string]int64              `json:",omitempty"` // Number of blocked requests, keyed on reason
+	Concurrency   map[string]*concurrencyStatus `json:",omitempty"` // Keyed on target name
+}
+
+type passThroughStatus struct {
+	Type     AuthPassThroughType
+	Token    *sharedTokenStatus `json:",omitempty"` // For providers that share one token between all users
+	Sessions *int               `json:",omitempty"` // For providers that have a session per user
+}
+
+// Who may read /router/status, besides other services
+type statusAccess struct {
+	permission    *permissionExpr // nil if IMQS users may not
+	allowLoopback bool
+}
+
+func newStatusAccess(c *ConfigStatus) (statusAccess, error) {
+	permission, err := parsePermissionExpr(c.RequirePermission)
+	if err != nil {
+		return statusAccess{}, fmt.Errorf("Status: %v", err)
+	}
+	return statusAccess{permission: permission, allowLoopback: c.AllowLoopback}, nil
+}
+
+// Serve /router/status, which exposes counters and internal state for monitoring.
+// This is only available to other services, and to whoever Config.Status allows.
+func (s *Server) serveStatus(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case serviceauth.VerifyInterServiceRequest(req) == nil:
+	case s.status.allowLoopback && isLoopbackRequest(req):
+	case s.status.permission != nil:
+		if _, ok := s.authorize(w, req, s.status.permission); !ok {
+			return
+		}
+	default:
+		http.Error(w, "Status is only available to other services", http.StatusForbidden)
+		return
+	}
+	status := routerStatus{}
+	if s.decisions != nil {
+		status.DecisionCache = s.decisions.status()
+	}
+	if s.blocklist != nil {
+		if blocked := s.blocklist.status(); len(blocked) != 0 {
+			status.Blocked = blocked
+		}
+	}
+	if s.translator != nil {
+		for name, t := range s.passThroughTargets() {
+			if status.PassThrough == nil {
+				status.PassThrough = map[string]*passThroughStatus{}
+			}
+			pt := &passThroughStatus{Type: t.auth.config.Type}
+			if holder, ok := t.auth.provider.(sharedTokenHolder); ok {
+				pt.Token = holder.passThroughToken().status()
+			}
+			if counter, ok := t.auth.provider.(sessionCounter); ok {
+				n := counter.sessionCount()
+				pt.Sessions = &n
+			}
+			status.PassThrough[name] = pt
+		}
+		for name, t := range s.concurrencyTargets() {
+			if status.Concurrency == nil {
+				status.Concurrency = map[string]*concurrencyStatus{}
+			}
+			status.Concurrency[name] = t.concurrency.status()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&status)
+}
+
+func isLoopbackRequest(req *http.Request) bool {
+	ip := net.ParseIP(remoteIP(req))
+	return ip != nil && ip.IsLoopback()
+}
@@ -1,18 +1,19 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/IMQS/log"
+	"github.com/IMQS/router/signing"
 )
 
 type scheme string
@@ -30,48 +31,45 @@ const (
 
 // A target URL
 type target struct {
+	name              string                // Name from the Targets section of the config. Empty for inline targets.
 	baseUrl           string                // The replacement string is appended to this
 	useProxy          bool                  // True if we route this via the proxy
-	requirePermission string                // If non-empty, then first authorize before continuing
+	permissions       *permissionRules      // If not nil, then first authorize before continuing
+	allowAPIKeys      bool                  // Machine clients may use an API key instead of an IMQS session
+	basicAuth         *basicAuth            // nil unless the target is protected by an htpasswd file
+	requireClientCert bool                  // Only clients with a certificate that may use this target are allowed
+	ipRules           *blockRules           // nil unless the target has AllowIPs or DenyIPs
+	rateLimit         *rateLimit            // nil unless the target has a RateLimit
+	concurrency       *concurrencyLimiter   // nil unless the target has a Concurrency limit
+	forwardIdentity   ConfigForwardIdentity // How the target learns who the user is
+	audit             *auditRules           // nil unless requests to the target are audited
+	owner             *ownerRule            // nil unless the target belongs to individual users
+	signer            *signing.Signer       // nil unless we sign the requests that we forward to the target
 	auth              targetPassThroughAuth // Special authentication rules for this target
 }
 
-/*
-Usage of targetPassThroughAuth fields:
-
-PureHub:
-
-	token
-	tokenExpires
-
-SitePro:
-
-	none
-
-ECS:
-
-	none
-
-CouchDB:
-
-	none
-*/
+// Pass-through authentication of a target. The provider holds whatever state it needs.
 type targetPassThroughAuth struct {
-	lock         sync.RWMutex // Guards access to all state except for "config", which is immutable
 	config       ConfigPassThroughAuth
-	token        string                 // A single token shared by all users of the system. "machine to machine", without any user-specific session.
-	tokenExpires time.Time              // Expiry date of 'token'
-	tokenMap     map[string]interface{} // Map from username to token. For user-specific sessions with another machine.
-	tokenLock    map[string]bool        // If an entry exists in here for a username, then we are busy trying to log that user in.
+	provider     passThroughProvider // nil if the target has no pass-through auth
+	invalidateOn *invalidationRules  // nil if we never discard the provider's credentials
 }
 
 // A route that maps from incoming URL to a target URL
 type route struct {
-	match      string
-	matchRe    *regexp.Regexp // Parsed regular expression of 'match'
-	replace    string
-	target     *target
-	validHosts []*regexp.Regexp // If not empty, then the target hostname must be one of these regexes
+	match             string
+	matchRe           *regexp.Regexp // Parsed regular expression of 'match'
+	replace           string
+	target            *target
+	validHosts        []*regexp.Regexp // If not empty, then the target hostname must be one of these regexes
+	allowAPIKeys      bool             // Machine clients may use an API key, even if the target doesn't say so
+	basicAuth         *basicAuth       // Overrides the target's basicAuth
+	requireClientCert bool             // Only clients with a certificate that may use this route are allowed
+	ipRules           *blockRules      // nil unless the route has AllowIPs or DenyIPs. The target's rules apply too.
+	rateLimit         *rateLimit       // nil unless the route has a RateLimit. The target's limit applies too.
+	permissions       *permissionRules // Take precedence over the target's permissions
+	audit             *auditRules      // Overrides the target's audit rules
+	owner             *ownerRule       // Overrides the target's owner rule
 }
 
 func parseScheme(targetUrl string, header *http.Header) scheme {
@@ -131,16 +129,50 @@ type routeSet struct {
 }
 
 func newTarget() *target {
-	t := &target{}
-	t.auth.tokenMap = make(map[string]interface{})
-	t.auth.tokenLock = make(map[string]bool)
-	return t
+	return &target{}
+}
+
+// Returns the Basic auth rules of this route, or nil if it has none
+func (r *route) basicAuthRules() *basicAuth {
+	if r.basicAuth != nil {
+		return r.basicAuth
+	}
+	return r.target.basicAuth
+}
+
+// Returns true if the route and its target allow requests from ip
+func (r *route) allowsIP(req *http.Request, ip net.IP) bool {
+	for _, rules := range []*blockRules{r.ipRules, r.target.ipRules} {
+		if rules != nil && rules.check(req, ip) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns nil if there are no rules
+func newIPRules(allow, deny []string) (*blockRules, error) {
+	rules, err := newBlockRules(&ConfigBlockRules{AllowIPs: allow, DenyIPs: deny})
+	if err != nil || rules.isEmpty() {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Returns true if only clients with a suitable certificate may use this route
+func (r *route) requiresClientCert() bool {
+	return r.requireClientCert || r.target.requireClientCert
+}
+
+// Returns true if machine clients may use an API key on this route
+func (r *route) acceptsAPIKeys() bool {
+	return r.allowAPIKeys || r.target.allowAPIKeys
 }
 
 // A urlTranslator is responsible for taking an incoming request and rewriting it for an appropriate backend.
 type urlTranslator interface {
 	// Rewrite an incoming request. If newurl is a blank string, then the URL does not match any route.
-	processRoute(uri *url.URL) (newurl string, requirePermission string, passThroughAuth *targetPassThroughAuth)
+	processRoute(uri *url.URL) (newurl string, matched *route)
 	// Return the URL of a proxy to use for a given request
 	getProxy(errLog *log.Logger, host string) (*url.URL, error)
 	// Returns all routes
@@ -188,10 +220,10 @@ func (r *routeSet) computeCaches() error {
 	return nil
 }
 
-func (r *routeSet) processRoute(uri *url.URL) (newurl string, requirePermission string, passThroughAuth *targetPassThroughAuth) {
+func (r *routeSet) processRoute(uri *url.URL) (newurl string, matched *route) {
 	route := r.match(uri)
 	if route == nil {
-		return "", "", nil
+		return "", nil
 	}
 
 	rewritten := route.matchRe.ReplaceAllString(uri.RequestURI(), route.target.baseUrl+route.replace)
@@ -199,14 +231,14 @@ func (r *routeSet) processRoute(uri *url.URL) (newurl string, requirePermission
 	if len(route.validHosts) != 0 {
 		newURL, err := url.Parse(rewritten)
 		if err != nil {
-			return "", "", nil
+			return "", nil
 		}
 		if !route.isHostValid(newURL) {
-			return "", "", nil
+			return "", nil
 		}
 	}
 
-	return rewritten, route.target.requirePermission, &route.target.auth
+	return rewritten, route
 }
 
 func (r *routeSet) getProxy(errLog *log.Logger, host string) (*url.URL, error) {
@@ -302,13 +334,73 @@ func newUrlTranslator(config *Config) (urlTranslator, error) {
 		rs.proxy, _ = url.Parse(config.Proxy) // config.verify() ensures that the proxy is a legal URL
 	}
 
+	htpasswdFiles := map[string]*reloadingFile{}
+	basicAuthFailures := newFailureLimiter()
+	rateLimits := newRateLimitStore(maxRateLimitBuckets)
+
 	targets := map[string]*target{}
 	for name, ctarget := range config.Targets {
 		t := newTarget()
+		t.name = name
 		t.baseUrl = ctarget.URL
 		t.useProxy = ctarget.UseProxy
-		t.requirePermission = ctarget.RequirePermission
+		if t.permissions, err = newPermissionRules(ctarget.RequirePermission, ctarget.MethodPermissions); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		t.allowAPIKeys = ctarget.AllowAPIKeys
+		t.requireClientCert = ctarget.RequireClientCert
+		if t.ipRules, err = newIPRules(ctarget.AllowIPs, ctarget.DenyIPs); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		if t.rateLimit, err = newRateLimit(&ctarget.RateLimit, "target:"+name, rateLimits); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		if t.concurrency, err = newConcurrencyLimiter(&ctarget.Concurrency); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		t.forwardIdentity = ctarget.ForwardIdentity
+		switch t.forwardIdentity.Mode {
+		case ForwardIdentityNone, ForwardIdentityHeaders:
+		case ForwardIdentityJWT:
+			if config.Auth.IdentityJWT.KeyFile == "" && config.Auth.IdentityJWT.Secret == "" {
+				return nil, fmt.Errorf("Target %v: ForwardIdentity JWT needs Auth.IdentityJWT", name)
+			}
+		default:
+			return nil, fmt.Errorf("Target %v: ForwardIdentity Mode must be '%v' or '%v'", name, ForwardIdentityHeaders, ForwardIdentityJWT)
+		}
+		if t.requireClientCert && config.HTTP.ClientCerts.Mode == ClientCertNone {
+			return nil, fmt.Errorf("Target %v: RequireClientCert needs HTTP.ClientCerts", name)
+		}
+		if t.basicAuth, err = newBasicAuth(&ctarget.BasicAuth, htpasswdFiles, basicAuthFailures); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		audit := &ctarget.Audit
+		if ctarget.PassThroughAuth.Type == AuthPassThroughECS && len(audit.Rules) == 0 && audit.Unmatched == "" {
+			audit = &ecsAuditDefaults
+		}
+		if t.audit, err = newAuditRules(audit); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		owner := &ctarget.Owner
+		if ctarget.PassThroughAuth.Type == AuthPassThroughCouchDB && owner.Path == "" {
+			owner = &couchDBOwnerDefaults
+		}
+		if t.owner, err = newOwnerRule(owner); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		if t.signer, err = newRequestSigner(&ctarget.Signing); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
 		t.auth.config = ctarget.PassThroughAuth
+		if t.auth.provider, err = newPassThroughProvider(&t.auth.config); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		if t.auth.invalidateOn, err = newInvalidationRules(&t.auth.config.InvalidateOn); err != nil {
+			return nil, fmt.Errorf("Target %v: %v", name, err)
+		}
+		if _, ok := t.auth.provider.(passThroughInvalidator); t.auth.invalidateOn != nil && !ok {
+			return nil, fmt.Errorf("Target %v: PassThroughAuth type '%v' has no cached credentials, so InvalidateOn does not apply", name, t.auth.config.Type)
+		}
 		targets[name] = t
 	}
 
@@ -320,14 +412,39 @@ func newUrlTranslator(config *Config) (urlTranslator, error) {
 			configRoute.Target = str
 		} else if any, ok := replaceAny.(map[string]interface{}); ok {
 			// And here we do a little hack, serializing back to JSON, and then
-			// from that JSON, we go to ConfigRoute.
+			// from that JSON, we go to ConfigRoute. Unknown fields are rejected, the same as everywhere else in the config.
 			str, _ := json.Marshal(any)
-			if err := json.Unmarshal(str, &configRoute); err != nil {
+			decoder := json.NewDecoder(bytes.NewReader(str))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&configRoute); err != nil {
 				return nil, fmt.Errorf("Error decoding route %v: %v", match, err)
 			}
 		}
 		route := &route{}
 		route.match = match
+		route.allowAPIKeys = configRoute.AllowAPIKeys
+		route.requireClientCert = configRoute.RequireClientCert
+		if route.ipRules, err = newIPRules(configRoute.AllowIPs, configRoute.DenyIPs); err != nil {
+			return nil, fmt.Errorf("In route for '%v': %v", match, err)
+		}
+		if route.permissions, err = newPermissionRules(configRoute.RequirePermission, configRoute.MethodPermissions); err != nil {
+			return nil, fmt.Errorf("In route for '%v': %v", match, err)
+		}
+		if route.audit, err = newAuditRules(&configRoute.Audit); err != nil {
+			return nil, fmt.Errorf("In route for '%v': %v", match, err)
+		}
+		if route.owner, err = newOwnerRule(&configRoute.Owner); err != nil {
+			return nil, fmt.Errorf("In route for '%v': %v", match, err)
+		}
+		if route.rateLimit, err = newRateLimit(&configRoute.RateLimit, "route:"+match, rateLimits); err != nil {
+			return nil, fmt.Errorf("In route for '%v': %v", match, err)
+		}
+		if route.requireClientCert && config.HTTP.ClientCerts.Mode == ClientCertNone {
+			return nil, fmt.Errorf("In route for '%v': RequireClientCert needs HTTP.ClientCerts", match)
+		}
+		if route.basicAuth, err = newBasicAuth(&configRoute.BasicAuth, htpasswdFiles, basicAuthFailures); err != nil {
+			return nil, fmt.Errorf("In route for '%v': %v", match, err)
+		}
 		if len(configRoute.ValidHosts) != 0 {
 			var err error
 			route.validHosts, err = parseValidHosts(&configRoute)
@@ -0,0 +1,255 @@
+/*
+Package signing signs the requests that the IMQS router forwards to a backend, so that the backend can
+be sure that a request came through the router, and was not sent by somebody else on the internal network.
+
+The router and the backend share a secret. The signature is an HMAC-SHA256, over
+
+	the time at which the request was signed
+	the method
+	the path that the client sent to the router (the X-Original-Path header)
+	the query string
+	a list of headers, chosen by the router, and their values
+	the SHA-256 hash of the body
+
+A backend written in Go checks requests with a Verifier:
+
+	v := &signing.Verifier{Secrets: [][]byte{secret}}
+	http.ListenAndServe(":2000", v.Middleware(handler))
+
+A signed request may be replayed within MaxSkew of being signed, so backends that care about that
+should make their requests idempotent.
+*/
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers that carry the signature
+const (
+	HeaderSignature     = "X-IMQS-Signature"           // Hex encoded HMAC-SHA256
+	HeaderTimestamp     = "X-IMQS-Signature-Timestamp" // Unix seconds
+	HeaderSignedHeaders = "X-IMQS-Signed-Headers"      // Lower case names, separated by ';'
+	HeaderContentSHA256 = "X-IMQS-Content-SHA256"      // Hex encoded hash of the body
+	HeaderOriginalPath  = "X-Original-Path"            // Added by the router to every request
+)
+
+const (
+	// The first line of the string that is signed. A new signature scheme gets a new name.
+	algorithm = "IMQS-HMAC-SHA256-V1"
+
+	// Secrets must be at least this long
+	MinSecretLength = 32
+
+	DefaultMaxSkew     = 5 * time.Minute
+	DefaultMaxBodySize = 8 * 1024 * 1024
+)
+
+var (
+	ErrBodyTooLarge  = errors.New("Request body is too large to sign")
+	ErrNotSigned     = errors.New("Request is not signed")
+	ErrBadSignature  = errors.New("Request signature is invalid")
+	ErrExpired       = errors.New("Request signature has expired")
+	ErrBodyTampered  = errors.New("Request body does not match its signature")
+	ErrHeaderMissing = errors.New("Request signature does not cover a required header")
+)
+
+// Signer signs outgoing requests
+type Signer struct {
+	Secret      []byte
+	Headers     []string         // Headers that are signed, besides the method, path, query, body and timestamp
+	MaxBodySize int64            // Default DefaultMaxBodySize
+	Now         func() time.Time // Default time.Now
+}
+
+// Sign r, which the client sent to originalPath. The body is read into memory, and replaced with a copy,
+// so that it can still be sent. Bodies larger than MaxBodySize are refused with ErrBodyTooLarge.
+func (s *Signer) Sign(r *http.Request, originalPath string) error {
+	maxBodySize := s.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	body, err := ReadBody(r, maxBodySize)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	names := canonicalHeaderNames(s.Headers)
+	bodyHash := sha256.Sum256(body)
+
+	r.Header.Set(HeaderOriginalPath, originalPath)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(now().Unix(), 10))
+	r.Header.Set(HeaderSignedHeaders, strings.Join(names, ";"))
+	r.Header.Set(HeaderContentSHA256, hex.EncodeToString(bodyHash[:]))
+	r.Header.Set(HeaderSignature, hex.EncodeToString(computeSignature(s.Secret, r, originalPath, names)))
+	return nil
+}
+
+// Verifier checks the signatures of incoming requests
+type Verifier struct {
+	Secrets        [][]byte         // A request signed with any of these is accepted, so that secrets can be rotated
+	RequireHeaders []string         // Headers that the signature must cover, eg the X-IMQS-User-ID that the router forwards
+	MaxSkew        time.Duration    // How far the signing time may be from now. Default DefaultMaxSkew.
+	MaxBodySize    int64            // Default DefaultMaxBodySize
+	Now            func() time.Time // Default time.Now
+}
+
+// Verify the signature of r. The body is read into memory, and replaced with a copy, so that the
+// handler can still read it.
+func (v *Verifier) Verify(r *http.Request) error {
+	signature, err := hex.DecodeString(r.Header.Get(HeaderSignature))
+	if err != nil || len(signature) == 0 {
+		return ErrNotSigned
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return ErrNotSigned
+	}
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	maxSkew := v.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	if skew := now().Sub(time.Unix(timestamp, 0)); skew > maxSkew || skew < -maxSkew {
+		return ErrExpired
+	}
+
+	names := []string{}
+	if signed := r.Header.Get(HeaderSignedHeaders); signed != "" {
+		names = strings.Split(signed, ";")
+	}
+	for _, required := range canonicalHeaderNames(v.RequireHeaders) {
+		if !contains(names, required) {
+			return fmt.Errorf("%w: %v", ErrHeaderMissing, required)
+		}
+	}
+
+	originalPath := r.Header.Get(HeaderOriginalPath)
+	if originalPath == "" {
+		originalPath = r.URL.EscapedPath()
+	}
+	valid := false
+	for _, secret := range v.Secrets {
+		valid = valid || hmac.Equal(signature, computeSignature(secret, r, originalPath, names))
+	}
+	if !valid {
+		return ErrBadSignature
+	}
+
+	// The signature covers the claimed hash of the body, so the body itself is checked last
+	maxBodySize := v.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	body, err := ReadBody(r, maxBodySize)
+	if err != nil {
+		return err
+	}
+	bodyHash := sha256.Sum256(body)
+	if !strings.EqualFold(r.Header.Get(HeaderContentSHA256), hex.EncodeToString(bodyHash[:])) {
+		return ErrBodyTampered
+	}
+	return nil
+}
+
+// Middleware answers requests that fail verification with 401, and passes the rest on to next
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The string that is signed. The signature headers (other than the signed ones) must already be set.
+func stringToSign(r *http.Request, originalPath string, names []string) string {
+	lines := []string{
+		algorithm,
+		r.Header.Get(HeaderTimestamp),
+		r.Method,
+		originalPath,
+		r.URL.RawQuery,
+	}
+	for _, name := range names {
+		values := r.Header.Values(name)
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.TrimSpace(v)
+		}
+		lines = append(lines, name+":"+strings.Join(trimmed, ","))
+	}
+	lines = append(lines, strings.Join(names, ";"))
+	lines = append(lines, strings.ToLower(r.Header.Get(HeaderContentSHA256)))
+	return strings.Join(lines, "\n")
+}
+
+func computeSignature(secret []byte, r *http.Request, originalPath string, names []string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign(r, originalPath, names)))
+	return mac.Sum(nil)
+}
+
+// Lower case, sorted, and without duplicates
+func canonicalHeaderNames(headers []string) []string {
+	names := []string{}
+	for _, h := range headers {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" && !contains(names, h) {
+			names = append(names, h)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadBody reads the body of r into memory, and replaces it with a copy, so that r can still be sent
+// or handled. Bodies larger than maxBodySize are refused with ErrBodyTooLarge. The router also uses
+// this for other signatures that cover the body.
+func ReadBody(r *http.Request, maxBodySize int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return []byte{}, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	return body, nil
+}
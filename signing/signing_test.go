@@ -0,0 +1,107 @@
+package signing
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+	signer := &Signer{Secret: secret, Headers: []string{"Content-Type", "x-imqs-user-id"}, Now: func() time.Time { return now }}
+	verifier := &Verifier{Secrets: [][]byte{[]byte("an old secret, which is being rotated"), secret}, Now: func() time.Time { return now }}
+
+	sign := func() *http.Request {
+		t.Helper()
+		r := httptest.NewRequest("POST", "http://backend/save?id=1", strings.NewReader(`{"a": 1}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-IMQS-User-ID", "7")
+		if err := signer.Sign(r, "/api/save"); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := sign()
+	if err := verifier.Verify(r); err != nil {
+		t.Fatalf("Valid signature was rejected: %v", err)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"a": 1}` {
+		t.Errorf("Body was not preserved: %q", body)
+	}
+	if got := r.Header.Get(HeaderSignedHeaders); got != "content-type;x-imqs-user-id" {
+		t.Errorf("Unexpected signed headers %q", got)
+	}
+
+	for _, c := range []struct {
+		name     string
+		tamper   func(r *http.Request)
+		expected error
+	}{
+		{"method", func(r *http.Request) { r.Method = "DELETE" }, ErrBadSignature},
+		{"path", func(r *http.Request) { r.Header.Set(HeaderOriginalPath, "/api/delete") }, ErrBadSignature},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "id=2" }, ErrBadSignature},
+		{"header", func(r *http.Request) { r.Header.Set("X-IMQS-User-ID", "1") }, ErrBadSignature},
+		{"extra header value", func(r *http.Request) { r.Header.Add("X-IMQS-User-ID", "1") }, ErrBadSignature},
+		{"header list", func(r *http.Request) { r.Header.Set(HeaderSignedHeaders, "content-type") }, ErrBadSignature},
+		{"body", func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"a": 2}`)) }, ErrBodyTampered},
+		{"timestamp", func(r *http.Request) { r.Header.Set(HeaderTimestamp, "1700000001") }, ErrBadSignature},
+		{"signature", func(r *http.Request) { r.Header.Set(HeaderSignature, strings.Repeat("00", 32)) }, ErrBadSignature},
+		{"unsigned", func(r *http.Request) { r.Header.Del(HeaderSignature) }, ErrNotSigned},
+	} {
+		r := sign()
+		c.tamper(r)
+		if err := verifier.Verify(r); err != c.expected {
+			t.Errorf("%v: expected %v, but got %v", c.name, c.expected, err)
+		}
+	}
+
+	// An unsigned header may be anything, unless the verifier insists that it is signed
+	r = sign()
+	r.Header.Set("X-Other", "x")
+	if err := verifier.Verify(r); err != nil {
+		t.Errorf("Unsigned header caused %v", err)
+	}
+	strict := &Verifier{Secrets: [][]byte{secret}, RequireHeaders: []string{"X-Other"}, Now: verifier.Now}
+	if err := strict.Verify(sign()); !errors.Is(err, ErrHeaderMissing) {
+		t.Errorf("Expected a required header to be missing, but got %v", err)
+	}
+
+	r = sign()
+	now = now.Add(DefaultMaxSkew + time.Second)
+	if err := verifier.Verify(r); err != ErrExpired {
+		t.Errorf("Expected an old signature to expire, but got %v", err)
+	}
+
+	small := &Signer{Secret: secret, MaxBodySize: 4}
+	if err := small.Sign(httptest.NewRequest("POST", "/", strings.NewReader("12345")), "/"); err != ErrBodyTooLarge {
+		t.Errorf("Expected a large body to be refused, but got %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	handler := (&Verifier{Secrets: [][]byte{secret}}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+
+	r := httptest.NewRequest("PUT", "/x", strings.NewReader("hello"))
+	(&Signer{Secret: secret}).Sign(r, "/api/x")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("Expected the signed request to reach the handler, but got %v %v", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/x", strings.NewReader("hello")))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned request to be refused, but got %v", w.Code)
+	}
+}